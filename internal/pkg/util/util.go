@@ -108,3 +108,35 @@ func SameNetwork(ip string, ipnet string) bool {
 
 	return false
 }
+
+// IsLoopback checks whether an address from a network interface (ip+net) is
+// an IPv4 loopback address
+func IsLoopback(ipnet string) bool {
+	ip, _, err := net.ParseCIDR(ipnet)
+	if err != nil {
+		return false
+	}
+	return ip.IsLoopback() && ip.To4() != nil
+}
+
+// IsLocalHost checks whether a host, i.e., a name or an IP, refers to the
+// local host: a loopback address or the address of one of the local network
+// interfaces
+func IsLocalHost(host string, ifaces []NetIface) bool {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, iface := range ifaces {
+			ifaceIP, _, err := net.ParseCIDR(iface.Addr)
+			if err == nil && ifaceIP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -85,3 +85,41 @@ func TestSameNetwork(t *testing.T) {
 		})
 	}
 }
+
+func TestIsLocalHost(t *testing.T) {
+	ifaces := []NetIface{
+		{
+			Name: "eth0",
+			Addr: "192.168.1.2/24",
+		},
+	}
+	tests := []struct {
+		name     string
+		host     string
+		expected bool
+	}{
+		{
+			name:     "loopback",
+			host:     "127.0.0.1",
+			expected: true,
+		},
+		{
+			name:     "local interface",
+			host:     "192.168.1.2",
+			expected: true,
+		},
+		{
+			name:     "remote host",
+			host:     "192.168.1.3",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if IsLocalHost(tt.host, ifaces) != tt.expected {
+				t.Fatalf("%s case: %s expected to be local: %v", tt.name, tt.host, tt.expected)
+			}
+		})
+	}
+}
@@ -17,26 +17,43 @@ import (
 // Connection is a structure representing a connection regardless of the
 // underlying transport
 type Connection struct {
-	transport Transport
+	transport *Transport
 
 	// Save the actual connection
 	tcpConn net.Conn
+
+	// LocalID is the ID of the local endpoint of the connection
+	LocalID string
+
+	// RemoteID is the ID of the remote endpoint of the connection
+	RemoteID string
+}
+
+// Send sends a message to the remote endpoint of a connection
+func (c *Connection) Send(data []byte) error {
+	if c == nil || c.transport == nil {
+		return fmt.Errorf("undefined connection")
+	}
+	return c.transport.SendTo(c.LocalID, c.RemoteID, data)
 }
 
 // Close closes a given connection
 func (c *Connection) Close() error {
-	if c == nil {
+	if c == nil || c.transport == nil {
 		return nil
 	}
 
-	switch c.transport.Priv.(type) {
-	case *transport.TCPTransport:
-		err := c.transport.TCP.Close()
-		if err != nil {
-			return err
-		}
-	default:
+	if c.transport.Concrete == nil {
 		return fmt.Errorf("unknown transport type")
 	}
+	// Connections accepted from a client only close the connection of that
+	// client, the transport keeps accepting connections
+	if acceptor, ok := c.transport.Concrete.(transport.PeerAcceptor); ok && c.RemoteID != "" {
+		return acceptor.ClosePeer(c.RemoteID)
+	}
+	err := c.transport.Concrete.Close()
+	if err != nil {
+		return err
+	}
 	return nil
 }
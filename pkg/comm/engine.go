@@ -8,11 +8,14 @@
 package comm
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/gvallee/comm/internal/pkg/util"
+	"github.com/gvallee/comm/pkg/transport"
 	"github.com/gvallee/event/pkg/event"
 )
 
@@ -33,6 +36,15 @@ const (
 type EngineCfg struct {
 	// Mode of the engine, e.g., 'Auto' or 'Minimalist'.
 	Mode string
+
+	// LoopbackZeroCopy specifies whether messages between endpoints of the
+	// engine are handed over without copy, in which case the sender must not
+	// modify the data once sent
+	LoopbackZeroCopy bool
+
+	// Logger is the logger of the engine, also used by the transports it
+	// instantiates in 'auto' mode; nothing is logged if not set
+	Logger Logger
 }
 
 // Engine is a structure representing a communication engine. It is allowed to have multiple
@@ -42,27 +54,49 @@ type Engine struct {
 	transports  []*Transport
 	cfg         EngineCfg
 	eventEngine event.Engine
-	eps         map[string]*Endpoint
+
+	// eps are the endpoints of the engine, indexed by ID
+	eps map[string]*Endpoint
+	// loopback is the in-process transport connecting endpoints of the
+	// engine, created the first time it is needed
+	loopback *Transport
+	// epsLock protects eps and loopback, endpoints being created and closed
+	// concurrently
+	epsLock sync.RWMutex
 }
 
 func (e *Engine) initResourceDiscovery() error {
+	if registerErr != nil {
+		return registerErr
+	}
+
 	var err error
 	e.ifaces, err = util.GetLocalInferfaces()
 	if err != nil {
 		return fmt.Errorf("unable to detect local network interfaces: %w", err)
 	}
 
-	// For all IPv4 addresses, initiate a TCP transport and a thread to accept incoming
-	// connections using a default port
+	// For all network interfaces, instantiate all the registered concrete transports
+	// that can be used with it. Concrete transports are then ranked based on their
+	// priority.
+	ids := transport.RegisteredIDs()
 	for _, iface := range e.ifaces {
-		if strings.HasSuffix(iface.Addr, "/8") || strings.HasSuffix(iface.Addr, "/24") {
-			ip := strings.TrimSuffix(iface.Addr, "/8")
-			ip = strings.TrimSuffix(iface.Addr, "/24")
-			// todo: we clearly need the IP but do we need to save the interface as well to ease
-			// later lookup in order to find the interface to perform a connect?
-			tpt := e.createAutoTCPTransport(iface, ip)
-			if tpt == nil {
-				return fmt.Errorf("unable to instantiate a TCP transport for %s", ip)
+		res := transport.Resource{
+			Name:   iface.Name,
+			Addr:   iface.Addr,
+			Logger: e.cfg.Logger,
+		}
+		for _, id := range ids {
+			factory, ok := transport.GetFactory(id)
+			if !ok {
+				continue
+			}
+			if factory.Probe != nil && !factory.Probe(res) {
+				continue
+			}
+			_, err := e.createAutoTransport(factory, res)
+			if err != nil {
+				return fmt.Errorf("unable to instantiate a %s transport for %s: %w", id, iface.Addr, err)
 			}
 		}
 	}
@@ -71,7 +105,7 @@ func (e *Engine) initResourceDiscovery() error {
 }
 
 // Init creates a new configuration engine from a given configuration
-func (cfg *EngineCfg) Init() *Engine {
+func (cfg *EngineCfg) Init() (*Engine, error) {
 	var e Engine
 	e.cfg = *cfg
 	e.eps = make(map[string]*Endpoint)
@@ -79,40 +113,93 @@ func (cfg *EngineCfg) Init() *Engine {
 	if cfg.Mode == Auto {
 		err := e.initResourceDiscovery()
 		if err != nil {
-			log.Println("[ERROR:engine] unable to detect local network interfaces: %w", err)
-			return nil
+			return nil, fmt.Errorf("unable to detect local network interfaces: %w", err)
 		}
 	}
 
-	return &e
+	return &e, nil
 }
 
 // AddTransport adds a transport to a given communication engine.
-func (e *Engine) AddTransport(tpt interface{}) *Transport {
-	if e == nil || tpt == nil {
-		log.Printf("[ERROR:engine] invalid parameter(s); unable to add transport")
-		return nil
-	}
-
+func (e *Engine) AddTransport(tpt interface{}) (*Transport, error) {
 	newTransportCfg := TransportCfg{
 		ID:             "",
-		TransportMode:  "",
-		ConnectionMode: "",
+		TransportMode:  ExplicitTransportMode,
+		ConnectionMode: MultiplexConnectionMode,
 	}
-	newTransport := newTransportCfg.Init()
+	return e.AddTransportWithCfg(newTransportCfg, tpt)
+}
 
-	err := newTransport.Add(tpt)
+// AddTransportWithCfg adds a transport with a specific configuration (e.g.,
+// connection mode) to a given communication engine.
+func (e *Engine) AddTransportWithCfg(cfg TransportCfg, tpt interface{}) (*Transport, error) {
+	if e == nil {
+		return nil, ErrInvalidEngine
+	}
+	if tpt == nil {
+		return nil, fmt.Errorf("undefined transport")
+	}
+
+	newTransport, err := cfg.Init()
 	if err != nil {
-		log.Printf("[ERROR:engine] unable to add transport: %s", err)
-		return nil
+		return nil, err
+	}
+
+	err = newTransport.Add(tpt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to add transport: %w", err)
 	}
 	e.transports = append(e.transports, newTransport)
 	newTransport.commEngine = e
 
-	return newTransport
+	return newTransport, nil
+}
+
+// getLoopbackTransport returns the in-process transport connecting the
+// endpoints of the engine. It is not part of the transports of the engine so
+// that it is never used to reach remote endpoints.
+func (e *Engine) getLoopbackTransport() (*Transport, error) {
+	e.epsLock.Lock()
+	defer e.epsLock.Unlock()
+	if e.loopback != nil {
+		return e.loopback, nil
+	}
+
+	cfg := TransportCfg{
+		TransportMode:  ExplicitTransportMode,
+		ConnectionMode: MultiplexConnectionMode,
+	}
+	tpt, err := cfg.Init()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create loopback transport: %w", err)
+	}
+	loopbackCfg := transport.LoopbackTransportCfg{
+		ZeroCopy: e.cfg.LoopbackZeroCopy,
+	}
+	err = tpt.Add(loopbackCfg.Init())
+	if err != nil {
+		return nil, fmt.Errorf("unable to add loopback transport: %w", err)
+	}
+	tpt.commEngine = e
+
+	// All the endpoints of the engine are reachable through the transport
+	for _, ep := range e.eps {
+		tpt.addEndpoint(ep)
+	}
+	e.loopback = tpt
+
+	return tpt, nil
+}
+
+// rankTransports sorts the transports of the engine by decreasing priority
+func (e *Engine) rankTransports() {
+	sort.SliceStable(e.transports, func(i, j int) bool {
+		return e.transports[i].priority > e.transports[j].priority
+	})
 }
 
 func (e *Engine) getNextTransport() int {
+	// Transports are ranked, the first one has the highest priority
 	// todo: do not only use the first transport available
 	return 0
 }
@@ -122,29 +209,89 @@ func (e *Engine) GetEvent() event.Event {
 	return *(e.eventEngine.GetEvent(true))
 }
 
-func (e *Engine) createEndpointForIface(iface util.NetIface, ip string) *Endpoint {
-	tpt := e.getTransportFromIface(iface)
-	if tpt == nil {
-		log.Printf("[ERROR:engine] Unable to get transport for %s\n", iface.Name)
-		return nil
+// createEndpointForIface creates an endpoint connected through one of the
+// transports of a network interface, trying them by decreasing priority
+func (e *Engine) createEndpointForIface(ctx context.Context, iface util.NetIface, ip string) (*Endpoint, error) {
+	tpts := e.getTransportsFromIface(iface)
+	if len(tpts) == 0 {
+		return nil, fmt.Errorf("unable to get transport for %s", iface.Name)
 	}
 
-	// Use that endpoint to connect to server
-	targetEP := tpt.Connect()
-	if targetEP == nil {
-		log.Println("[ERROR:engine] Unable to connect to endpoint")
-		return nil
+	var lastErr error
+	for _, tpt := range tpts {
+		// Use that endpoint to connect to server
+		targetEP, err := tpt.ConnectContext(ctx)
+		if err == nil {
+			return targetEP, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		e.logger("engine").Warn("unable to connect using "+tpt.ConcreteID+" transport", peerField(ip), errField(err))
+		lastErr = err
 	}
 
-	return targetEP
+	return nil, fmt.Errorf("unable to connect using the transports of %s: %w", iface.Name, lastErr)
+}
+
+// connectLocalEP creates an endpoint connected to another endpoint of the
+// engine using the in-process loopback transport
+func (e *Engine) connectLocalEP(ctx context.Context, dstID string) (*Endpoint, error) {
+	tpt, err := e.getLoopbackTransport()
+	if err != nil {
+		return nil, err
+	}
+	ep, err := e.CreateEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	err = tpt.connectEP(ctx, ep, dstID)
+	if err != nil {
+		ep.Close()
+		return nil, fmt.Errorf("unable to connect to local endpoint: %w", err)
+	}
+	return ep, nil
 }
 
 // Connect will establish a connection to a remote endpoint. This function
-// is meant to be used with a communication engine in 'Auto' mode.
-func (e *Engine) Connect(id string) *Endpoint {
-	if e == nil || e.cfg.Mode != Auto {
-		log.Println("[ERROR:engine] invalid engine")
-		return nil
+// is meant to be used with a communication engine in 'Auto' mode, unless
+// the remote endpoint is an endpoint of the engine, identified by its ID, in
+// which case the in-process loopback transport is used. When the remote
+// endpoint is on the local host, the transports of the loopback interface are
+// used, i.e., shared memory and otherwise Unix domain sockets.
+func (e *Engine) Connect(id string) (*Endpoint, error) {
+	return e.ConnectContext(context.Background(), id)
+}
+
+// ConnectContext establishes a connection to a remote endpoint like Connect
+// until the context is done, in which case the error of the context is
+// returned, e.g., context.DeadlineExceeded
+func (e *Engine) ConnectContext(ctx context.Context, id string) (*Endpoint, error) {
+	if e == nil {
+		return nil, ErrInvalidEngine
+	}
+
+	// The remote endpoint may be an endpoint of the engine
+	if e.LookupEP(id) != nil {
+		return e.connectLocalEP(ctx, id)
+	}
+
+	if e.cfg.Mode != Auto {
+		return nil, fmt.Errorf("%w: %s is not a local endpoint and the engine is not in auto mode", ErrInvalidEngine, id)
+	}
+
+	if util.IsLocalHost(id, e.ifaces) {
+		for _, iface := range e.ifaces {
+			if util.IsLoopback(iface.Addr) {
+				ep, err := e.createEndpointForIface(ctx, iface, id)
+				if err == nil {
+					return ep, nil
+				}
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+			}
+		}
 	}
 
 	// Try to find a network interface we can use
@@ -152,17 +299,20 @@ func (e *Engine) Connect(id string) *Endpoint {
 		if strings.Contains(iface.Addr, id) || util.SameNetwork(iface.Addr, id) {
 			// The exact same interface is present locally,
 			// we can connect using the default connection values (e.g., port)
-			ep := e.createEndpointForIface(iface, id)
-			if ep == nil {
+			ep, err := e.createEndpointForIface(ctx, iface, id)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
 				// We are unable to create the endpoint, we try with the next network interface
 				continue
 			}
 
-			return ep
+			return ep, nil
 		}
 	}
 
 	// We did not manage to find a suitable network interface to connect to the
 	// remote endpoint
-	return nil
+	return nil, fmt.Errorf("no suitable network interface to connect to %s", id)
 }
@@ -8,15 +8,20 @@
 package comm
 
 import (
+	"context"
+	"errors"
 	"log"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gvallee/comm/pkg/transport"
 )
 
 const (
-	tcpServerURL = "127.0.0.1"
-	msgStr       = "Hello World"
+	tcpServerURL   = "127.0.0.1"
+	msgStr         = "Hello World"
+	peerClosedPort = 45500
 )
 
 func magicRecvRoutine(t *testing.T) {
@@ -27,13 +32,14 @@ func magicRecvRoutine(t *testing.T) {
 	engineCfg := EngineCfg{
 		Mode: Auto,
 	}
-	commEngine := engineCfg.Init()
-	if commEngine == nil {
-		t.Fatal("unable to start engine")
+	_, err := engineCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to start engine: %s", err)
 	}
 }
 
-func recvRoutine(t *testing.T) {
+func recvRoutine(t *testing.T, done chan bool) {
+	defer close(done)
 
 	// Create a minimalist engine, we do not want much by default since we will
 	// add manually the TCP transport, which will in turn switch the engine to
@@ -41,7 +47,10 @@ func recvRoutine(t *testing.T) {
 	engineCfg := EngineCfg{
 		Mode: Minimalist,
 	}
-	commEngine := engineCfg.Init()
+	commEngine, err := engineCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
 
 	serverCfg := transport.TCPTransportCfg{
 		Interface: tcpServerURL,
@@ -49,18 +58,21 @@ func recvRoutine(t *testing.T) {
 		PortHigh:  44444,
 		Accept:    true,
 	}
-	tcpTransport := serverCfg.Init()
+	tcpTransport, err := serverCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to initialize transport: %s", err)
+	}
 
-	tpt := commEngine.AddTransport(tcpTransport)
-	if tpt == nil {
-		t.Fatalf("unable to add transport")
+	tpt, err := commEngine.AddTransport(tcpTransport)
+	if err != nil {
+		t.Fatalf("unable to add transport: %s", err)
 	}
 
 	// Since accept is set to true, creating an endpoint with a single TCP transport
 	// automatically create a Go routine that will accept incoming connections
-	ep := commEngine.CreateEndpoint()
-	if ep == nil {
-		t.Fatal("unable to create endpoint")
+	ep, err := commEngine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
 	}
 
 	log.Println("Server: receiving message...")
@@ -74,43 +86,56 @@ func recvRoutine(t *testing.T) {
 
 func TestBasicSendRecv(t *testing.T) {
 	// Create recv routine acting as a server
-	go recvRoutine(t)
+	done := make(chan bool)
+	go recvRoutine(t, done)
 
 	engineCfg := EngineCfg{
 		Mode: Minimalist,
 	}
-	commEngine := engineCfg.Init()
+	commEngine, err := engineCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
 
 	serverCfg := transport.TCPTransportCfg{
 		Interface: tcpServerURL,
 		PortLow:   33333,
 		Accept:    false,
 	}
-	tcpTransport := serverCfg.Init()
-	if tcpTransport == nil {
-		t.Fatal("unable to initialize transport")
+	tcpTransport, err := serverCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to initialize transport: %s", err)
 	}
 
-	tpt := commEngine.AddTransport(tcpTransport)
-	if tpt == nil {
-		t.Fatal("unable to add transport")
+	tpt, err := commEngine.AddTransport(tcpTransport)
+	if err != nil {
+		t.Fatalf("unable to add transport: %s", err)
 	}
 
 	// Use that endpoint to connect to server
-	targetEP := tpt.Connect()
-	if targetEP == nil {
-		t.Fatalf("unable to connect to endpoint")
+	targetEP, err := tpt.Connect()
+	if err != nil {
+		t.Fatalf("unable to connect to endpoint: %s", err)
 	}
 
 	// Send a few messages
 	msg := []byte(msgStr)
 
-	// todo: do not rely on transport.Send but wait for a send completion event so we can check
-	// how much data was sent
-	err := targetEP.Send(msg)
+	// Wait for the send completion event so we can check how much data was sent
+	err = targetEP.SendNotify(msg, []byte(msgStr))
 	if err != nil {
 		t.Fatal("failed to send message")
 	}
+	userCtx, size, err := targetEP.WaitSendCompletion()
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if string(userCtx) != msgStr || size != len(msg) {
+		t.Fatalf("completion of %d bytes with context %s", size, string(userCtx))
+	}
+
+	// The server receives the message through the progress thread of its endpoint
+	<-done
 
 	// This will emit a termination event and make sure everything is going to
 	// be cleanly finalized
@@ -123,14 +148,235 @@ func TestMagicComm(t *testing.T) {
 	engineCfg := EngineCfg{
 		Mode: Auto,
 	}
-	commEngine := engineCfg.Init()
-	if commEngine == nil {
-		t.Fatal("unable to create communication engine")
+	commEngine, err := engineCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to create communication engine: %s", err)
 	}
 
 	log.Println("Connection to endpoint on 127.0.0.1")
-	ep := commEngine.Connect("127.0.0.1")
-	if ep == nil {
-		t.Fatal("unable to connect to remote endpoint")
+	ep, err := commEngine.Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("unable to connect to remote endpoint: %s", err)
+	}
+	// The remote endpoint is on the local host
+	if ep.transports[0].ConcreteID != transport.SMTransportID {
+		t.Fatalf("connected using %s transport instead of %s", ep.transports[0].ConcreteID, transport.SMTransportID)
+	}
+
+	// The shared memory segment connects a single pair of transports, Unix
+	// domain sockets are used for other connections
+	ep, err = commEngine.Connect("127.0.0.1")
+	if err != nil {
+		t.Fatalf("unable to connect to remote endpoint: %s", err)
+	}
+	if ep.transports[0].ConcreteID != transport.UnixTransportID {
+		t.Fatalf("connected using %s transport instead of %s", ep.transports[0].ConcreteID, transport.UnixTransportID)
+	}
+}
+
+func TestEndpointClose(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	closedEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+	serverEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+	ep, err := engine.Connect(serverEP.ID)
+	if err != nil {
+		t.Fatalf("unable to connect to local endpoint: %s", err)
+	}
+
+	// The first endpoint receives the messages of the loopback transport; once
+	// closed, another endpoint must take over
+	err = closedEP.Close()
+	if err != nil {
+		t.Fatalf("unable to close endpoint: %s", err)
+	}
+	if engine.LookupEP(closedEP.ID) != nil {
+		t.Fatal("closed endpoint still registered")
+	}
+
+	err = ep.Send([]byte(msgStr))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	if string(serverEP.Recv()) != msgStr {
+		t.Fatal("message corrupted")
+	}
+}
+
+func TestIdleEndpoint(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	idleEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+	serverEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+	idleClient, err := engine.Connect(idleEP.ID)
+	if err != nil {
+		t.Fatalf("unable to connect to local endpoint: %s", err)
+	}
+	client, err := engine.Connect(serverEP.ID)
+	if err != nil {
+		t.Fatalf("unable to connect to local endpoint: %s", err)
+	}
+
+	// The messages of an endpoint that does not receive them do not stall
+	// the other endpoints sharing the loopback transport
+	for i := 0; i < 2; i++ {
+		err = idleClient.Send([]byte(msgStr))
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
+	}
+	err = client.Send([]byte(msgStr))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := serverEP.RecvContext(ctx)
+	if err != nil {
+		t.Fatalf("unable to receive message: %s", err)
+	}
+	if string(data) != msgStr {
+		t.Fatal("message corrupted")
+	}
+	if string(idleEP.Recv()) != msgStr {
+		t.Fatal("message corrupted")
+	}
+}
+
+func TestConcurrentEndpoints(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+
+	// Endpoints are created, connected and closed concurrently, the loopback
+	// transport being lazily created by the first connection
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ep, err := engine.Connect(serverEP.ID)
+			if err != nil {
+				t.Errorf("unable to connect to local endpoint: %s", err)
+				return
+			}
+			err = ep.Close()
+			if err != nil {
+				t.Errorf("unable to close endpoint: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if engine.LookupEP(serverEP.ID) == nil {
+		t.Fatal("server endpoint not registered")
+	}
+}
+
+func TestEngineErrors(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	ep, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+
+	err = ep.Send([]byte(msgStr))
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("send returned %v instead of %s", err, ErrNotConnected)
+	}
+
+	// Only an engine in auto mode connects to remote endpoints
+	_, err = engine.Connect("127.0.0.1")
+	if !errors.Is(err, ErrInvalidEngine) {
+		t.Fatalf("connect returned %v instead of %s", err, ErrInvalidEngine)
+	}
+}
+
+func TestPeerClosed(t *testing.T) {
+	// The server only accepts the connection, which is then closed
+	serverCfg := transport.TCPTransportCfg{
+		Interface: tcpServerURL,
+		PortLow:   peerClosedPort,
+		PortHigh:  peerClosedPort,
+		Accept:    true,
+	}
+	accepted := make(chan *transport.TCPTransport, 1)
+	go func() {
+		serverTCP, err := serverCfg.Init()
+		if err != nil {
+			t.Errorf("unable to initialize transport: %s", err)
+		}
+		accepted <- serverTCP
+	}()
+
+	clientEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	clientCfg := transport.TCPTransportCfg{
+		Interface: tcpServerURL,
+		PortLow:   peerClosedPort,
+	}
+	clientTCP, err := clientCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to initialize transport: %s", err)
+	}
+	tpt, err := clientEngine.AddTransport(clientTCP)
+	if err != nil {
+		t.Fatalf("unable to add transport: %s", err)
+	}
+	ep, err := tpt.Connect()
+	if err != nil {
+		t.Fatalf("unable to connect to endpoint: %s", err)
+	}
+
+	serverTCP := <-accepted
+	if serverTCP == nil {
+		return
+	}
+
+	// Sends fail once the client notices that the connection is closed
+	serverTCP.Close()
+	deadline := time.Now().Add(time.Second)
+	err = ep.Send([]byte(msgStr))
+	for err == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		err = ep.Send([]byte(msgStr))
+	}
+	if !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("send returned %v instead of %s", err, ErrPeerClosed)
+	}
+
+	// The send completions carry the error as is
+	err = ep.SendNotify([]byte(msgStr), nil)
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	_, _, err = ep.WaitSendCompletion()
+	if !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("send completed with %v instead of %s", err, ErrPeerClosed)
 	}
 }
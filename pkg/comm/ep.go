@@ -8,8 +8,11 @@
 package comm
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
-	"log"
+	"reflect"
+	"sync"
 
 	"github.com/gvallee/comm/internal/pkg/util"
 	"github.com/gvallee/comm/pkg/transport"
@@ -19,42 +22,371 @@ import (
 const (
 	defaultEPNumEvts = 4096
 
-	userDataEventTypeID = "ep:evt:data"
+	userDataEventTypeID       = "ep:evt:data"
+	sendCompletionEventTypeID = "ep:evt:sendcompletion"
+
+	/* Data of the send completion events */
+	sendCompletionCtxIdx  = 0
+	sendCompletionSizeIdx = 1
+	sendCompletionErrIdx  = 2
 )
 
 // Endpoint is a structure representing an endpoint
 type Endpoint struct {
 	conns       []Connection
-	transports  []Transport
+	transports  []*Transport
 	engine      *Engine
 	eventTypes  map[string]*event.EventType
 	eventEngine *event.Engine
 
+	// peerID is the ID of the remote endpoint the endpoint is connected to, if any
+	peerID string
+	// peerTransport is the transport used to connect to the remote endpoint, if any
+	peerTransport *Transport
+
 	// ID is the locally unique endpoint identifier (256-character string)
 	ID string
 
 	// RXEvent is a queue of events where events associated to receive completion are stored
 	// and ready for the application to use
 	RXEvents chan event.Event
+
+	// rxQueue are the RX events delivered by the transports and not yet
+	// handed over to RXEvents, so that an endpoint that does not receive
+	// its messages does not stall the other endpoints of its transports.
+	// The number of events of the endpoint bounds its size.
+	rxQueue      []event.Event
+	rxQueueLock  sync.Mutex
+	rxQueueCheck chan struct{}
+
+	// TXEvents is a queue of events where events associated to the completion
+	// of the messages sent using SendNotify are stored and ready for the
+	// application to use
+	TXEvents chan event.Event
+
+	// sendErrs are the errors of the send completion events not consumed
+	// yet, indexed by the ID stored in the event, so that the errors are
+	// returned as is by WaitSendCompletion
+	sendErrs     map[uint64]error
+	nextSendErr  uint64
+	sendErrsLock sync.Mutex
+
+	// postedRecvs are the receives posted using Irecv, completed in order;
+	// it is closed, under postLock, once the endpoint is closed
+	postedRecvs chan *Request
+	postLock    sync.RWMutex
+
+	// tagMatcher matches the tagged messages with the tagged receives
+	tagMatcher tagMatcher
+
+	// heldMsgs are the received messages that did not match the receives
+	// waiting for a message so far, see recvMatching
+	heldMsgs []*Msg
+	// receiving specifies whether a receive is waiting for the next RX event
+	receiving bool
+	recvLock  sync.Mutex
+	recvCond  *sync.Cond
+
+	// drained are the transports whose messages are received by the
+	// progress thread of the endpoint
+	drained      []*Transport
+	drainedLock  sync.Mutex
+	drainedCheck chan struct{}
+
+	// done is closed once the endpoint is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// sendTransport returns the transport used to send messages to the remote endpoint
+func (ep *Endpoint) sendTransport() *Transport {
+	if ep.peerTransport != nil {
+		return ep.peerTransport
+	}
+	// todo: do not only use the first transport
+	if len(ep.transports) == 0 {
+		return nil
+	}
+	return ep.transports[0]
 }
 
 // Send sends a message to a given endpoint
 func (ep *Endpoint) Send(data []byte) error {
-	// todo: do not only use the first transport=
-	return ep.transports[0].Send(ep.ID, data)
+	tpt := ep.sendTransport()
+	if tpt == nil {
+		return fmt.Errorf("endpoint %s: %w", ep.ID, ErrNotConnected)
+	}
+	return tpt.SendTo(ep.ID, ep.peerID, data)
+}
+
+// SendContext sends a message like Send until the context is done, in which
+// case the error of the context is returned, e.g., context.DeadlineExceeded.
+// The message may still be sent once the context is done; the data is
+// therefore copied and can be reused as soon as SendContext returns. Only
+// the transports implementing transport.ContextSender can be interrupted
+// while sending, the context is otherwise only checked before sending.
+func (ep *Endpoint) SendContext(ctx context.Context, data []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if ctx.Done() == nil {
+		// The context can never be done
+		return ep.Send(data)
+	}
+	tpt := ep.sendTransport()
+	if tpt == nil {
+		return fmt.Errorf("endpoint %s: %w", ep.ID, ErrNotConnected)
+	}
+
+	msg := make([]byte, len(data))
+	copy(msg, data)
+	return tpt.sendToContext(ctx, ep.ID, ep.peerID, msg)
+}
+
+// Isend starts sending a message to the remote endpoint without blocking and
+// returns a request completed once the message is sent. The data must not be
+// modified until the request completes.
+func (ep *Endpoint) Isend(data []byte) *Request {
+	req := newRequest()
+	tpt := ep.sendTransport()
+	if tpt == nil {
+		req.complete(0, nil, fmt.Errorf("endpoint %s: %w", ep.ID, ErrNotConnected))
+		return req
+	}
+	tpt.sendNotify(ep.ID, ep.peerID, data, func(size int, err error) {
+		req.complete(size, nil, err)
+	})
+	return req
+}
+
+// SendNotify sends a message to the remote endpoint without blocking. Once
+// the message is written to the wire, a send completion event carrying the
+// user context is emitted to TXEvents. The data must not be modified until
+// then.
+func (ep *Endpoint) SendNotify(data []byte, userCtx []byte) error {
+	tpt := ep.sendTransport()
+	if tpt == nil {
+		return fmt.Errorf("endpoint %s: %w", ep.ID, ErrNotConnected)
+	}
+	tpt.sendNotify(ep.ID, ep.peerID, data, func(size int, err error) {
+		ep.emitSendCompletion(userCtx, size, err)
+	})
+	return nil
+}
+
+// emitSendCompletion emits the completion event of a message sent using
+// SendNotify. It is called by the send thread of the transport and therefore
+// never blocks.
+func (ep *Endpoint) emitSendCompletion(userCtx []byte, size int, sendErr error) {
+	evt := ep.eventEngine.GetEvent(false)
+	if evt == nil {
+		ep.engine.logger("endpoint").Error(fmt.Sprintf("unable to get an event, completion of a %d bytes message dropped", size), epField(ep.ID))
+		return
+	}
+	evt.SetType(sendCompletionEventTypeID)
+	evt.Data[sendCompletionCtxIdx] = userCtx
+	evt.Data[sendCompletionSizeIdx] = make([]byte, 8)
+	binary.LittleEndian.PutUint64(evt.Data[sendCompletionSizeIdx], uint64(size))
+	evt.Data[sendCompletionErrIdx] = nil
+	var errID uint64
+	if sendErr != nil {
+		ep.sendErrsLock.Lock()
+		ep.nextSendErr++
+		errID = ep.nextSendErr
+		ep.sendErrs[errID] = sendErr
+		ep.sendErrsLock.Unlock()
+		evt.Data[sendCompletionErrIdx] = make([]byte, 8)
+		binary.LittleEndian.PutUint64(evt.Data[sendCompletionErrIdx], errID)
+	}
+
+	select {
+	case ep.TXEvents <- *evt:
+	default:
+		ep.engine.logger("endpoint").Error(fmt.Sprintf("too many pending send completions, completion of a %d bytes message dropped", size), epField(ep.ID))
+		ep.takeSendErr(errID)
+		ep.eventEngine.Return(evt)
+	}
+}
+
+// takeSendErr returns and forgets the error of a send completion event
+func (ep *Endpoint) takeSendErr(errID uint64) error {
+	ep.sendErrsLock.Lock()
+	defer ep.sendErrsLock.Unlock()
+	err := ep.sendErrs[errID]
+	delete(ep.sendErrs, errID)
+	return err
+}
+
+// WaitSendCompletion waits for the next send completion event and returns the
+// user context of the message, the number of bytes sent and the error that
+// prevented the message to be sent, if any
+func (ep *Endpoint) WaitSendCompletion() ([]byte, int, error) {
+	evt := <-ep.TXEvents
+	userCtx := evt.Data[sendCompletionCtxIdx]
+	size := int(binary.LittleEndian.Uint64(evt.Data[sendCompletionSizeIdx]))
+	var err error
+	if evt.Data[sendCompletionErrIdx] != nil {
+		err = ep.takeSendErr(binary.LittleEndian.Uint64(evt.Data[sendCompletionErrIdx]))
+	}
+	for _, i := range []int{sendCompletionCtxIdx, sendCompletionSizeIdx, sendCompletionErrIdx} {
+		evt.Data[i] = nil
+	}
+	ep.eventEngine.Return(&evt)
+	return userCtx, size, err
+}
+
+// Irecv posts a receive without blocking and returns a request completed once
+// a message is received. Posted receives are completed in order and must not
+// be mixed with concurrent calls to Recv. The receives pending or posted once
+// the endpoint is closed complete with ErrEndpointClosed.
+func (ep *Endpoint) Irecv() *Request {
+	req := newRequest()
+	ep.postLock.RLock()
+	defer ep.postLock.RUnlock()
+	select {
+	case <-ep.done:
+		req.complete(0, nil, fmt.Errorf("endpoint %s: %w", ep.ID, ErrEndpointClosed))
+		return req
+	default:
+	}
+	select {
+	case ep.postedRecvs <- req:
+	case <-ep.done:
+		req.complete(0, nil, fmt.Errorf("endpoint %s: %w", ep.ID, ErrEndpointClosed))
+	}
+	return req
+}
+
+// queueRX queues a RX event for the endpoint without blocking; false is
+// returned if the endpoint is closed
+func (ep *Endpoint) queueRX(evt *event.Event) bool {
+	ep.rxQueueLock.Lock()
+	select {
+	case <-ep.done:
+		ep.rxQueueLock.Unlock()
+		return false
+	default:
+	}
+	ep.rxQueue = append(ep.rxQueue, *evt)
+	ep.rxQueueLock.Unlock()
+
+	select {
+	case ep.rxQueueCheck <- struct{}{}:
+	default:
+		// The RX thread is already notified
+	}
+	return true
+}
+
+// rxThread hands the queued RX events over to RXEvents, in order, until the
+// endpoint is closed; the events still queued then are dropped
+func (ep *Endpoint) rxThread() {
+	for {
+		ep.rxQueueLock.Lock()
+		if len(ep.rxQueue) == 0 {
+			ep.rxQueueLock.Unlock()
+			select {
+			case <-ep.rxQueueCheck:
+				continue
+			case <-ep.done:
+				ep.dropRX()
+				return
+			}
+		}
+		evt := ep.rxQueue[0]
+		ep.rxQueue = ep.rxQueue[1:]
+		ep.rxQueueLock.Unlock()
+
+		select {
+		case ep.RXEvents <- evt:
+		case <-ep.done:
+			getRXEventMsg(&evt)
+			ep.eventEngine.Return(&evt)
+			ep.dropRX()
+			return
+		}
+	}
+}
+
+// dropRX drops the RX events queued once the endpoint is closed
+func (ep *Endpoint) dropRX() {
+	ep.rxQueueLock.Lock()
+	queued := ep.rxQueue
+	ep.rxQueue = nil
+	ep.rxQueueLock.Unlock()
+	for i := range queued {
+		getRXEventMsg(&queued[i])
+		ep.eventEngine.Return(&queued[i])
+	}
+}
+
+// progressRecvs completes the posted receives as messages are received, until
+// the endpoint is closed; the receives still posted then complete with an
+// error
+func (ep *Endpoint) progressRecvs() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ep.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for req := range ep.postedRecvs {
+		msg, err := ep.RecvMsgContext(ctx)
+		if err != nil {
+			req.complete(0, nil, fmt.Errorf("endpoint %s: %w", ep.ID, ErrEndpointClosed))
+			continue
+		}
+		req.complete(len(msg.Data), msg, nil)
+	}
+}
+
+// PeerIdentity returns the identity of the remote endpoint as verified by the
+// transport, e.g., the common name of its TLS certificate. It is empty if the
+// transport does not authenticate peers.
+func (ep *Endpoint) PeerIdentity() string {
+	tpt := ep.peerTransport
+	if tpt == nil {
+		if len(ep.transports) == 0 {
+			return ""
+		}
+		tpt = ep.transports[0]
+	}
+	if identifier, ok := tpt.Concrete.(transport.PeerIdentifier); ok {
+		return identifier.PeerIdentity(ep.peerID)
+	}
+	return ""
+}
+
+// addTransport associates a transport to the endpoint
+func (ep *Endpoint) addTransport(tpt *Transport) {
+	for _, t := range ep.transports {
+		if t == tpt {
+			return
+		}
+	}
+	ep.transports = append(ep.transports, tpt)
 }
 
 // Recv receives a message from a given endpoint
 func (ep *Endpoint) Recv() []byte {
-	evt := <-ep.RXEvents
-	// We copy the data to end it to the application
-	data := make([]byte, len(evt.Data[0]))
-	copy(data, evt.Data[0])
-	err := ep.eventEngine.Return(&evt)
+	// The event owns its data (see Transport.Recv), which is handed over to
+	// the application without copy
+	return ep.RecvMsg().Data
+}
+
+// RecvContext receives a message like Recv until the context is done, in
+// which case the error of the context is returned, e.g.,
+// context.DeadlineExceeded
+func (ep *Endpoint) RecvContext(ctx context.Context) ([]byte, error) {
+	msg, err := ep.RecvMsgContext(ctx)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return data
+	return msg.Data, nil
 }
 
 /*
@@ -64,10 +396,43 @@ func (ep *Endpoint) ReturnEvent() error {
 }
 */
 
-// Connect connects to a given endpoint using a specific target transport
-func (ep *Endpoint) Connect(target interface{}) *Endpoint {
+// Connect connects the endpoint using a specific target transport, which must
+// be a *Transport. The connection mode of the transport is enforced, e.g., in
+// 'single' mode, connecting through a transport already used by another pair
+// of endpoints fails while in 'multiplex' mode the connection is reused.
+// The target can also be the ID of another endpoint of the same engine, in
+// which case the in-process loopback transport is used.
+func (ep *Endpoint) Connect(target interface{}) (*Endpoint, error) {
+	if ep == nil {
+		return nil, fmt.Errorf("undefined endpoint")
+	}
 
-	return nil
+	var tpt *Transport
+	dstID := ""
+	switch t := target.(type) {
+	case *Transport:
+		tpt = t
+	case string:
+		if ep.engine.LookupEP(t) == nil {
+			return nil, fmt.Errorf("unknown local endpoint %s", t)
+		}
+		var err error
+		tpt, err = ep.engine.getLoopbackTransport()
+		if err != nil {
+			return nil, err
+		}
+		dstID = t
+	}
+	if tpt == nil || tpt.Concrete == nil {
+		return nil, fmt.Errorf("invalid target transport")
+	}
+
+	err := tpt.connectEP(context.Background(), ep, dstID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+
+	return ep, nil
 }
 
 // Disconnect ends all connections for a given endpoint
@@ -93,50 +458,143 @@ func (ep *Endpoint) Disconnect(target *Endpoint) error {
 
 // LookupEP returns the endpoint structure based on a endpoint unique ID
 func (e *Engine) LookupEP(epID string) *Endpoint {
+	e.epsLock.RLock()
+	defer e.epsLock.RUnlock()
 	return e.eps[epID]
 }
 
-// eventThread checks all transports associated to the endpoint and if a receive
-// completed (i.e., a RX buffer is available), extract the information from it
-// and emit an associated event.
-func eventThread(ep *Endpoint) {
-	for _, tpt := range ep.transports {
-		if tpt.ConcreteID == transport.TCPTransportID {
-			if tpt.TCP != nil && len(tpt.TCP.RecvQueue) > 0 {
-				rx := <-tpt.TCP.RecvQueue
-				evt := ep.engine.eventEngine.GetEvent(true)
-				if evt != nil {
-					log.Println("[ERROR:eventThread] unable to get event")
+// addDrained makes the progress thread of the endpoint receive the messages
+// of a transport
+func (ep *Endpoint) addDrained(tpt *Transport) {
+	ep.drainedLock.Lock()
+	ep.drained = append(ep.drained, tpt)
+	ep.drainedLock.Unlock()
+	select {
+	case ep.drainedCheck <- struct{}{}:
+	default:
+		// The progress thread is already notified
+	}
+}
+
+// progressThread receives the messages of all the transports drained by the
+// endpoint until the endpoint is closed. Each message is delivered, as a RX
+// event, to the local endpoint it targets, which is not necessarily this
+// endpoint when the transport is shared, and the RX buffer is returned to the
+// transport. A transport is drained by a single endpoint so that messages are
+// delivered in order.
+func (ep *Endpoint) progressThread() {
+	for {
+		ep.drainedLock.Lock()
+		transports := make([]*Transport, len(ep.drained))
+		copy(transports, ep.drained)
+		ep.drainedLock.Unlock()
+
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ep.done)},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ep.drainedCheck)},
+		}
+		for _, tpt := range transports {
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(tpt.Concrete.GetRecvQueue()),
+			})
+		}
+		i, rx, ok := reflect.Select(cases)
+		switch {
+		case i == 0:
+			return
+		case i == 1:
+			// The list of transports changed
+			continue
+		case !ok:
+			ep.engine.logger("endpoint").Error("receive queue of "+transports[i-2].ConcreteID+" transport closed", epField(ep.ID))
+			ep.drainedLock.Lock()
+			for j, tpt := range ep.drained {
+				if tpt == transports[i-2] {
+					ep.drained = append(ep.drained[:j], ep.drained[j+1:]...)
+					break
 				}
-				evt.SetType(userDataEventTypeID)
-				evt.Data[0] = tpt.TCP.GetPayloadFromRX(rx)
-				// At this point we have the data, we can release the RX
-				tpt.TCP.RecvQueue <- rx
-				ep.RXEvents <- *evt
 			}
+			ep.drainedLock.Unlock()
+		default:
+			transports[i-2].deliver(rx.Bytes())
 		}
 	}
 }
 
+// Close closes the endpoint: it stops receiving messages and is no longer
+// reachable through its transports, which remain usable by other endpoints.
+// The connections of the endpoint are not closed, see Disconnect.
+func (ep *Endpoint) Close() error {
+	if ep == nil {
+		return fmt.Errorf("undefined endpoint")
+	}
+	ep.closeOnce.Do(func() {
+		close(ep.done)
+		// Receives posted concurrently are completed with an error
+		ep.postLock.Lock()
+		close(ep.postedRecvs)
+		ep.postLock.Unlock()
+		ep.tagMatcher.close(fmt.Errorf("endpoint %s: %w", ep.ID, ErrEndpointClosed))
+		for _, tpt := range ep.transports {
+			tpt.removeEndpoint(ep)
+		}
+		e := ep.engine
+		e.epsLock.Lock()
+		if e.loopback != nil {
+			e.loopback.removeEndpoint(ep)
+		}
+		delete(e.eps, ep.ID)
+		e.epsLock.Unlock()
+	})
+	return nil
+}
+
 func (ep *Endpoint) registerDefaultEvtTypes() error {
 	userDataType, err := ep.eventEngine.NewType(userDataEventTypeID)
 	if err != nil {
 		return err
 	}
 	ep.eventTypes[userDataEventTypeID] = &userDataType
+	sendCompletionType, err := ep.eventEngine.NewType(sendCompletionEventTypeID)
+	if err != nil {
+		return err
+	}
+	ep.eventTypes[sendCompletionEventTypeID] = &sendCompletionType
 	return nil
 }
 
 // CreateEndpoint returns an endpoint in the context of a given engine
-func (e *Engine) CreateEndpoint() *Endpoint {
+func (e *Engine) CreateEndpoint() (*Endpoint, error) {
 	// Parse all transports, find the one with the highest priority and create
 	// endpoint based on the transport configuration
 	if e == nil {
-		return nil
+		return nil, ErrInvalidEngine
 	}
 
 	var ep Endpoint
 	ep.engine = e
+
+	// Initialize the event system specific to the endpoint
+	evtEngineCfg := event.QueueCfg{
+		Size: defaultEPNumEvts,
+	}
+	ep.eventEngine = evtEngineCfg.Init()
+	ep.eventTypes = make(map[string]*event.EventType)
+	err := ep.registerDefaultEvtTypes()
+	if err != nil {
+		return nil, fmt.Errorf("unable to register event types: %w", err)
+	}
+	ep.RXEvents = make(chan event.Event)
+	ep.TXEvents = make(chan event.Event, defaultEPNumEvts)
+	ep.sendErrs = make(map[uint64]error)
+	ep.postedRecvs = make(chan *Request, defaultEPNumEvts)
+	ep.recvCond = sync.NewCond(&ep.recvLock)
+	ep.drainedCheck = make(chan struct{}, 1)
+	ep.rxQueueCheck = make(chan struct{}, 1)
+	ep.done = make(chan struct{})
+
+	e.epsLock.Lock()
 	ep.ID = util.GenerateID()
 	// We need an ID that is locally unique
 	for {
@@ -146,27 +604,30 @@ func (e *Engine) CreateEndpoint() *Endpoint {
 		ep.ID = util.GenerateID()
 	}
 	e.eps[ep.ID] = &ep
-
-	// Initialize the event system specific to the endpoint
-	evtEngineCfg := event.QueueCfg{
-		Size: defaultEPNumEvts,
+	if e.loopback != nil {
+		// Other endpoints of the engine can connect to the new endpoint
+		e.loopback.addEndpoint(&ep)
 	}
-	ep.eventEngine = evtEngineCfg.Init()
-	ep.eventTypes = make(map[string]*event.EventType)
-	ep.RXEvents = make(chan event.Event)
+	e.epsLock.Unlock()
 
-	// Create the event thread
-	go eventThread(&ep)
+	// Create the progress thread
+	go ep.progressThread()
+	go ep.progressRecvs()
+	go ep.rxThread()
 
-	// Find the active transport and those that do not have a thread to accept connection
-	// and need one
+	// Find the transports accepting connections, the new endpoint is reachable through them
 	for _, t := range e.transports {
-		if t.ConcreteID == transport.TCPTransportID && t.TCP.Cfg.Accept && !t.TCP.IsAcceptingConns() {
-			// Associate the TCP transport accepting connection to the new endpoint
-			ep.transports = append(ep.transports, *t)
-			log.Println("[INFO:endpoint] creating accept thread for TCP transport")
+		if t.Concrete != nil && t.Concrete.AcceptsConns() {
+			if t.cfg.ConnectionMode == SingleConnectionMode && t.numEndpoints() > 0 {
+				// The connection cannot be shared with another endpoint
+				continue
+			}
+			// Associate the transport accepting connection to the new endpoint
+			ep.addTransport(t)
+			t.addEndpoint(&ep)
+			e.logger("endpoint").Info("endpoint reachable through "+t.ConcreteID+" transport", epField(ep.ID))
 		}
 	}
 
-	return &ep
+	return &ep, nil
 }
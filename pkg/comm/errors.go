@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"errors"
+
+	"github.com/gvallee/comm/pkg/transport"
+)
+
+var (
+	// ErrConnectionRefused is returned when the remote side does not accept
+	// the connection
+	ErrConnectionRefused = transport.ErrConnectionRefused
+
+	// ErrPeerClosed is returned when the connection is closed by the remote side
+	ErrPeerClosed = transport.ErrPeerClosed
+
+	// ErrPoolExhausted is returned when no TX or RX buffer is available
+	ErrPoolExhausted = transport.ErrPoolExhausted
+
+	// ErrMessageTooLarge is returned when a message cannot be sent because
+	// of its size
+	ErrMessageTooLarge = transport.ErrMessageTooLarge
+
+	// ErrNotConnected is returned when sending from an endpoint that is not
+	// connected to a remote endpoint
+	ErrNotConnected = errors.New("endpoint is not connected")
+
+	// ErrEndpointClosed is returned by the receives posted on an endpoint
+	// that is closed before they complete, or after it is closed
+	ErrEndpointClosed = errors.New("endpoint closed")
+
+	// ErrInvalidEngine is returned when using an undefined engine, or an
+	// engine whose mode does not support the operation
+	ErrInvalidEngine = errors.New("invalid engine")
+)
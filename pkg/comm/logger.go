@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"github.com/gvallee/comm/pkg/transport"
+)
+
+// Logger is the interface used to log the messages of the engine and its
+// transports, see transport.Logger
+type Logger = transport.Logger
+
+// Level is the severity of a log message
+type Level = transport.Level
+
+// Field is a key/value pair attached to a log message
+type Field = transport.Field
+
+const (
+	// DebugLevel is the level of the messages tracing the progress of communications
+	DebugLevel = transport.DebugLevel
+	// InfoLevel is the level of the messages reporting connections
+	InfoLevel = transport.InfoLevel
+	// WarnLevel is the level of the messages reporting recoverable situations
+	WarnLevel = transport.WarnLevel
+	// ErrorLevel is the level of the messages reporting failures
+	ErrorLevel = transport.ErrorLevel
+)
+
+var (
+	// SilentLogger returns a logger discarding all messages
+	SilentLogger = transport.SilentLogger
+
+	// NewStdLogger returns a logger writing messages to a standard logger
+	NewStdLogger = transport.NewStdLogger
+)
+
+// logger logs the messages of a component of the engine through the logger
+// of the engine configuration, silent if not set
+type logger = transport.ComponentLogger
+
+var (
+	epField   = transport.EndpointField
+	peerField = transport.PeerField
+	errField  = transport.ErrorField
+)
+
+// logger returns the logger of the engine for a given component
+func (e *Engine) logger(component string) logger {
+	if e == nil {
+		return transport.NewComponentLogger(nil, component)
+	}
+	return transport.NewComponentLogger(e.cfg.Logger, component)
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/gvallee/event/pkg/event"
+)
+
+const (
+	/* Data of the RX events */
+	rxDataIdx      = 0
+	rxSrcIdx       = 1
+	rxTransportIdx = 2
+	rxTimestampIdx = 3
+)
+
+// Msg is a message received by an endpoint
+type Msg struct {
+	// Data is the payload of the message
+	Data []byte
+
+	// Src is the ID of the remote endpoint that sent the message
+	Src string
+
+	// Tag is the tag of the message, 0 if the message is not tagged
+	Tag uint64
+
+	// Transport is the ID of the concrete transport the message was received from
+	Transport string
+
+	// Timestamp is the time at which the message was received
+	Timestamp time.Time
+}
+
+// setRXEventMsg stores a received message in a RX event
+func setRXEventMsg(evt *event.Event, msg *Msg) {
+	evt.SetType(userDataEventTypeID)
+	evt.Data[rxDataIdx] = msg.Data
+	evt.Data[rxSrcIdx] = []byte(msg.Src)
+	evt.Data[rxTransportIdx] = []byte(msg.Transport)
+	evt.Data[rxTimestampIdx] = make([]byte, 8)
+	binary.LittleEndian.PutUint64(evt.Data[rxTimestampIdx], uint64(msg.Timestamp.UnixNano()))
+}
+
+// getRXEventMsg extracts a received message from a RX event and releases the
+// data of the event. The data of the message is handed over without copy.
+func getRXEventMsg(evt *event.Event) *Msg {
+	msg := &Msg{
+		Data:      evt.Data[rxDataIdx],
+		Src:       string(evt.Data[rxSrcIdx]),
+		Transport: string(evt.Data[rxTransportIdx]),
+	}
+	if len(evt.Data[rxTimestampIdx]) == 8 {
+		msg.Timestamp = time.Unix(0, int64(binary.LittleEndian.Uint64(evt.Data[rxTimestampIdx])))
+	}
+	for _, i := range []int{rxDataIdx, rxSrcIdx, rxTransportIdx, rxTimestampIdx} {
+		evt.Data[i] = nil
+	}
+	return msg
+}
+
+// recvMatching returns the first received message for which match returns
+// true. Messages that do not match are held until another receive matches
+// them, so that receives waiting for different messages can run concurrently.
+// The error of the context is returned if it is done first.
+func (ep *Endpoint) recvMatching(ctx context.Context, match func(*Msg) bool) (*Msg, error) {
+	if ctx.Done() != nil {
+		// Wake up the receive if it is waiting for another one once the
+		// context is done
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				ep.recvLock.Lock()
+				ep.recvCond.Broadcast()
+				ep.recvLock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	ep.recvLock.Lock()
+	defer ep.recvLock.Unlock()
+	for {
+		for i, msg := range ep.heldMsgs {
+			if match(msg) {
+				ep.heldMsgs = append(ep.heldMsgs[:i], ep.heldMsgs[i+1:]...)
+				return msg, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if ep.receiving {
+			// Another receive is waiting for the next RX event
+			ep.recvCond.Wait()
+			continue
+		}
+
+		ep.receiving = true
+		ep.recvLock.Unlock()
+		var msg *Msg
+		select {
+		case evt := <-ep.RXEvents:
+			msg = getRXEventMsg(&evt)
+			ep.eventEngine.Return(&evt)
+		case <-ctx.Done():
+		}
+		ep.recvLock.Lock()
+		ep.receiving = false
+		if msg != nil {
+			ep.heldMsgs = append(ep.heldMsgs, msg)
+		}
+		ep.recvCond.Broadcast()
+	}
+}
+
+// RecvMsg receives the next message that is not tagged and returns it along
+// with its source, the transport it was received from and its receive time
+func (ep *Endpoint) RecvMsg() *Msg {
+	msg, _ := ep.RecvMsgContext(context.Background())
+	return msg
+}
+
+// RecvMsgContext receives the next message that is not tagged like RecvMsg
+// until the context is done, in which case the error of the context is
+// returned, e.g., context.DeadlineExceeded
+func (ep *Endpoint) RecvMsgContext(ctx context.Context) (*Msg, error) {
+	return ep.recvMatching(ctx, func(*Msg) bool {
+		return true
+	})
+}
+
+// RecvFrom receives the next message that is not tagged sent by a specific
+// remote endpoint. Messages from other endpoints are held for other receives.
+func (ep *Endpoint) RecvFrom(srcID string) *Msg {
+	msg, _ := ep.RecvFromContext(context.Background(), srcID)
+	return msg
+}
+
+// RecvFromContext receives the next message sent by a specific remote
+// endpoint like RecvFrom until the context is done, in which case the error
+// of the context is returned
+func (ep *Endpoint) RecvFromContext(ctx context.Context, srcID string) (*Msg, error) {
+	return ep.recvMatching(ctx, func(msg *Msg) bool {
+		return msg.Src == srcID
+	})
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gvallee/comm/pkg/transport"
+)
+
+func TestRecvFrom(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+	var clients []*Endpoint
+	for i := 0; i < 2; i++ {
+		ep, err := engine.Connect(serverEP.ID)
+		if err != nil {
+			t.Fatalf("unable to connect to local endpoint: %s", err)
+		}
+		clients = append(clients, ep)
+	}
+
+	start := time.Now()
+	for _, ep := range clients {
+		err := ep.Send([]byte(ep.ID))
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
+	}
+
+	// Waiting for the second client does not drop the message of the first one
+	msg := serverEP.RecvFrom(clients[1].ID)
+	if msg.Src != clients[1].ID || string(msg.Data) != clients[1].ID {
+		t.Fatalf("received %s from %s instead of the message of %s", string(msg.Data), msg.Src, clients[1].ID)
+	}
+	msg = serverEP.RecvMsg()
+	if msg.Src != clients[0].ID || string(msg.Data) != clients[0].ID {
+		t.Fatalf("received %s from %s instead of the message of %s", string(msg.Data), msg.Src, clients[0].ID)
+	}
+	if msg.Transport != transport.LoopbackTransportID {
+		t.Fatalf("received from %s transport instead of %s", msg.Transport, transport.LoopbackTransportID)
+	}
+	if msg.Timestamp.Before(start) || msg.Timestamp.After(time.Now()) {
+		t.Fatalf("invalid receive timestamp %s", msg.Timestamp)
+	}
+
+	// Concurrent receives waiting for different sources
+	done := make(chan *Msg)
+	for _, ep := range clients {
+		go func(src string) {
+			done <- serverEP.RecvFrom(src)
+		}(ep.ID)
+	}
+	for i := len(clients) - 1; i >= 0; i-- {
+		err := clients[i].Send([]byte(clients[i].ID))
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
+	}
+	for range clients {
+		msg := <-done
+		if string(msg.Data) != msg.Src {
+			t.Fatalf("received %s from %s", string(msg.Data), msg.Src)
+		}
+	}
+
+	// The source and tag of tagged messages are also available
+	err = clients[0].SendTagged(voteTag, []byte(msgStr))
+	if err != nil {
+		t.Fatalf("unable to send tagged message: %s", err)
+	}
+	msg = serverEP.RecvTaggedMsg(0, 0)
+	if msg.Src != clients[0].ID || msg.Tag != voteTag || string(msg.Data) != msgStr {
+		t.Fatalf("received %s (tag %x) from %s", string(msg.Data), msg.Tag, msg.Src)
+	}
+}
+
+func TestRecvContext(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = engine.ConnectContext(canceled, serverEP.ID)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("connect returned %v instead of %s", err, context.Canceled)
+	}
+	ep, err := engine.ConnectContext(context.Background(), serverEP.ID)
+	if err != nil {
+		t.Fatalf("unable to connect to local endpoint: %s", err)
+	}
+
+	// Receives waiting for a message, or for another receive, give up once
+	// their deadline is exceeded
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, err := serverEP.RecvContext(ctx)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("receive returned %v instead of %s", err, context.DeadlineExceeded)
+		}
+	}
+
+	// Messages received afterwards are not lost
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = ep.SendContext(ctx, []byte(msgStr))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	msg, err := serverEP.RecvFromContext(ctx, ep.ID)
+	if err != nil || string(msg.Data) != msgStr {
+		t.Fatalf("receive failed: %v", err)
+	}
+}
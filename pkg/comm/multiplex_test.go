@@ -11,27 +11,115 @@ import (
 	"fmt"
 	"log"
 	"testing"
+
+	"github.com/gvallee/comm/pkg/transport"
+)
+
+const (
+	multiplexPort = 45000
+	ackPrefix     = "ack:"
 )
 
-func doMultiplexServer(t *testing.T, nClient int) {
+func doMultiplexServer(t *testing.T, nClient int, done chan bool) {
+	defer close(done)
 	log.Println("Hello, i am the server test")
 
+	engineCfg := EngineCfg{
+		Mode: Minimalist,
+	}
+	commEngine, err := engineCfg.Init()
+	if err != nil {
+		t.Errorf("unable to create engine: %s", err)
+		return
+	}
+
+	serverCfg := transport.TCPTransportCfg{
+		Interface:          tcpServerURL,
+		PortLow:            multiplexPort,
+		PortHigh:           multiplexPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+	}
+	tcp, err := serverCfg.Init()
+	if err != nil {
+		t.Errorf("unable to initialize transport: %s", err)
+		return
+	}
+	tpt, err := commEngine.AddTransport(tcp)
+	if err != nil {
+		t.Errorf("unable to add transport: %s", err)
+		return
+	}
+	ep, err := commEngine.CreateEndpoint()
+	if err != nil {
+		t.Errorf("unable to create endpoint: %s", err)
+		return
+	}
+
+	// Each client sends its endpoint ID, which we use to reply to that
+	// specific client over the shared connection
+	for i := 0; i < nClient; i++ {
+		clientID := string(ep.Recv())
+		err := tpt.SendTo(ep.ID, clientID, []byte(ackPrefix+clientID))
+		if err != nil {
+			t.Errorf("unable to reply to client: %s", err)
+			return
+		}
+	}
+
 	fmt.Println("All messages have been received")
 }
 
-func doMultiplexClient(t *testing.T, id string) {
-	// Each client sends a single message and then terminates, once all
-	// clients are terminated, the server is supposed to detect the
-	// closed connection and terminates as well.
+func doMultiplexClient(t *testing.T, tpt *Transport, id string) {
+	// Each client sends a single message and waits for the reply of the
+	// server, which must be delivered to that client and no other.
 	log.Printf("Hello, i am a test client (%s)\n", id)
+
+	ep, err := tpt.Connect()
+	if err != nil {
+		t.Fatalf("(%s) unable to connect to server: %s", id, err)
+	}
+	err = ep.Send([]byte(ep.ID))
+	if err != nil {
+		t.Fatalf("(%s) unable to send message: %s", id, err)
+	}
+	reply := string(ep.Recv())
+	if reply != ackPrefix+ep.ID {
+		t.Fatalf("(%s) received a reply for another endpoint", id)
+	}
 }
 
-/*
 func TestTCPMultiplexing(t *testing.T) {
-	// One server using a single port; two clients
-	go doServer(t)
+	// One server using a single port; two clients sharing a single connection
+	done := make(chan bool)
+	go doMultiplexServer(t, 2, done)
+
+	engineCfg := EngineCfg{
+		Mode: Minimalist,
+	}
+	commEngine, err := engineCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+
+	clientCfg := transport.TCPTransportCfg{
+		Interface: tcpServerURL,
+		PortLow:   multiplexPort,
+	}
+	tcp, err := clientCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to initialize transport: %s", err)
+	}
+	tpt, err := commEngine.AddTransport(tcp)
+	if err != nil {
+		t.Fatalf("unable to add transport: %s", err)
+	}
+
+	doMultiplexClient(t, tpt, "client1")
+	doMultiplexClient(t, tpt, "client2")
+	<-done
 
-	go doClient(t, "client1")
-	doClient(t, "client2")
+	if tcp.NumChannels() != 2 {
+		t.Fatalf("%d channels are multiplexed instead of 2", tcp.NumChannels())
+	}
 }
-*/
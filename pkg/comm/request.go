@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Request is the handle of a non-blocking operation, i.e., a message sent
+// using Isend or received using Irecv
+type Request struct {
+	// done is closed once the operation completed
+	done chan struct{}
+
+	// size is the number of bytes transferred
+	size int
+	// msg is the received message
+	msg *Msg
+	// err is the error that prevented the operation to complete
+	err error
+}
+
+func newRequest() *Request {
+	return &Request{
+		done: make(chan struct{}),
+	}
+}
+
+// complete marks the operation as completed; it must be called only once
+func (r *Request) complete(size int, msg *Msg, err error) {
+	r.size = size
+	r.msg = msg
+	r.err = err
+	close(r.done)
+}
+
+// Wait blocks until the operation completes and returns the number of bytes
+// transferred
+func (r *Request) Wait() (int, error) {
+	<-r.done
+	return r.size, r.err
+}
+
+// Test checks whether the operation completed, without blocking
+func (r *Request) Test() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Size returns the number of bytes transferred, once the operation completed
+func (r *Request) Size() int {
+	if !r.Test() {
+		return 0
+	}
+	return r.size
+}
+
+// Err returns the error that prevented the operation to complete, if any,
+// once the operation completed
+func (r *Request) Err() error {
+	if !r.Test() {
+		return nil
+	}
+	return r.err
+}
+
+// Data returns the message received by a receive operation, once completed
+func (r *Request) Data() []byte {
+	if !r.Test() || r.msg == nil {
+		return nil
+	}
+	return r.msg.Data
+}
+
+// Msg returns the message received by a receive operation, with its source,
+// tag, transport and receive time, once completed
+func (r *Request) Msg() *Msg {
+	if !r.Test() {
+		return nil
+	}
+	return r.msg
+}
+
+// Tag returns the tag of the message received by a tagged receive operation,
+// once completed
+func (r *Request) Tag() uint64 {
+	if !r.Test() || r.msg == nil {
+		return 0
+	}
+	return r.msg.Tag
+}
+
+// WaitAll blocks until all the operations complete and returns the first
+// error that occurred, if any
+func WaitAll(reqs ...*Request) error {
+	var firstErr error
+	for _, r := range reqs {
+		_, err := r.Wait()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// WaitAny blocks until one of the operations completes and returns its index
+// in the list of requests, as well as its error, if any
+func WaitAny(reqs ...*Request) (int, error) {
+	if len(reqs) == 0 {
+		return -1, fmt.Errorf("no request to wait for")
+	}
+	cases := make([]reflect.SelectCase, len(reqs))
+	for i, r := range reqs {
+		cases[i] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(r.done),
+		}
+	}
+	i, _, _ := reflect.Select(cases)
+	return i, reqs[i].err
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/gvallee/comm/pkg/transport"
+)
+
+const (
+	requestPort = 45400
+	numRequests = 8
+)
+
+func TestNonBlockingSendRecv(t *testing.T) {
+	serverEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverCfg := transport.TCPTransportCfg{
+		Interface:          tcpServerURL,
+		PortLow:            requestPort,
+		PortHigh:           requestPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+	}
+	_, err = serverEngine.AddTransport(&serverCfg)
+	if err != nil {
+		t.Fatalf("unable to add server transport: %s", err)
+	}
+	serverEP, err := serverEngine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create server endpoint: %s", err)
+	}
+
+	// Receives are posted before any message is sent
+	recvs := make([]*Request, numRequests)
+	for i := range recvs {
+		recvs[i] = serverEP.Irecv()
+	}
+	if recvs[0].Test() {
+		t.Fatal("receive completed before any message was sent")
+	}
+
+	clientEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	clientCfg := transport.TCPTransportCfg{
+		Interface: tcpServerURL,
+		PortLow:   requestPort,
+	}
+	tpt, err := clientEngine.AddTransport(&clientCfg)
+	if err != nil {
+		t.Fatalf("unable to add client transport: %s", err)
+	}
+	ep, err := tpt.Connect()
+	if err != nil {
+		t.Fatalf("unable to connect to server: %s", err)
+	}
+
+	sends := make([]*Request, numRequests)
+	for i := range sends {
+		sends[i] = ep.Isend([]byte(msgStr + strconv.Itoa(i)))
+	}
+	err = WaitAll(sends...)
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	for i, req := range sends {
+		if req.Size() != len(msgStr+strconv.Itoa(i)) {
+			t.Fatalf("%d bytes sent instead of %d", req.Size(), len(msgStr+strconv.Itoa(i)))
+		}
+	}
+
+	// Posted receives complete in order
+	pending := make([]*Request, len(recvs))
+	copy(pending, recvs)
+	for len(pending) > 0 {
+		i, err := WaitAny(pending...)
+		if err != nil {
+			t.Fatalf("receive failed: %s", err)
+		}
+		pending = append(pending[:i], pending[i+1:]...)
+	}
+	for i, req := range recvs {
+		size, err := req.Wait()
+		if err != nil {
+			t.Fatalf("receive failed: %s", err)
+		}
+		if string(req.Data()) != msgStr+strconv.Itoa(i) || size != len(req.Data()) {
+			t.Fatalf("received %s (%d bytes) instead of %s", string(req.Data()), size, msgStr+strconv.Itoa(i))
+		}
+	}
+}
+
+func TestIrecvClosedEndpoint(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	ep, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+
+	// Receives posted before and after the endpoint is closed complete with
+	// an error
+	recvs := []*Request{ep.Irecv(), ep.Irecv()}
+	err = ep.Close()
+	if err != nil {
+		t.Fatalf("unable to close endpoint: %s", err)
+	}
+	recvs = append(recvs, ep.Irecv())
+	for i, req := range recvs {
+		_, err = req.Wait()
+		if !errors.Is(err, ErrEndpointClosed) {
+			t.Fatalf("receive %d completed with %v instead of %s", i, err, ErrEndpointClosed)
+		}
+	}
+}
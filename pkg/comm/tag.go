@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	// ExactTagMask is the mask of tagged receives only matching messages
+	// with the exact same tag
+	ExactTagMask = ^uint64(0)
+)
+
+// postedTaggedRecv is a tagged receive waiting for a matching message
+type postedTaggedRecv struct {
+	tag  uint64
+	mask uint64
+	req  *Request
+}
+
+// tagMatcher matches the tagged messages received by an endpoint with the
+// tagged receives posted by the application, in order, as done by the MPI
+// and OFI tagged interfaces
+type tagMatcher struct {
+	lock sync.Mutex
+	// unexpected are the messages received before a matching receive is posted
+	unexpected []*Msg
+	// posted are the receives waiting for a matching message
+	posted []postedTaggedRecv
+	// closedErr is the error completing the receives once the endpoint is closed
+	closedErr error
+}
+
+// tagMatches checks whether the tag of a message matches the tag of a
+// receive; only the bits set in the mask are compared
+func tagMatches(msgTag uint64, tag uint64, mask uint64) bool {
+	return msgTag&mask == tag&mask
+}
+
+// deliver completes the first posted receive matching a tagged message or
+// holds the message until a matching receive is posted
+func (m *tagMatcher) deliver(msg *Msg) {
+	m.lock.Lock()
+	for i, r := range m.posted {
+		if tagMatches(msg.Tag, r.tag, r.mask) {
+			m.posted = append(m.posted[:i], m.posted[i+1:]...)
+			m.lock.Unlock()
+			r.req.complete(len(msg.Data), msg, nil)
+			return
+		}
+	}
+	m.unexpected = append(m.unexpected, msg)
+	m.lock.Unlock()
+}
+
+// post posts a tagged receive, which is immediately completed by the first
+// unexpected message matching it, if any
+func (m *tagMatcher) post(tag uint64, mask uint64) *Request {
+	req := newRequest()
+	m.lock.Lock()
+	if m.closedErr != nil {
+		m.lock.Unlock()
+		req.complete(0, nil, m.closedErr)
+		return req
+	}
+	for i, msg := range m.unexpected {
+		if tagMatches(msg.Tag, tag, mask) {
+			m.unexpected = append(m.unexpected[:i], m.unexpected[i+1:]...)
+			m.lock.Unlock()
+			req.complete(len(msg.Data), msg, nil)
+			return req
+		}
+	}
+	m.posted = append(m.posted, postedTaggedRecv{tag: tag, mask: mask, req: req})
+	m.lock.Unlock()
+	return req
+}
+
+// cancel removes a posted receive that is not completed yet; false is
+// returned if a message matched it in the meantime
+func (m *tagMatcher) cancel(req *Request) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, r := range m.posted {
+		if r.req == req {
+			m.posted = append(m.posted[:i], m.posted[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// close completes the posted receives, as well as the receives posted
+// later, with an error
+func (m *tagMatcher) close(err error) {
+	m.lock.Lock()
+	m.closedErr = err
+	posted := m.posted
+	m.posted = nil
+	m.lock.Unlock()
+	for _, r := range posted {
+		r.req.complete(0, nil, err)
+	}
+}
+
+// deliverTagged hands a tagged message received by the endpoint over to the
+// matching engine
+func (ep *Endpoint) deliverTagged(msg *Msg) {
+	ep.tagMatcher.deliver(msg)
+}
+
+// SendTagged sends a message with a tag to the remote endpoint
+func (ep *Endpoint) SendTagged(tag uint64, data []byte) error {
+	tpt := ep.sendTransport()
+	if tpt == nil {
+		return fmt.Errorf("endpoint %s: %w", ep.ID, ErrNotConnected)
+	}
+	return tpt.sendTagged(ep.ID, ep.peerID, tag, data)
+}
+
+// IrecvTagged posts a tagged receive without blocking and returns a request
+// completed once a message whose tag matches is received. Only the bits set
+// in the mask are compared, e.g., ExactTagMask matches a single tag while a
+// mask of 0 matches any tagged message. Messages received before a matching
+// receive is posted are held by the endpoint. The receives pending or posted
+// once the endpoint is closed complete with ErrEndpointClosed.
+func (ep *Endpoint) IrecvTagged(tag uint64, mask uint64) *Request {
+	return ep.tagMatcher.post(tag, mask)
+}
+
+// RecvTagged receives a message whose tag matches, see IrecvTagged, and
+// returns its data and its tag. Tagged messages are only received using
+// tagged receives. No data is returned once the endpoint is closed.
+func (ep *Endpoint) RecvTagged(tag uint64, mask uint64) ([]byte, uint64) {
+	req := ep.IrecvTagged(tag, mask)
+	req.Wait()
+	return req.Data(), req.Tag()
+}
+
+// RecvTaggedContext receives a message whose tag matches like RecvTagged
+// until the context is done, in which case the error of the context is
+// returned, e.g., context.DeadlineExceeded. The receive is then withdrawn so
+// the message is left to later receives.
+func (ep *Endpoint) RecvTaggedContext(ctx context.Context, tag uint64, mask uint64) ([]byte, uint64, error) {
+	req := ep.IrecvTagged(tag, mask)
+	select {
+	case <-req.done:
+	case <-ctx.Done():
+		if ep.tagMatcher.cancel(req) {
+			return nil, 0, ctx.Err()
+		}
+		// A message matched the receive before it was withdrawn
+		<-req.done
+	}
+	if req.err != nil {
+		return nil, 0, req.err
+	}
+	return req.msg.Data, req.msg.Tag, nil
+}
+
+// RecvTaggedMsg receives a message whose tag matches, see IrecvTagged, and
+// returns it along with its source, the transport it was received from and
+// its receive time. It returns nil once the endpoint is closed.
+func (ep *Endpoint) RecvTaggedMsg(tag uint64, mask uint64) *Msg {
+	req := ep.IrecvTagged(tag, mask)
+	req.Wait()
+	return req.msg
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	voteTag      = 0x100
+	heartbeatTag = 0x200
+	logEntryTag  = 0x201
+	kindMask     = 0xF00
+)
+
+func TestTaggedSendRecv(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+	ep, err := engine.Connect(serverEP.ID)
+	if err != nil {
+		t.Fatalf("unable to connect to local endpoint: %s", err)
+	}
+
+	// A receive posted before the message arrives
+	posted := serverEP.IrecvTagged(logEntryTag, ExactTagMask)
+	if posted.Test() {
+		t.Fatal("receive completed before any message was sent")
+	}
+
+	msgs := []struct {
+		tag  uint64
+		data string
+	}{
+		{tag: voteTag, data: "vote"},
+		{tag: heartbeatTag, data: "heartbeat"},
+		{tag: logEntryTag, data: "log entry"},
+	}
+	for _, m := range msgs {
+		err := ep.SendTagged(m.tag, []byte(m.data))
+		if err != nil {
+			t.Fatalf("unable to send tagged message: %s", err)
+		}
+	}
+	err = ep.Send([]byte(msgStr))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+
+	// Untagged messages are not matched by tagged receives
+	if string(serverEP.Recv()) != msgStr {
+		t.Fatal("untagged message corrupted")
+	}
+
+	_, err = posted.Wait()
+	if err != nil || string(posted.Data()) != "log entry" || posted.Tag() != logEntryTag {
+		t.Fatalf("posted receive completed with %s (tag %x)", string(posted.Data()), posted.Tag())
+	}
+
+	// Unexpected messages are held until a matching receive is posted,
+	// regardless of the order in which they arrived
+	data, tag := serverEP.RecvTagged(heartbeatTag, kindMask)
+	if string(data) != "heartbeat" || tag != heartbeatTag {
+		t.Fatalf("received %s (tag %x) instead of heartbeat", string(data), tag)
+	}
+	data, tag = serverEP.RecvTagged(0, 0)
+	if string(data) != "vote" || tag != voteTag {
+		t.Fatalf("received %s (tag %x) instead of vote", string(data), tag)
+	}
+}
+
+func TestRecvTaggedContext(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverEP, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+	ep, err := engine.Connect(serverEP.ID)
+	if err != nil {
+		t.Fatalf("unable to connect to local endpoint: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err = serverEP.RecvTaggedContext(ctx, voteTag, ExactTagMask)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("receive returned %v instead of %s", err, context.DeadlineExceeded)
+	}
+
+	// The abandoned receive does not consume the next matching message
+	err = ep.SendTagged(voteTag, []byte("vote"))
+	if err != nil {
+		t.Fatalf("unable to send tagged message: %s", err)
+	}
+	data, tag, err := serverEP.RecvTaggedContext(context.Background(), voteTag, ExactTagMask)
+	if err != nil || string(data) != "vote" || tag != voteTag {
+		t.Fatalf("received %q with tag %#x: %v", data, tag, err)
+	}
+}
+
+func TestRecvTaggedClosedEndpoint(t *testing.T) {
+	engine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	ep, err := engine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+
+	// Tagged receives waiting for a message and posted after the endpoint
+	// is closed complete with an error
+	received := make(chan []byte)
+	go func() {
+		data, _ := ep.RecvTagged(voteTag, ExactTagMask)
+		received <- data
+	}()
+	recvs := []*Request{ep.IrecvTagged(heartbeatTag, ExactTagMask)}
+	err = ep.Close()
+	if err != nil {
+		t.Fatalf("unable to close endpoint: %s", err)
+	}
+	recvs = append(recvs, ep.IrecvTagged(voteTag, kindMask))
+	for i, req := range recvs {
+		_, err = req.Wait()
+		if !errors.Is(err, ErrEndpointClosed) {
+			t.Fatalf("receive %d completed with %v instead of %s", i, err, ErrEndpointClosed)
+		}
+	}
+	select {
+	case data := <-received:
+		if data != nil {
+			t.Fatalf("received %s from a closed endpoint", string(data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocking tagged receive not completed once the endpoint is closed")
+	}
+	_, _, err = ep.RecvTaggedContext(context.Background(), voteTag, ExactTagMask)
+	if !errors.Is(err, ErrEndpointClosed) {
+		t.Fatalf("receive returned %v instead of %s", err, ErrEndpointClosed)
+	}
+}
@@ -9,8 +9,15 @@
 package comm
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gvallee/comm/internal/pkg/util"
 	"github.com/gvallee/comm/pkg/transport"
@@ -23,6 +30,10 @@ const (
 	defaultNumEvents = 1024
 	termEventTypeID  = "comm:evt:term"
 
+	// defaultNumAcceptedConns is the number of connections opened by remote
+	// endpoints that can wait to be accepted by the application
+	defaultNumAcceptedConns = 1024
+
 	/* Tansport Modes */
 
 	// AutoTransportMode identifies the automatic mode where the system will
@@ -50,6 +61,38 @@ const (
 	/* Some default values with use in the context of TCP */
 	defaultTCPPortLow  = 50000
 	defaultTCPPortHigh = 50100
+
+	// autoTCPPriority is the priority of the TCP transport when automatically
+	// instantiated, most other transports are expected to perform better
+	autoTCPPriority = 10
+
+	/* Some default values with use in the context of UDP */
+	defaultUDPPortLow  = 50200
+	defaultUDPPortHigh = 50300
+
+	// autoUDPPriority is the priority of the UDP transport when automatically
+	// instantiated; it is meant for low-latency control traffic so TCP is
+	// preferred by default
+	autoUDPPriority = 5
+
+	/* Some default values with use in the context of Unix domain sockets */
+	defaultUnixSocketName = "comm.sock"
+	defaultUnixPathRange  = 16
+
+	// autoUnixPriority is the priority of the Unix domain socket transport
+	// when automatically instantiated; it only reaches peers on the local
+	// host but is cheaper than TCP
+	autoUnixPriority = 20
+
+	/* Some default values with use in the context of shared memory */
+	defaultSMSegmentName = "comm-sm"
+	defaultSMNameRange   = 16
+
+	// autoSMPriority is the priority of the shared memory transport when
+	// automatically instantiated; it only reaches a single peer on the local
+	// host but avoids the copies through the kernel, the Unix domain socket
+	// transport is used for the other peers
+	autoSMPriority = 30
 )
 
 // Cfg represents the configuration of a transport
@@ -73,6 +116,10 @@ type TransportCfg struct {
 	// of endpoints; while the 'parallel' mode allows for multiple connections
 	// between a pair of endpoints.
 	ConnectionMode string
+
+	// NumConns is the number of connections between a pair of endpoints in
+	// 'parallel' mode
+	NumConns int
 }
 
 // Transport is the structure representing a given network transport
@@ -80,7 +127,22 @@ type Transport struct {
 	cfg        TransportCfg
 	iface      util.NetIface
 	commEngine *Engine
-	eps        map[string]*Endpoint
+	priority   int
+
+	// eps are the local endpoints reachable using the transport; the
+	// default endpoint receives messages that do not target a known endpoint
+	eps       map[string]*Endpoint
+	defaultEP *Endpoint
+	// drainer is the local endpoint whose progress thread receives the
+	// messages of the transport, see Endpoint.progressThread
+	drainer *Endpoint
+	// peers are the remote endpoints the local endpoints are connected to,
+	// indexed by local endpoint ID
+	peers   map[string]string
+	epsLock sync.RWMutex
+	// accepted are the connections opened by remote endpoints, when the
+	// concrete transport accepts connections from several clients
+	accepted chan *Connection
 
 	// EventEngine is the event engine associated to the transport
 	EventEngine *event.Engine
@@ -89,10 +151,6 @@ type Transport struct {
 	// readable identifier
 	EventTypes map[string]*event.EventType
 
-	// Priv is the underlying concrete transport (to be deprecated,
-	// use ConcreteID instead)
-	Priv interface{}
-
 	// ConcreteID identifies the type of the underlying concrete
 	// transport (e.g., 'TCP')
 	ConcreteID string
@@ -102,11 +160,11 @@ type Transport struct {
 	// todo: move to TransportCfg
 	InitialNumEvents uint64
 
-	// Pointers to the different transport we support, used to get transport specific data
-	// Remember that this structure is associated to one and only one concrete transport (e.g., TCP).
-	// However, an engine can be using many different transports at the same time, including some
-	// of the same concrete transport.
-	TCP *transport.TCPTransport
+	// Concrete is the underlying concrete transport, used to perform the actual
+	// communications. Remember that this structure is associated to one and only one
+	// concrete transport (e.g., TCP). However, an engine can be using many different
+	// transports at the same time, including some of the same concrete transport.
+	Concrete transport.Concrete
 }
 
 func (t *Transport) initEvtSystem() error {
@@ -132,13 +190,59 @@ func (t *Transport) initEvtSystem() error {
 	return nil
 }
 
+// validate checks the configuration of a transport and sets the default
+// modes, i.e., 'auto' and 'multiplex', when they are not specified
+func (cfg *TransportCfg) validate() error {
+	switch cfg.TransportMode {
+	case "":
+		cfg.TransportMode = AutoTransportMode
+	case AutoTransportMode, ExplicitTransportMode:
+	default:
+		return fmt.Errorf("unknown transport mode: %s", cfg.TransportMode)
+	}
+
+	switch cfg.ConnectionMode {
+	case "":
+		cfg.ConnectionMode = MultiplexConnectionMode
+	case MultiplexConnectionMode, SingleConnectionMode, ParallelConnectionMode:
+	default:
+		return fmt.Errorf("unknown connection mode: %s", cfg.ConnectionMode)
+	}
+
+	if cfg.NumConns < 0 {
+		return fmt.Errorf("invalid number of connections: %d", cfg.NumConns)
+	}
+	if cfg.NumConns > 1 && cfg.ConnectionMode != ParallelConnectionMode {
+		return fmt.Errorf("multiple connections between endpoints require the %s connection mode", ParallelConnectionMode)
+	}
+
+	return nil
+}
+
 // Init creates a new transport based on a requested configuration
-func (cfg *TransportCfg) Init() *Transport {
+func (cfg *TransportCfg) Init() (*Transport, error) {
+	err := cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	var t Transport
 	t.cfg = *cfg
 	t.eps = make(map[string]*Endpoint)
+	t.peers = make(map[string]string)
 	t.EventTypes = make(map[string]*event.EventType)
-	return &t
+	return &t, nil
+}
+
+// TransportMode returns the mode of the transport, i.e., 'auto' or 'explicit'
+func (t *Transport) TransportMode() string {
+	return t.cfg.TransportMode
+}
+
+// ConnectionMode returns the connection mode of the transport, i.e.,
+// 'multiplex', 'single' or 'parallel'
+func (t *Transport) ConnectionMode() string {
+	return t.cfg.ConnectionMode
 }
 
 // Fini finalizes a given transport
@@ -153,169 +257,706 @@ func (t *Transport) Fini() error {
 		return fmt.Errorf("failed to emit termination event: %w", err)
 	}
 
+	if t.Concrete != nil {
+		t.Concrete.Fini()
+	}
+
 	return nil
 }
 
-func addTCPTransport(t *Transport, tcp *transport.TCPTransport) error {
-	if t == nil || tcp == nil {
-		return fmt.Errorf("invalid parameter(s); cannot add tcp transport")
+func addConcreteTransport(t *Transport, concrete transport.Concrete) error {
+	if t == nil || concrete == nil {
+		return fmt.Errorf("invalid parameter(s); cannot add concrete transport")
+	}
+	t.commEngine.logger("transport").Debug("adding " + concrete.ID() + " transport")
+	if t.Concrete != nil {
+		return fmt.Errorf("concrete transport already defined")
 	}
-	log.Println("Adding TCP transport...")
-	if t.TCP != nil {
-		return fmt.Errorf("TCP transport already defined")
+	t.ConcreteID = concrete.ID()
+	t.Concrete = concrete
+
+	if acceptor, ok := concrete.(transport.PeerAcceptor); ok && acceptor.AcceptedChannels() != nil {
+		t.accepted = make(chan *Connection, defaultNumAcceptedConns)
+		go t.trackConnections(acceptor.AcceptedChannels())
 	}
-	t.Priv = tcp
-	t.ConcreteID = transport.TCPTransportID
-	t.TCP = tcp
 	return nil
 }
 
-// Add sets a given concrete transport (e.g., TCP) to a generic transport structure
+// trackConnections makes the connections opened by remote endpoints available
+// to the application
+func (t *Transport) trackConnections(channels <-chan transport.Channel) {
+	for c := range channels {
+		conn := &Connection{
+			transport: t,
+			LocalID:   c.Local,
+			RemoteID:  c.Remote,
+		}
+		select {
+		case t.accepted <- conn:
+		default:
+			t.commEngine.logger("transport").Warn("too many connections waiting to be accepted, connection dropped", epField(c.Remote))
+		}
+	}
+}
+
+// Accept waits for a remote endpoint to connect to a local endpoint through
+// the transport and returns the new connection, which can then be used to
+// reply to that specific endpoint. It returns nil if the transport does not
+// accept connections from several clients.
+func (t *Transport) Accept() (*Connection, error) {
+	return t.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for a remote endpoint to connect like Accept until the
+// context is done, in which case the error of the context is returned, e.g.,
+// context.DeadlineExceeded
+func (t *Transport) AcceptContext(ctx context.Context) (*Connection, error) {
+	if t.accepted == nil {
+		return nil, fmt.Errorf("%s transport does not accept connections from several clients", t.ConcreteID)
+	}
+	select {
+	case conn := <-t.accepted:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newTCPTransport instantiates a concrete TCP transport according to the
+// connection mode of the transport
+func (t *Transport) newTCPTransport(cfg *transport.TCPTransportCfg) (transport.Concrete, error) {
+	if t.cfg.ConnectionMode == ParallelConnectionMode {
+		ptcpCfg := transport.ParallelTCPTransportCfg{
+			TCP:      *cfg,
+			NumConns: t.cfg.NumConns,
+		}
+		ptcp, err := ptcpCfg.Init()
+		if err != nil {
+			return nil, fmt.Errorf("unable to instantiate parallel TCP transport: %w", err)
+		}
+		return ptcp, nil
+	}
+
+	tcp, err := cfg.Init()
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate TCP transport: %w", err)
+	}
+	return tcp, nil
+}
+
+// Add sets a given concrete transport (e.g., TCP) to a generic transport structure.
+// The concrete transport can also be specified by its configuration, in which
+// case it is instantiated based on the connection mode of the transport, e.g.,
+// multiple TCP connections are used in 'parallel' mode.
 func (t *Transport) Add(tpt interface{}) error {
+	var concrete transport.Concrete
 	switch actualTransport := tpt.(type) {
+	case *transport.TCPTransportCfg:
+		var err error
+		concrete, err = t.newTCPTransport(actualTransport)
+		if err != nil {
+			return err
+		}
 	case transport.TCPTransport:
-		//tcp := tpt.(transport.TCPTransport)
-		err := addTCPTransport(t, &actualTransport)
+		concrete = &actualTransport
+	case *transport.UDPTransportCfg:
+		udp, err := actualTransport.Init()
+		if err != nil {
+			return fmt.Errorf("unable to instantiate UDP transport: %w", err)
+		}
+		concrete = udp
+	case *transport.UnixTransportCfg:
+		unix, err := actualTransport.Init()
+		if err != nil {
+			return fmt.Errorf("unable to instantiate Unix transport: %w", err)
+		}
+		concrete = unix
+	case *transport.SMTransportCfg:
+		sm, err := actualTransport.Init()
 		if err != nil {
-			return fmt.Errorf("failed to add TCP transport: %s", err)
+			return fmt.Errorf("unable to instantiate shared memory transport: %w", err)
 		}
-	case *transport.TCPTransport:
-		/*
-			tcp := tpt.(*transport.TCPTransport)
-			if tcp == nil {
-				log.Fatal("Mmmm....")
-			}
-		*/
-		err := addTCPTransport(t, actualTransport)
+		concrete = sm
+	case *transport.WebSocketTransportCfg:
+		ws, err := actualTransport.Init()
 		if err != nil {
-			return fmt.Errorf("failed to add TCP transport: %s", err)
+			return fmt.Errorf("unable to instantiate WebSocket transport: %w", err)
 		}
+		concrete = ws
+	case transport.Concrete:
+		concrete = actualTransport
 	default:
 		return fmt.Errorf("unknown transport type")
 	}
 
+	if t.cfg.ConnectionMode == ParallelConnectionMode && concrete.ID() == transport.TCPTransportID {
+		return fmt.Errorf("%s mode requires the TCP transport to be added by its configuration", ParallelConnectionMode)
+	}
+
+	err := addConcreteTransport(t, concrete)
+	if err != nil {
+		return fmt.Errorf("failed to add %s transport: %w", concrete.ID(), err)
+	}
+
 	return nil
 }
 
 // Send sends a message over a transport
 func (t *Transport) Send(epID string, msg []byte) error {
-	switch t.ConcreteID {
+	return t.SendTo(epID, "", msg)
+}
+
+// SendTo sends a message from a local endpoint to a specific remote endpoint
+// over a transport. This is required when the connection is multiplexed, i.e.,
+// when the remote side has more than one endpoint reachable via the transport.
+func (t *Transport) SendTo(srcID string, dstID string, msg []byte) error {
+	if t.Concrete == nil {
+		return fmt.Errorf("undefined concrete transport")
+	}
+
+	hdr := transport.TCPHeader{
+		MsgType: transport.DATAMSG,
+		Src:     srcID,
+		Dst:     dstID,
+	}
+	err := t.Concrete.SendMsg(hdr, msg)
+	if err != nil {
+		return fmt.Errorf("unable to send %s message: %w", t.ConcreteID, err)
+	}
+	return nil
+}
 
-	case transport.TCPTransportID:
-		hdr := transport.TCPHeader{
-			MsgType: "INTERNAL:DATAMSG",
-			Src:     epID,
+// sendToContext sends a message like SendTo until the context is done. Only
+// the concrete transports implementing transport.ContextSender can be
+// interrupted while sending, the context is otherwise only checked before
+// sending.
+func (t *Transport) sendToContext(ctx context.Context, srcID string, dstID string, msg []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	sender, ok := t.Concrete.(transport.ContextSender)
+	if !ok {
+		return t.SendTo(srcID, dstID, msg)
+	}
+
+	hdr := transport.TCPHeader{
+		MsgType: transport.DATAMSG,
+		Src:     srcID,
+		Dst:     dstID,
+	}
+	err := sender.SendMsgContext(ctx, hdr, msg)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		err := t.TCP.SendMsg(hdr, msg)
+		return fmt.Errorf("unable to send %s message: %w", t.ConcreteID, err)
+	}
+	return nil
+}
+
+// sendTagged sends a tagged message from a local endpoint to a remote endpoint
+func (t *Transport) sendTagged(srcID string, dstID string, tag uint64, msg []byte) error {
+	if t.Concrete == nil {
+		return fmt.Errorf("undefined concrete transport")
+	}
+
+	hdr := transport.TCPHeader{
+		MsgType: transport.TAGMSG,
+		Src:     srcID,
+		Dst:     dstID,
+	}
+	err := t.Concrete.SendMsg(hdr, transport.TaggedPayload(tag, msg))
+	if err != nil {
+		return fmt.Errorf("unable to send %s tagged message: %w", t.ConcreteID, err)
+	}
+	return nil
+}
+
+// sendNotify sends a message from a local endpoint to a remote endpoint
+// without waiting for the message to be sent. The completion is notified to
+// done once the concrete transport notifies that the message is sent or, if
+// it cannot, once the message is handed over to the concrete transport.
+func (t *Transport) sendNotify(srcID string, dstID string, msg []byte, done transport.SendCompletionFunc) {
+	sender, ok := t.Concrete.(transport.CompletionSender)
+	if !ok {
+		err := t.SendTo(srcID, dstID, msg)
 		if err != nil {
-			return fmt.Errorf("unable to send TCP message")
+			done(0, err)
+			return
 		}
+		done(len(msg), nil)
+		return
+	}
 
-	default:
-		return fmt.Errorf("unknown transport type: %s", t.ConcreteID)
+	hdr := transport.TCPHeader{
+		MsgType: transport.DATAMSG,
+		Src:     srcID,
+		Dst:     dstID,
+	}
+	err := sender.SendMsgNotify(hdr, msg, done)
+	if err != nil {
+		done(0, fmt.Errorf("unable to send %s message: %w", t.ConcreteID, err))
 	}
-	return nil
 }
 
 // LookupReceiver looks into the list of all endpoints that are
 // reachable using this transport, based on the endpoint identifier,
 // and returns the associated endpoint structure.
 func (t *Transport) LookupReceiver(target string) *Endpoint {
+	t.epsLock.RLock()
+	defer t.epsLock.RUnlock()
 	return t.eps[target]
 }
 
-// Recv receives a message from a transport
+// addEndpoint makes a local endpoint reachable using the transport
+func (t *Transport) addEndpoint(ep *Endpoint) {
+	t.epsLock.Lock()
+	t.eps[ep.ID] = ep
+	if t.defaultEP == nil {
+		t.defaultEP = ep
+	}
+	drain := t.drainer == nil && t.Concrete != nil
+	if drain {
+		t.drainer = ep
+	}
+	t.epsLock.Unlock()
+	if drain {
+		ep.addDrained(t)
+	}
+
+	if mux, ok := t.Concrete.(transport.Multiplexer); ok {
+		mux.AddEndpoint(ep.ID)
+	}
+}
+
+// removeEndpoint makes a local endpoint unreachable using the transport. If
+// the endpoint was receiving the messages of the transport, another endpoint
+// takes over.
+func (t *Transport) removeEndpoint(ep *Endpoint) {
+	t.epsLock.Lock()
+	delete(t.eps, ep.ID)
+	delete(t.peers, ep.ID)
+	var next *Endpoint
+	for _, e := range t.eps {
+		next = e
+		break
+	}
+	if t.defaultEP == ep {
+		t.defaultEP = next
+	}
+	drain := t.drainer == ep && next != nil
+	if t.drainer == ep {
+		t.drainer = next
+	}
+	t.epsLock.Unlock()
+	if drain {
+		next.addDrained(t)
+	}
+}
+
+// lookupDest returns the local endpoint to which a received message must be
+// delivered, i.e., its destination or the default endpoint when the
+// destination is not specified or unknown
+func (t *Transport) lookupDest(dst string) *Endpoint {
+	ep := t.LookupReceiver(dst)
+	if ep != nil {
+		return ep
+	}
+	t.epsLock.RLock()
+	defer t.epsLock.RUnlock()
+	return t.defaultEP
+}
+
+// Recv receives a message from a transport and delivers it to the local
+// endpoint it targets. Multiple endpoints may share the same transport, the
+// destination of the message is therefore used to find the endpoint.
+// The messages of a transport with local endpoints are already received by
+// the progress thread of one of them, in order, and must not be received
+// concurrently using Recv.
 func (t *Transport) Recv() []byte {
-	switch t.ConcreteID {
-
-	case transport.TCPTransportID:
-		rx := <-t.TCP.RecvQueue
-		// Create a new event and emit it for the endpoint as a recv event
-		dst := t.TCP.ExtractDest(rx)
-		ep := t.LookupReceiver(dst)
-		if ep == nil {
-			log.Println("unknown target endpoint")
-			return nil
+	if t.Concrete == nil {
+		t.commEngine.logger("transport").Error("undefined concrete transport")
+		return nil
+	}
+
+	return t.deliver(<-t.Concrete.GetRecvQueue())
+}
+
+// deliver delivers a message received by the transport to the local endpoint
+// it targets and returns the RX buffer to the concrete transport
+func (t *Transport) deliver(rx []byte) []byte {
+	// Create a new event and emit it for the endpoint as a recv event
+	dst := t.Concrete.ExtractDest(rx)
+	ep := t.lookupDest(dst)
+	if ep == nil {
+		t.commEngine.logger("transport").Warn("unknown target endpoint, message dropped", epField(dst))
+		t.Concrete.ReturnRX(rx)
+		return nil
+	}
+	// The endpoint may not be receiving its messages, waiting for one of its
+	// events would stall the other endpoints of the transport
+	evt := ep.eventEngine.GetEvent(false)
+	if evt == nil {
+		t.commEngine.logger("transport").Error("unable to get an event, message dropped", epField(dst))
+		t.Concrete.ReturnRX(rx)
+		return nil
+	}
+
+	// The RX is about to be returned, the event gets its own copy of the
+	// payload unless the concrete transport hands it over
+	var data []byte
+	var err error
+	if owner, ok := t.Concrete.(transport.PayloadOwner); ok {
+		data, err = owner.TakePayload(rx)
+	} else {
+		var payload []byte
+		payload, err = t.Concrete.ExtractPayload(rx)
+		if err == nil {
+			data = make([]byte, len(payload))
+			copy(data, payload)
 		}
-		evt := ep.eventEngine.GetEvent(true)
-		if evt == nil {
-			log.Printf("unable to get an event")
+	}
+	if err != nil {
+		t.commEngine.logger("transport").Error("unable to extract payload", epField(dst), errField(err))
+		t.Concrete.ReturnRX(rx)
+		ep.eventEngine.Return(evt)
+		return nil
+	}
+	msg := &Msg{
+		Data:      data,
+		Src:       string(t.Concrete.ExtractSrc(rx)),
+		Transport: t.ConcreteID,
+		Timestamp: time.Now(),
+	}
+	msgType := transport.ExtractMsgType(rx)
+	t.Concrete.ReturnRX(rx)
+
+	if msgType == transport.TAGMSG {
+		// Tagged messages are matched with the tagged receives instead
+		ep.eventEngine.Return(evt)
+		msg.Tag, msg.Data, err = transport.SplitTaggedPayload(data)
+		if err != nil {
+			t.commEngine.logger("transport").Error("invalid tagged message", epField(dst), errField(err))
 			return nil
 		}
+		ep.deliverTagged(msg)
+		return msg.Data
+	}
 
-		// Emit event
-		payload := t.TCP.GetPayloadFromRX(rx)
-		evt.Emit(payload)
-	default:
-		log.Printf("[ERROR:transport] unknown transport type: %s", t.ConcreteID)
+	setRXEventMsg(evt, msg)
+	if !ep.queueRX(evt) {
+		// The endpoint is closed, the message is dropped
+		getRXEventMsg(evt)
+		ep.eventEngine.Return(evt)
 		return nil
 	}
-	return nil
+	return data
 }
 
 // Connect to a specific remote node identified by an identifier.
 // For example, the id can be a TCP address.
-func (tpt *Transport) Connect() *Endpoint {
+func (tpt *Transport) Connect() (*Endpoint, error) {
+	return tpt.ConnectContext(context.Background())
+}
+
+// ConnectContext connects like Connect until the context is done, in which
+// case the error of the context is returned, e.g., context.DeadlineExceeded.
+// Only the concrete transports implementing transport.ContextConnector can be
+// interrupted while connecting, the context is otherwise only checked before
+// connecting.
+func (tpt *Transport) ConnectContext(ctx context.Context) (*Endpoint, error) {
 	if tpt == nil || tpt.commEngine == nil {
-		log.Println("[ERROR:transport] corrupted transport")
-		return nil
+		return nil, fmt.Errorf("corrupted transport")
+	}
+	if tpt.Concrete == nil {
+		return nil, fmt.Errorf("corrupt transport; cannot connect")
 	}
-	ep := tpt.commEngine.CreateEndpoint()
-	switch tpt.ConcreteID {
-	case transport.TCPTransportID:
-		if tpt.TCP == nil {
-			log.Println("[ERROR:transport] corrupt transport; cannot connect")
-		}
 
-		// Add the transport to the endpoint
-		ep.transports = append(ep.transports, *tpt)
-		serverID, err := tpt.TCP.Connect(ep.ID)
-		tpt.eps[serverID] = ep
-		if err != nil {
-			log.Printf("[ERROR:transport] unable to connect to remote peer: %s", err)
+	ep, err := tpt.commEngine.CreateEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	err = tpt.connectEP(ctx, ep, "")
+	if err != nil {
+		ep.Close()
+		return nil, fmt.Errorf("unable to connect to remote peer: %w", err)
+	}
+
+	return ep, nil
+}
+
+// connectEP connects a local endpoint to the remote side of the transport,
+// enforcing the connection mode of the transport: in 'single' mode, the
+// connection can only be used by a single pair of endpoints; in 'multiplex'
+// and 'parallel' modes, the existing connection is reused. A specific remote
+// endpoint can be targeted with transports able to multiplex connections,
+// otherwise dstID must be empty.
+func (tpt *Transport) connectEP(ctx context.Context, ep *Endpoint, dstID string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	tpt.epsLock.RLock()
+	_, connected := tpt.peers[ep.ID]
+	numPeers := len(tpt.peers)
+	tpt.epsLock.RUnlock()
+
+	switch tpt.cfg.ConnectionMode {
+	case SingleConnectionMode:
+		if numPeers > 0 {
+			return fmt.Errorf("connection already in use; %s mode allows a single pair of endpoints per connection", SingleConnectionMode)
+		}
+	default:
+		if connected {
+			// The endpoint is already connected, we reuse the connection
 			return nil
 		}
+		if _, ok := tpt.Concrete.(transport.Multiplexer); numPeers > 0 && !ok {
+			return fmt.Errorf("%s transport cannot multiplex connections", tpt.ConcreteID)
+		}
+	}
+
+	// Add the transport to the endpoint; the endpoint is registered before
+	// connecting so that messages received right after the handshake can
+	// be delivered.
+	ep.addTransport(tpt)
+	tpt.addEndpoint(ep)
+	var serverID string
+	var err error
+	mux, isMux := tpt.Concrete.(transport.Multiplexer)
+	connector, isConnector := tpt.Concrete.(transport.ContextConnector)
+	switch {
+	case isConnector && isMux && dstID != "":
+		serverID, err = connector.ConnectEPContext(ctx, ep.ID, dstID)
+	case isConnector:
+		serverID, err = connector.ConnectContext(ctx, ep.ID)
+	case isMux && dstID != "":
+		serverID, err = mux.ConnectEP(ep.ID, dstID)
 	default:
-		log.Printf("[ERROR:transport] unknown transport type: %s", tpt.ConcreteID)
-		return nil
+		serverID, err = tpt.Concrete.Connect(ep.ID)
 	}
+	if err != nil {
+		return err
+	}
+	ep.peerID = serverID
+	ep.peerTransport = tpt
+
+	tpt.epsLock.Lock()
+	tpt.peers[ep.ID] = serverID
+	tpt.epsLock.Unlock()
 
-	return ep
+	return nil
 }
 
-func (e *Engine) createAutoTCPTransport(iface util.NetIface, ip string) *Transport {
-	log.Printf("Instantiating TCP transport for %s\n", ip)
+// numEndpoints returns the number of local endpoints reachable using the transport
+func (tpt *Transport) numEndpoints() int {
+	tpt.epsLock.RLock()
+	defer tpt.epsLock.RUnlock()
+	return len(tpt.eps)
+}
 
-	// The transport will automatically start listening on the default lower port
+// registerErr is the error that prevented the default concrete transports
+// to be registered, if any; it is returned when an engine instantiates
+// transports automatically
+var registerErr error
+
+func init() {
+	factories := []struct {
+		id      string
+		factory transport.Factory
+	}{
+		{
+			id: transport.TCPTransportID,
+			factory: transport.Factory{
+				Priority: autoTCPPriority,
+				Probe:    probeAutoTCPTransport,
+				New:      newAutoTCPTransport,
+			},
+		},
+		{
+			id: transport.UDPTransportID,
+			factory: transport.Factory{
+				Priority: autoUDPPriority,
+				Probe:    probeAutoUDPTransport,
+				New:      newAutoUDPTransport,
+			},
+		},
+		{
+			id: transport.UnixTransportID,
+			factory: transport.Factory{
+				Priority: autoUnixPriority,
+				Probe:    probeAutoUnixTransport,
+				New:      newAutoUnixTransport,
+			},
+		},
+		{
+			id: transport.SMTransportID,
+			factory: transport.Factory{
+				Priority: autoSMPriority,
+				Probe:    probeAutoSMTransport,
+				New:      newAutoSMTransport,
+			},
+		},
+	}
+	for _, f := range factories {
+		err := transport.Register(f.id, f.factory)
+		if err != nil && registerErr == nil {
+			registerErr = fmt.Errorf("unable to register %s transport: %w", f.id, err)
+		}
+	}
+}
+
+// autoLogger returns the logger of the engine instantiating transports in
+// 'auto' mode
+func autoLogger(res transport.Resource) logger {
+	return transport.NewComponentLogger(res.Logger, "transport")
+}
+
+// probeAutoTCPTransport checks whether a TCP transport can be automatically
+// instantiated for a network interface, i.e., for IPv4 addresses
+func probeAutoTCPTransport(res transport.Resource) bool {
+	return strings.HasSuffix(res.Addr, "/8") || strings.HasSuffix(res.Addr, "/24")
+}
+
+func newAutoTCPTransport(res transport.Resource) (transport.Concrete, error) {
+	ip := strings.Split(res.Addr, "/")[0]
+	autoLogger(res).Info("instantiating TCP transport", peerField(ip))
+
+	// The transport will automatically start listening on the default lower
+	// port and accept connections from any number of peers
 	tcpCfg := transport.TCPTransportCfg{
 		PortLow:            defaultTCPPortLow,
 		PortHigh:           defaultTCPPortHigh,
 		Accept:             true,
 		DoNotBlockOnAccept: true,
+		MaxConns:           -1,
+		Logger:             res.Logger,
 	}
-	tcp := tcpCfg.Init()
-	if tcp == nil {
-		log.Println("[ERROR:transport] unable to instantiate TCP transport")
-		return nil
+	tcp, err := tcpCfg.Init()
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate TCP transport: %w", err)
 	}
 
-	newTransport := e.AddTransport(tcp)
-	if newTransport == nil {
-		log.Println("[ERROR:transport] unable to create new transport")
+	return tcp, nil
+}
+
+// probeAutoUDPTransport checks whether a UDP transport can be automatically
+// instantiated for a network interface, i.e., for IPv4 addresses since the
+// address of the interface is used as is to build the address of the socket
+func probeAutoUDPTransport(res transport.Resource) bool {
+	ip, _, err := net.ParseCIDR(res.Addr)
+	return err == nil && ip.To4() != nil
+}
+
+func newAutoUDPTransport(res transport.Resource) (transport.Concrete, error) {
+	ip := strings.Split(res.Addr, "/")[0]
+	autoLogger(res).Info("instantiating UDP transport", peerField(ip))
+
+	udpCfg := transport.UDPTransportCfg{
+		Interface:          ip,
+		PortLow:            defaultUDPPortLow,
+		PortHigh:           defaultUDPPortHigh,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		Reliable:           true,
+		Logger:             res.Logger,
+	}
+	udp, err := udpCfg.Init()
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate UDP transport: %w", err)
 	}
-	newTransport.iface.Name = iface.Name
-	newTransport.iface.Addr = iface.Addr
 
-	return newTransport
+	return udp, nil
 }
 
-func (e *Engine) getTransportFromIface(iface util.NetIface) *Transport {
-	// Loop over the list of transports we know and find the one matching the target interface
+// probeAutoUnixTransport checks whether a Unix domain socket transport can be
+// automatically instantiated for a network interface. A single transport is
+// required for the local host so it is only associated to the loopback
+// interface.
+func probeAutoUnixTransport(res transport.Resource) bool {
+	return util.IsLoopback(res.Addr)
+}
+
+func newAutoUnixTransport(res transport.Resource) (transport.Concrete, error) {
+	path := filepath.Join(os.TempDir(), defaultUnixSocketName)
+	autoLogger(res).Info("instantiating Unix transport", Field{Key: "path", Value: path})
+
+	// Like ports with TCP, the transport listens on the first path available
+	unixCfg := transport.UnixTransportCfg{
+		Path:               path,
+		PathRange:          defaultUnixPathRange,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		Logger:             res.Logger,
+	}
+	unix, err := unixCfg.Init()
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate Unix transport: %w", err)
+	}
+
+	return unix, nil
+}
+
+// probeAutoSMTransport checks whether a shared memory transport can be
+// automatically instantiated for a network interface. Like with Unix domain
+// sockets, it is only associated to the loopback interface.
+func probeAutoSMTransport(res transport.Resource) bool {
+	return runtime.GOOS == "linux" && util.IsLoopback(res.Addr)
+}
+
+func newAutoSMTransport(res transport.Resource) (transport.Concrete, error) {
+	autoLogger(res).Info("instantiating shared memory transport", Field{Key: "name", Value: defaultSMSegmentName})
+
+	// The transport creates the first segment available and waits for a
+	// peer, unless it connects to the segment of another transport first
+	smCfg := transport.SMTransportCfg{
+		Name:               defaultSMSegmentName,
+		NameRange:          defaultSMNameRange,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		Logger:             res.Logger,
+	}
+	sm, err := smCfg.Init()
+	if err != nil {
+		return nil, fmt.Errorf("unable to instantiate shared memory transport: %w", err)
+	}
+
+	return sm, nil
+}
+
+func (e *Engine) createAutoTransport(factory transport.Factory, res transport.Resource) (*Transport, error) {
+	concrete, err := factory.New(res)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := TransportCfg{
+		TransportMode:  AutoTransportMode,
+		ConnectionMode: MultiplexConnectionMode,
+	}
+	newTransport, err := e.AddTransportWithCfg(cfg, concrete)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create new transport: %w", err)
+	}
+	newTransport.iface.Name = res.Name
+	newTransport.iface.Addr = res.Addr
+	newTransport.priority = factory.Priority
+	e.rankTransports()
+
+	return newTransport, nil
+}
+
+// getTransportsFromIface returns the transports associated to a network
+// interface, by decreasing priority
+func (e *Engine) getTransportsFromIface(iface util.NetIface) []*Transport {
+	var tpts []*Transport
+	// Loop over the list of transports we know and find the ones matching the
+	// target interface; transports are already ranked
 	for _, tpt := range e.transports {
 		if iface.Addr == tpt.iface.Addr && iface.Name == tpt.iface.Name {
-			return tpt
+			tpts = append(tpts, tpt)
 		}
 	}
 
-	return nil
+	return tpts
 }
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package comm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gvallee/comm/pkg/transport"
+)
+
+const (
+	singleModePort = 45100
+	udpPort        = 45200
+	acceptPort     = 45300
+)
+
+func TestTransportCfgInit(t *testing.T) {
+	tests := []struct {
+		name            string
+		cfg             TransportCfg
+		successExpected bool
+		connMode        string
+	}{
+		{
+			name:            "default modes",
+			cfg:             TransportCfg{},
+			successExpected: true,
+			connMode:        MultiplexConnectionMode,
+		},
+		{
+			name: "single mode",
+			cfg: TransportCfg{
+				TransportMode:  ExplicitTransportMode,
+				ConnectionMode: SingleConnectionMode,
+			},
+			successExpected: true,
+			connMode:        SingleConnectionMode,
+		},
+		{
+			name: "parallel mode",
+			cfg: TransportCfg{
+				ConnectionMode: ParallelConnectionMode,
+				NumConns:       4,
+			},
+			successExpected: true,
+			connMode:        ParallelConnectionMode,
+		},
+		{
+			name: "unknown transport mode",
+			cfg: TransportCfg{
+				TransportMode: "dummy",
+			},
+			successExpected: false,
+		},
+		{
+			name: "unknown connection mode",
+			cfg: TransportCfg{
+				ConnectionMode: "dummy",
+			},
+			successExpected: false,
+		},
+		{
+			name: "multiple connections without parallel mode",
+			cfg: TransportCfg{
+				ConnectionMode: SingleConnectionMode,
+				NumConns:       2,
+			},
+			successExpected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpt, err := tt.cfg.Init()
+			if (err == nil) != tt.successExpected {
+				t.Fatalf("%s case: success expected: %v (%v)", tt.name, tt.successExpected, err)
+			}
+			if err == nil && tpt.ConnectionMode() != tt.connMode {
+				t.Fatalf("%s case: connection mode is %s instead of %s", tt.name, tpt.ConnectionMode(), tt.connMode)
+			}
+		})
+	}
+}
+
+func TestSingleConnectionMode(t *testing.T) {
+	serverEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverCfg := transport.TCPTransportCfg{
+		Interface:          tcpServerURL,
+		PortLow:            singleModePort,
+		PortHigh:           singleModePort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+	}
+	_, err = serverEngine.AddTransport(&serverCfg)
+	if err != nil {
+		t.Fatalf("unable to add server transport: %s", err)
+	}
+	_, err = serverEngine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create server endpoint: %s", err)
+	}
+
+	cfg := TransportCfg{
+		TransportMode:  ExplicitTransportMode,
+		ConnectionMode: SingleConnectionMode,
+	}
+	clientEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	clientCfg := transport.TCPTransportCfg{
+		Interface: tcpServerURL,
+		PortLow:   singleModePort,
+	}
+	tpt, err := clientEngine.AddTransportWithCfg(cfg, &clientCfg)
+	if err != nil {
+		t.Fatalf("unable to add client transport: %s", err)
+	}
+
+	ep, err := tpt.Connect()
+	if err != nil {
+		t.Fatalf("unable to connect to server: %s", err)
+	}
+	_, err = ep.Connect(tpt)
+	if err == nil {
+		t.Fatal("a second connection between the same pair of endpoints succeeded")
+	}
+	_, err = tpt.Connect()
+	if err == nil {
+		t.Fatal("a connection shared between two pairs of endpoints succeeded")
+	}
+}
+
+func TestUDPTransport(t *testing.T) {
+	serverEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverCfg := transport.UDPTransportCfg{
+		Interface:          tcpServerURL,
+		PortLow:            udpPort,
+		PortHigh:           udpPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		Reliable:           true,
+	}
+	_, err = serverEngine.AddTransport(&serverCfg)
+	if err != nil {
+		t.Fatalf("unable to add server transport: %s", err)
+	}
+	serverEP, err := serverEngine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create server endpoint: %s", err)
+	}
+
+	clientEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	clientCfg := transport.UDPTransportCfg{
+		Interface: tcpServerURL,
+		PortLow:   udpPort,
+		Reliable:  true,
+	}
+	tpt, err := clientEngine.AddTransport(&clientCfg)
+	if err != nil {
+		t.Fatalf("unable to add client transport: %s", err)
+	}
+	ep, err := tpt.Connect()
+	if err != nil {
+		t.Fatalf("unable to connect to server: %s", err)
+	}
+
+	err = ep.Send([]byte(ep.ID))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	if string(serverEP.Recv()) != ep.ID {
+		t.Fatal("message corrupted")
+	}
+}
+
+func TestTransportAccept(t *testing.T) {
+	serverEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+	if err != nil {
+		t.Fatalf("unable to create engine: %s", err)
+	}
+	serverCfg := transport.TCPTransportCfg{
+		Interface:          tcpServerURL,
+		PortLow:            acceptPort,
+		PortHigh:           acceptPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		MaxConns:           2,
+	}
+	serverTpt, err := serverEngine.AddTransport(&serverCfg)
+	if err != nil {
+		t.Fatalf("unable to add server transport: %s", err)
+	}
+	_, err = serverEngine.CreateEndpoint()
+	if err != nil {
+		t.Fatalf("unable to create server endpoint: %s", err)
+	}
+
+	eps := make(map[string]*Endpoint)
+	for i := 0; i < 2; i++ {
+		clientEngine, err := (&EngineCfg{Mode: Minimalist}).Init()
+		if err != nil {
+			t.Fatalf("unable to create engine: %s", err)
+		}
+		clientCfg := transport.TCPTransportCfg{
+			Interface: tcpServerURL,
+			PortLow:   acceptPort,
+		}
+		tpt, err := clientEngine.AddTransport(&clientCfg)
+		if err != nil {
+			t.Fatalf("unable to add client transport: %s", err)
+		}
+		ep, err := tpt.Connect()
+		if err != nil {
+			t.Fatalf("unable to connect to server: %s", err)
+		}
+		eps[ep.ID] = ep
+	}
+
+	// The server replies to each client over its own connection
+	for i := 0; i < len(eps); i++ {
+		conn, err := serverTpt.Accept()
+		if err != nil {
+			t.Fatalf("no connection accepted: %s", err)
+		}
+		if _, ok := eps[conn.RemoteID]; !ok {
+			t.Fatalf("unexpected connection from %s", conn.RemoteID)
+		}
+		err = conn.Send([]byte(conn.RemoteID))
+		if err != nil {
+			t.Fatalf("unable to reply to %s: %s", conn.RemoteID, err)
+		}
+	}
+	for id, ep := range eps {
+		if string(ep.Recv()) != id {
+			t.Fatalf("%s received a message for another client", id)
+		}
+	}
+}
+
+func TestLoopbackTransport(t *testing.T) {
+	for _, zeroCopy := range []bool{false, true} {
+		engine, err := (&EngineCfg{Mode: Minimalist, LoopbackZeroCopy: zeroCopy}).Init()
+		if err != nil {
+			t.Fatalf("unable to create engine: %s", err)
+		}
+		serverEP, err := engine.CreateEndpoint()
+		if err != nil {
+			t.Fatalf("unable to create endpoint: %s", err)
+		}
+
+		// The destination is an endpoint of the engine
+		ep, err := engine.Connect(serverEP.ID)
+		if err != nil {
+			t.Fatalf("unable to connect to local endpoint: %s", err)
+		}
+		if ep.peerTransport.ConcreteID != transport.LoopbackTransportID {
+			t.Fatalf("connected using %s transport instead of %s", ep.peerTransport.ConcreteID, transport.LoopbackTransportID)
+		}
+		_, err = serverEP.Connect(ep.ID)
+		if err != nil {
+			t.Fatalf("unable to connect back to local endpoint: %s", err)
+		}
+
+		msg := []byte(msgStr)
+		err = ep.Send(msg)
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
+		data := serverEP.Recv()
+		if !bytes.Equal(data, msg) {
+			t.Fatalf("received %s instead of %s", string(data), msgStr)
+		}
+		if (&data[0] == &msg[0]) != zeroCopy {
+			t.Fatalf("message handed over: %v, zero-copy: %v", &data[0] == &msg[0], zeroCopy)
+		}
+
+		err = serverEP.Send([]byte(ep.ID))
+		if err != nil {
+			t.Fatalf("unable to send reply: %s", err)
+		}
+		if string(ep.Recv()) != ep.ID {
+			t.Fatal("reply corrupted")
+		}
+	}
+}
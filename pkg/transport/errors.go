@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/gvallee/syserror/pkg/syserror"
+)
+
+var (
+	// ErrConnectionRefused is returned when the remote side does not accept
+	// the connection, e.g., when nothing listens on the target port
+	ErrConnectionRefused = errors.New("connection refused")
+
+	// ErrPeerClosed is returned when the connection is closed by the remote side
+	ErrPeerClosed = errors.New("connection closed by peer")
+
+	// ErrPeerUnreachable is returned when the remote side stopped answering,
+	// e.g., when messages are not acknowledged despite retransmissions
+	ErrPeerUnreachable = errors.New("peer unreachable")
+
+	// ErrPoolExhausted is returned when no TX or RX buffer is available
+	ErrPoolExhausted = fmt.Errorf("buffer pool exhausted: %w", &syserror.ErrOutOfRes)
+
+	// ErrMessageTooLarge is returned when a message cannot be sent by the
+	// transport because of its size
+	ErrMessageTooLarge = fmt.Errorf("message too large: %w", &syserror.ErrDataOverflow)
+)
+
+// NetError is the error of a network operation performed by a transport. It
+// wraps the error of the net package and, when it can be identified, the
+// reason of the failure, e.g., ErrConnectionRefused, which can be checked
+// using errors.Is.
+type NetError struct {
+	// Op is the operation that failed, e.g., "dial"
+	Op string
+	// Addr is the remote address, if known
+	Addr string
+	// Kind is the sentinel error identifying the failure, nil if unknown
+	Kind error
+	// Err is the underlying error
+	Err error
+}
+
+func (e *NetError) Error() string {
+	msg := e.Op
+	if e.Addr != "" {
+		msg += " " + e.Addr
+	}
+	if e.Kind != nil {
+		return fmt.Sprintf("%s: %s: %s", msg, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Err)
+}
+
+// Unwrap returns the underlying error, e.g., a *net.OpError
+func (e *NetError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the failure is identified by a sentinel error
+func (e *NetError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// netError wraps the error of a network operation, identifying connections
+// refused or closed by the remote side
+func netError(op string, addr string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var kind error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		kind = ErrConnectionRefused
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		kind = ErrPeerClosed
+	}
+	return &NetError{Op: op, Addr: addr, Kind: kind, Err: err}
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	/* Fragment header, at the beginning of the payload of each fragment */
+	fragSeqOffset      = 0
+	fragOffsetOffset   = 8
+	fragTotalLenOffset = 16
+	fragNumFragsOffset = 24
+	fragMsgTypeOffset  = 28
+	fragHdrLen         = 32
+)
+
+// fragHdr is the header of a fragment of a message that does not fit in a
+// single frame
+type fragHdr struct {
+	// seq is the sequence number of the message the fragment belongs to
+	seq uint64
+	// offset is the offset of the fragment's data in the message
+	offset uint64
+	// totalLen is the size of the entire message
+	totalLen uint64
+	// numFrags is the number of fragments of the message
+	numFrags uint32
+	// msgType is the identifier of the type of the message (see wireMsgTypes),
+	// 0 for a DATAMSG
+	msgType uint8
+}
+
+func (h *fragHdr) put(frag []byte) {
+	binary.LittleEndian.PutUint64(frag[fragSeqOffset:], h.seq)
+	binary.LittleEndian.PutUint64(frag[fragOffsetOffset:], h.offset)
+	binary.LittleEndian.PutUint64(frag[fragTotalLenOffset:], h.totalLen)
+	binary.LittleEndian.PutUint32(frag[fragNumFragsOffset:], h.numFrags)
+	frag[fragMsgTypeOffset] = h.msgType
+}
+
+// getFragHdr parses the payload of a fragment and returns its header and data
+func getFragHdr(frag []byte) (fragHdr, []byte, error) {
+	var h fragHdr
+	if len(frag) < fragHdrLen {
+		return h, nil, fmt.Errorf("fragment too small")
+	}
+	h.seq = binary.LittleEndian.Uint64(frag[fragSeqOffset:])
+	h.offset = binary.LittleEndian.Uint64(frag[fragOffsetOffset:])
+	h.totalLen = binary.LittleEndian.Uint64(frag[fragTotalLenOffset:])
+	h.numFrags = binary.LittleEndian.Uint32(frag[fragNumFragsOffset:])
+	h.msgType = frag[fragMsgTypeOffset]
+	data := frag[fragHdrLen:]
+	if h.numFrags == 0 || h.offset+uint64(len(data)) > h.totalLen {
+		return h, nil, fmt.Errorf("invalid fragment at offset %d", h.offset)
+	}
+	return h, data, nil
+}
+
+// numFragments returns the number of fragments of a payload of a given size
+func numFragments(size int, chunkSize int) int {
+	numFrags := (size + chunkSize - 1) / chunkSize
+	if numFrags == 0 {
+		numFrags = 1
+	}
+	return numFrags
+}
+
+// fragment splits the payload of a data message into fragments of at most
+// chunkSize bytes of data and calls send for each of them, in order. The
+// fragment passed to send is reused for the next fragment so it must be
+// copied if needed.
+func fragment(payload []byte, msgType string, chunkSize int, seq uint64, send func(i int, frag []byte) error) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("MTU too small to fragment messages")
+	}
+	numFrags := numFragments(len(payload), chunkSize)
+
+	frag := make([]byte, fragHdrLen+chunkSize)
+	h := fragHdr{
+		seq:      seq,
+		totalLen: uint64(len(payload)),
+		numFrags: uint32(numFrags),
+	}
+	if msgType != DATAMSG {
+		h.msgType, _ = wireMsgType(msgType)
+	}
+	for i := 0; i < numFrags; i++ {
+		start := i * chunkSize
+		end := start + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		h.offset = uint64(start)
+		h.put(frag)
+		n := copy(frag[fragHdrLen:], payload[start:end])
+		err := send(i, frag[:fragHdrLen+n])
+		if err != nil {
+			return fmt.Errorf("unable to send fragment %d/%d: %w", i, numFrags, err)
+		}
+	}
+	return nil
+}
+
+// fragKey identifies a message between a pair of endpoints
+type fragKey struct {
+	peers string
+	seq   uint64
+}
+
+func fragPeers(src string, dst string) string {
+	return src + ":" + dst
+}
+
+// partialMsg is a message being reassembled
+type partialMsg struct {
+	rx        []byte
+	numFrags  uint32
+	remaining uint32
+	// received are the offsets of the fragments already received
+	received map[uint64]bool
+}
+
+// reassembler rebuilds messages from their fragments. It is not safe for
+// concurrent use.
+type reassembler struct {
+	msgs map[fragKey]*partialMsg
+	// maxMsgSize is the maximum size of a reassembled message
+	maxMsgSize uint64
+	// pending is the size of the messages being reassembled
+	pending uint64
+	// maxPending is the maximum size of the messages being reassembled at a
+	// given time
+	maxPending uint64
+}
+
+func newReassembler(maxMsgSize int64, maxPending int64) *reassembler {
+	return &reassembler{
+		msgs:       make(map[fragKey]*partialMsg),
+		maxMsgSize: uint64(maxMsgSize),
+		maxPending: uint64(maxPending),
+	}
+}
+
+// remove frees a message being reassembled
+func (r *reassembler) remove(key fragKey) {
+	m, ok := r.msgs[key]
+	if !ok {
+		return
+	}
+	r.pending -= uint64(len(m.rx) - payloadOffset)
+	delete(r.msgs, key)
+}
+
+// drop frees the messages being reassembled between a pair of endpoints,
+// e.g., once the channel between them is closed
+func (r *reassembler) drop(peers string) {
+	for key := range r.msgs {
+		if key.peers == peers {
+			r.remove(key)
+		}
+	}
+}
+
+// reset frees all the messages being reassembled, e.g., once the connection
+// is closed
+func (r *reassembler) reset() {
+	r.msgs = make(map[fragKey]*partialMsg)
+	r.pending = 0
+}
+
+// add adds a fragment, received in a RX buffer, to the message it belongs to.
+// Once all the fragments of the message are received, the message is returned
+// with its original type and the same layout than a RX buffer so that the
+// payload can be extracted the usual way. The returned buffer is not allocated from a pool.
+func (r *reassembler) add(rx []byte, peers string, frag []byte) (fragKey, []byte, error) {
+	h, data, err := getFragHdr(frag)
+	if err != nil {
+		return fragKey{}, nil, err
+	}
+
+	key := fragKey{
+		peers: peers,
+		seq:   h.seq,
+	}
+	m, ok := r.msgs[key]
+	if !ok {
+		// The size is checked before allocating the message: a fragment
+		// carries at most the data fitting in the RX buffer it is received in
+		if h.totalLen > r.maxMsgSize {
+			return key, nil, fmt.Errorf("message %d of %d bytes: %w", h.seq, h.totalLen, ErrMessageTooLarge)
+		}
+		maxFragLen := uint64(len(rx) - payloadOffset - fragHdrLen)
+		if h.totalLen > uint64(h.numFrags)*maxFragLen || uint64(h.numFrags) > h.totalLen+1 {
+			return key, nil, fmt.Errorf("%d fragments inconsistent with the size of message %d", h.numFrags, h.seq)
+		}
+		// The fragments of the message are dropped until enough messages
+		// being reassembled are complete
+		if r.pending+h.totalLen > r.maxPending {
+			return key, nil, fmt.Errorf("message %d of %d bytes exceeds the %d bytes available for reassembly: %w", h.seq, h.totalLen, r.maxPending-r.pending, ErrPoolExhausted)
+		}
+		m = &partialMsg{
+			rx:        make([]byte, payloadOffset+int(h.totalLen)),
+			numFrags:  h.numFrags,
+			remaining: h.numFrags,
+			received:  make(map[uint64]bool),
+		}
+		copy(m.rx, rx[:payloadOffset])
+		copy(m.rx[msgTypeOffset:msgTypeOffset+msgTypeLen], dataMsgType(h.msgType))
+		n := binary.PutUvarint(m.rx[payloadSizeOffset:payloadOffset], h.totalLen)
+		m.rx[sizeOfSizeOffset] = uint8(n)
+		r.msgs[key] = m
+		r.pending += h.totalLen
+	}
+	if uint64(len(m.rx)) != payloadOffset+h.totalLen || m.numFrags != h.numFrags {
+		r.remove(key)
+		return key, nil, fmt.Errorf("inconsistent size for fragments of message %d", h.seq)
+	}
+	if m.received[h.offset] {
+		return key, nil, fmt.Errorf("duplicate fragment at offset %d of message %d", h.offset, h.seq)
+	}
+	m.received[h.offset] = true
+	copy(m.rx[payloadOffset+int(h.offset):], data)
+	m.remaining--
+	if m.remaining > 0 {
+		return key, nil, nil
+	}
+
+	r.remove(key)
+	return key, m.rx, nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// frameLenLen is the size of the length prefix of a frame
+	frameLenLen = 4
+)
+
+// frameReader reads length-prefixed frames from a stream, e.g., a TCP
+// connection. The stream may split a frame across several reads or coalesce
+// several frames in a single read; the reader always returns complete frames.
+type frameReader struct {
+	r *bufio.Reader
+
+	// maxLen is the maximum size of a frame, i.e., the MTU
+	maxLen int
+}
+
+func newFrameReader(r io.Reader, maxLen int) *frameReader {
+	return &frameReader{
+		r:      bufio.NewReader(r),
+		maxLen: maxLen,
+	}
+}
+
+// readLen reads the length prefix of the next frame. A frame always includes
+// a complete message header. io.EOF is returned if the stream is closed
+// between two frames.
+func (fr *frameReader) readLen() (int, error) {
+	var lenBuf [frameLenLen]byte
+	_, err := io.ReadFull(fr.r, lenBuf[:])
+	if err != nil {
+		return 0, err
+	}
+
+	n := int(binary.LittleEndian.Uint32(lenBuf[:]))
+	if n < compactHdrLen || n > fr.maxLen {
+		return 0, fmt.Errorf("invalid frame length: %d", n)
+	}
+	return n, nil
+}
+
+// peek returns the next bytes of the current frame without consuming them
+func (fr *frameReader) peek(n int) ([]byte, error) {
+	return fr.r.Peek(n)
+}
+
+// readFull reads the content of the current frame
+func (fr *frameReader) readFull(buf []byte) error {
+	_, err := io.ReadFull(fr.r, buf)
+	if err != nil {
+		return fmt.Errorf("truncated frame: %w", err)
+	}
+	return nil
+}
+
+// Read reads raw data from the stream, e.g., data following a frame
+func (fr *frameReader) Read(p []byte) (int, error) {
+	return fr.r.Read(p)
+}
+
+// writeFrame writes a frame prefixed by its length to a stream. Raw data that
+// must immediately follow the frame can be specified and is written at the
+// same time.
+func writeFrame(w io.Writer, frame []byte, data ...[]byte) error {
+	lenBuf := make([]byte, frameLenLen)
+	binary.LittleEndian.PutUint32(lenBuf, uint32(len(frame)))
+	bufs := net.Buffers{lenBuf, frame}
+	bufs = append(bufs, data...)
+	_, err := bufs.WriteTo(w)
+	return err
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func framingMsg(payload string) []byte {
+	tx := make([]byte, defaultMTU)
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	setHeader(tx, hdr)
+	setPayload(tx, []byte(payload))
+	return tx
+}
+
+func TestFrameReader(t *testing.T) {
+	tests := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{
+			name: "coalesced frames",
+			wrap: func(r io.Reader) io.Reader { return r },
+		},
+		{
+			name: "split frames",
+			wrap: iotest.OneByteReader,
+		},
+		{
+			name: "partial reads",
+			wrap: iotest.HalfReader,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Two messages in a row in the stream
+			var stream bytes.Buffer
+			msgs := []string{msg1, msg2}
+			sender := newWireCodec()
+			for _, msg := range msgs {
+				err := sender.writeMsg(&stream, framingMsg(msg))
+				if err != nil {
+					t.Fatalf("unable to write frame: %s", err)
+				}
+			}
+
+			reader := newFrameReader(tt.wrap(&stream), defaultMTU)
+			receiver := newWireCodec()
+			tcp := newTCPTransport(&TCPTransportCfg{})
+			for _, msg := range msgs {
+				rx := make([]byte, defaultMTU)
+				n, err := tcp.recvMsg(reader, receiver, rx)
+				if err != nil {
+					t.Fatalf("unable to read frame: %s", err)
+				}
+				if n != payloadOffset+len(msg) {
+					t.Fatalf("frame of %d bytes instead of %d", n, payloadOffset+len(msg))
+				}
+				data, err := tcp.ExtractPayload(rx)
+				if err != nil {
+					t.Fatalf("unable to extract payload: %s", err)
+				}
+				if string(data) != msg {
+					t.Fatalf("received %s instead of %s", string(data), msg)
+				}
+			}
+
+			// The stream is closed cleanly between two frames
+			n, err := tcp.recvMsg(reader, receiver, make([]byte, defaultMTU))
+			if n != 0 || !errors.Is(err, ErrPeerClosed) {
+				t.Fatalf("end of stream not detected")
+			}
+		})
+	}
+}
+
+func TestFrameReaderInvalidLength(t *testing.T) {
+	// Frames larger than the MTU or smaller than a message header are rejected
+	for _, size := range []int{2 * defaultMTU, compactHdrLen - 1} {
+		var stream bytes.Buffer
+		err := writeFrame(&stream, make([]byte, size))
+		if err != nil {
+			t.Fatalf("unable to write frame: %s", err)
+		}
+		reader := newFrameReader(&stream, defaultMTU)
+		_, err = reader.readLen()
+		if err == nil {
+			t.Fatalf("frame of %d bytes accepted", size)
+		}
+	}
+
+	reader := newFrameReader(bytes.NewReader([]byte{1, 2}), defaultMTU)
+	_, err := reader.readLen()
+	if err == nil || err == io.EOF {
+		t.Fatalf("truncated frame length not detected")
+	}
+}
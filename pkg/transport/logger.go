@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	// DebugLevel is the level of the messages tracing the progress of
+	// communications, e.g., each message sent or received
+	DebugLevel Level = iota
+	// InfoLevel is the level of the messages reporting connections and
+	// other events of the life of a transport
+	InfoLevel
+	// WarnLevel is the level of the messages reporting unexpected but
+	// recoverable situations
+	WarnLevel
+	// ErrorLevel is the level of the messages reporting failures that could
+	// not be returned to the caller, e.g., in progress threads
+	ErrorLevel
+)
+
+// Keys of the fields attached to log messages
+const (
+	// ComponentKey identifies the component logging the message, e.g., 'tcp'
+	ComponentKey = "component"
+	// EndpointKey identifies the endpoint concerned by the message
+	EndpointKey = "endpoint"
+	// PeerKey identifies the address of the peer concerned by the message
+	PeerKey = "peer"
+	// MsgTypeKey identifies the type of the message sent or received
+	MsgTypeKey = "msg_type"
+	// ErrorKey identifies the error reported by the message
+	ErrorKey = "error"
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	case ErrorLevel:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL%d", int(l))
+}
+
+// Field is a key/value pair attached to a log message, e.g., the ID of the
+// endpoint concerned by the message
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger is the interface used to log the messages of the transports, to
+// route them to the logging stack of the application. By default, nothing
+// is logged.
+type Logger interface {
+	// Enabled checks whether messages of a given level are logged, so that
+	// messages are not built on hot paths when they are discarded
+	Enabled(level Level) bool
+
+	// Log logs a message with structured fields
+	Log(level Level, msg string, fields ...Field)
+}
+
+type silentLogger struct{}
+
+func (silentLogger) Enabled(level Level) bool {
+	return false
+}
+
+func (silentLogger) Log(level Level, msg string, fields ...Field) {
+}
+
+// SilentLogger returns a logger discarding all messages, i.e., the default
+// logger of the transports
+func SilentLogger() Logger {
+	return silentLogger{}
+}
+
+// stdLogger logs messages using the standard log package
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+// NewStdLogger returns a logger writing the messages of a given level and
+// above to a standard logger, the default standard logger if nil, e.g.,
+// '[ERROR:tcp] connection rejected peer=127.0.0.1:4242 error=...'
+func NewStdLogger(l *log.Logger, level Level) Logger {
+	return &stdLogger{
+		l:     l,
+		level: level,
+	}
+}
+
+func (s *stdLogger) Enabled(level Level) bool {
+	return level >= s.level
+}
+
+func (s *stdLogger) Log(level Level, msg string, fields ...Field) {
+	if !s.Enabled(level) {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("[")
+	b.WriteString(level.String())
+	for _, f := range fields {
+		if f.Key == ComponentKey {
+			fmt.Fprintf(&b, ":%v", f.Value)
+		}
+	}
+	b.WriteString("] ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		if f.Key != ComponentKey {
+			fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+		}
+	}
+	if s.l == nil {
+		log.Print(b.String())
+		return
+	}
+	s.l.Print(b.String())
+}
+
+// ComponentLogger logs the messages of a component, e.g., a transport,
+// through the logger of its configuration, silent if not set. The name of
+// the component is attached to all the messages.
+type ComponentLogger struct {
+	Logger
+	component string
+}
+
+// NewComponentLogger returns the logger of a component, e.g., 'tcp'
+func NewComponentLogger(l Logger, component string) ComponentLogger {
+	if l == nil {
+		l = silentLogger{}
+	}
+	return ComponentLogger{
+		Logger:    l,
+		component: component,
+	}
+}
+
+func (l ComponentLogger) log(level Level, msg string, fields []Field) {
+	if l.Logger == nil || !l.Enabled(level) {
+		return
+	}
+	l.Log(level, msg, append(fields, Field{Key: ComponentKey, Value: l.component})...)
+}
+
+// Debug logs a message at the debug level
+func (l ComponentLogger) Debug(msg string, fields ...Field) {
+	l.log(DebugLevel, msg, fields)
+}
+
+// Info logs a message at the info level
+func (l ComponentLogger) Info(msg string, fields ...Field) {
+	l.log(InfoLevel, msg, fields)
+}
+
+// Warn logs a message at the warn level
+func (l ComponentLogger) Warn(msg string, fields ...Field) {
+	l.log(WarnLevel, msg, fields)
+}
+
+// Error logs a message at the error level
+func (l ComponentLogger) Error(msg string, fields ...Field) {
+	l.log(ErrorLevel, msg, fields)
+}
+
+// DebugEnabled checks whether debug messages are logged, to be checked
+// before building them on hot paths
+func (l ComponentLogger) DebugEnabled() bool {
+	return l.Logger != nil && l.Enabled(DebugLevel)
+}
+
+// EndpointField returns the field identifying the endpoint concerned by a message
+func EndpointField(id string) Field {
+	return Field{Key: EndpointKey, Value: id}
+}
+
+// PeerField returns the field identifying the address of the peer concerned
+// by a message
+func PeerField(addr string) Field {
+	return Field{Key: PeerKey, Value: addr}
+}
+
+// MsgTypeField returns the field identifying the type of the message sent
+// or received
+func MsgTypeField(msgType string) Field {
+	return Field{Key: MsgTypeKey, Value: msgType}
+}
+
+// ErrorField returns the field identifying the error reported by a message
+func ErrorField(err error) Field {
+	return Field{Key: ErrorKey, Value: err}
+}
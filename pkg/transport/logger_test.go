@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	loggerPort = 44501
+)
+
+type logEntry struct {
+	level  Level
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger records the messages of a given level and above
+type recordingLogger struct {
+	level   Level
+	lock    sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *recordingLogger) Log(level Level, msg string, fields ...Field) {
+	e := logEntry{
+		level:  level,
+		msg:    msg,
+		fields: make(map[string]interface{}),
+	}
+	for _, f := range fields {
+		e.fields[f.Key] = f.Value
+	}
+	l.lock.Lock()
+	l.entries = append(l.entries, e)
+	l.lock.Unlock()
+}
+
+// find returns the first message with a given field, if any
+func (l *recordingLogger) find(key string, value interface{}) *logEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := range l.entries {
+		if l.entries[i].fields[key] == value {
+			return &l.entries[i]
+		}
+	}
+	return nil
+}
+
+func (l *recordingLogger) minLevel() Level {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	min := ErrorLevel
+	for _, e := range l.entries {
+		if e.level < min {
+			min = e.level
+		}
+	}
+	return min
+}
+
+func TestTCPLogger(t *testing.T) {
+	serverLogger := &recordingLogger{level: InfoLevel}
+	serverCfg := TCPTransportCfg{
+		Interface:          "127.0.0.1",
+		PortLow:            loggerPort,
+		PortHigh:           loggerPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		Logger:             serverLogger,
+	}
+	server, err := serverCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer server.Close()
+
+	clientLogger := &recordingLogger{level: DebugLevel}
+	clientCfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   loggerPort,
+		Logger:    clientLogger,
+	}
+	client, err := clientCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer client.Close()
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	err = client.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	rx := <-server.RecvQueue
+	server.ReturnRX(rx)
+
+	// Messages carry the component and structured fields
+	e := serverLogger.find(MsgTypeKey, DATAMSG)
+	if e != nil {
+		t.Fatalf("debug message logged at info level: %s", e.msg)
+	}
+	if serverLogger.minLevel() < InfoLevel {
+		t.Fatal("messages below the level of the logger were logged")
+	}
+	// The send thread logs the message once written to the connection
+	deadline := time.Now().Add(time.Second)
+	e = clientLogger.find(MsgTypeKey, DATAMSG)
+	for e == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		e = clientLogger.find(MsgTypeKey, DATAMSG)
+	}
+	if e == nil {
+		t.Fatal("sent message not logged")
+	}
+	if e.level != DebugLevel || e.fields[ComponentKey] != "tcp" || e.fields[PeerKey] == nil {
+		t.Fatalf("invalid log message %+v", *e)
+	}
+	if clientLogger.find(ComponentKey, "tcp") == nil || serverLogger.find(ComponentKey, "tcp") == nil {
+		t.Fatal("connection not logged")
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewComponentLogger(NewStdLogger(log.New(&buf, "", 0), WarnLevel), "tcp")
+	l.Info("connected")
+	l.Warn("connection rejected", PeerField("127.0.0.1:4242"), ErrorField(errors.New("timeout")))
+
+	expected := "[WARN:tcp] connection rejected peer=127.0.0.1:4242 error=timeout\n"
+	if buf.String() != expected {
+		t.Fatalf("logged %q instead of %q", buf.String(), expected)
+	}
+
+	// Nothing is logged by default
+	if NewComponentLogger(nil, "tcp").DebugEnabled() {
+		t.Fatal("default logger is not silent")
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gvallee/memory_pool/pkg/pool"
+)
+
+const (
+	// LoopbackTransportID identifies the in-process loopback transport
+	LoopbackTransportID = "LOOPBACK"
+)
+
+// LoopbackTransportCfg is the structure capturing the configuration of an
+// in-process loopback transport
+type LoopbackTransportCfg struct {
+	// MTU is the requested MTU size, larger messages are still delivered
+	// but without using the RX pool
+	MTU int64
+
+	// ZeroCopy specifies whether the payload of messages is handed over to
+	// the receiver instead of being copied. The sender then transfers the
+	// ownership of the payload and must not modify it once sent.
+	ZeroCopy bool
+}
+
+// LoopbackTransport is the structure representing a given instantiation of an
+// in-process loopback transport: messages between endpoints of the same
+// process are directly placed in the receive queue, without any socket
+type LoopbackTransport struct {
+	// Cfg is the configuration of the loopback transport
+	Cfg *LoopbackTransportCfg
+
+	// receiverEPs are the local endpoints reachable through the transport,
+	// the first one being the default target of connection requests
+	receiverEPs []string
+	// channels are the endpoint-to-endpoint channels established through the transport
+	channels map[tcpChannel]bool
+	// payloads are the payloads handed over without copy, indexed by the
+	// RX buffer storing the header of the message
+	payloads map[*byte][]byte
+	lock     sync.Mutex
+
+	// RX pool
+	RxPool pool.Pool
+	// RecvQueue is the receive queue, accessed by the endpoint to generate RX events
+	RecvQueue chan []byte
+}
+
+// Init creates a new in-process loopback transport based on a configuration
+func (cfg *LoopbackTransportCfg) Init() *LoopbackTransport {
+	var tpt LoopbackTransport
+	tpt.Cfg = cfg
+
+	tpt.RxPool = pool.Pool{
+		ObjSize:    defaultMTU,
+		NObj:       defaultNumRX,
+		GrowFactor: 0,
+		Erase:      true,
+	}
+	if cfg.MTU != 0 {
+		tpt.RxPool.ObjSize = cfg.MTU
+	}
+	tpt.RxPool.New()
+
+	// Messages are queued until the receiver gets them so the sender never
+	// blocks, unless all the RX buffers are in use
+	tpt.RecvQueue = make(chan []byte, defaultNumRX)
+	tpt.channels = make(map[tcpChannel]bool)
+	tpt.payloads = make(map[*byte][]byte)
+
+	return &tpt
+}
+
+// ID returns the identifier of the loopback transport type
+func (tpt *LoopbackTransport) ID() string {
+	return LoopbackTransportID
+}
+
+// AddEndpoint makes a local endpoint reachable through the transport
+func (tpt *LoopbackTransport) AddEndpoint(epID string) {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for _, id := range tpt.receiverEPs {
+		if id == epID {
+			return
+		}
+	}
+	tpt.receiverEPs = append(tpt.receiverEPs, epID)
+}
+
+// Connect connects a local endpoint to the default endpoint of the transport
+func (tpt *LoopbackTransport) Connect(epID string) (string, error) {
+	return tpt.ConnectEP(epID, "")
+}
+
+// ConnectEP connects a local endpoint to another local endpoint reachable
+// through the transport. If the destination is not specified, the default
+// endpoint is used.
+func (tpt *LoopbackTransport) ConnectEP(epID string, dstID string) (string, error) {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+
+	remote := ""
+	for _, id := range tpt.receiverEPs {
+		if id == dstID || (dstID == "" && id != epID) {
+			remote = id
+			break
+		}
+	}
+	if remote == "" {
+		return "", fmt.Errorf("endpoint %s is not reachable through the loopback transport", dstID)
+	}
+	tpt.channels[tcpChannel{local: epID, remote: remote}] = true
+
+	return remote, nil
+}
+
+// NumChannels returns the number of endpoint-to-endpoint channels established
+// through the transport
+func (tpt *LoopbackTransport) NumChannels() int {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	return len(tpt.channels)
+}
+
+// Accept makes a local endpoint reachable; there is no connection to wait for
+func (tpt *LoopbackTransport) Accept(epID string) error {
+	tpt.AddEndpoint(epID)
+	return nil
+}
+
+// AcceptsConns specifies whether the transport is configured to accept
+// incoming connections, which is always the case for the loopback transport
+func (tpt *LoopbackTransport) AcceptsConns() bool {
+	return true
+}
+
+// IsAcceptingConns checks whether the transport is currently accepting incoming connections
+func (tpt *LoopbackTransport) IsAcceptingConns() bool {
+	return true
+}
+
+// SendMsg delivers a message to the receive queue. The payload is copied to
+// a RX buffer unless the transport is configured for zero-copy, in which case
+// only the header is stored in the RX buffer and the payload is handed over.
+func (tpt *LoopbackTransport) SendMsg(hdr TCPHeader, payload []byte) error {
+	var rx []byte
+	if tpt.Cfg.ZeroCopy || payloadOffset+len(payload) <= int(tpt.RxPool.ObjSize) {
+		rx = tpt.RxPool.Get()
+		if rx == nil {
+			return fmt.Errorf("unable to get RX buffer: %w", ErrPoolExhausted)
+		}
+	} else {
+		// Like reassembled messages, large messages are not allocated from the pool
+		rx = make([]byte, payloadOffset+len(payload))
+	}
+
+	setHeader(rx, hdr)
+	if tpt.Cfg.ZeroCopy {
+		n := binary.PutUvarint(rx[payloadSizeOffset:payloadOffset], uint64(len(payload)))
+		rx[sizeOfSizeOffset] = uint8(n)
+		tpt.lock.Lock()
+		tpt.payloads[&rx[0]] = payload
+		tpt.lock.Unlock()
+	} else {
+		setPayload(rx, payload)
+	}
+	tpt.RecvQueue <- rx
+
+	return nil
+}
+
+// getPayload returns the payload handed over for a RX buffer, if any
+func (tpt *LoopbackTransport) getPayload(rx []byte) ([]byte, bool) {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	payload, ok := tpt.payloads[&rx[0]]
+	return payload, ok
+}
+
+// ExtractPayload returns the payload from a RX buffer
+func (tpt *LoopbackTransport) ExtractPayload(rx []byte) ([]byte, error) {
+	if payload, ok := tpt.getPayload(rx); ok {
+		return payload, nil
+	}
+	sizeOfSize := int(rx[sizeOfSizeOffset])
+	payloadSize, n := binary.Uvarint(rx[payloadSizeOffset : payloadSizeOffset+sizeOfSize])
+	if n != sizeOfSize {
+		return nil, fmt.Errorf("failed to read the payload size from loopback msg")
+	}
+	return rx[payloadOffset : payloadOffset+payloadSize], nil
+}
+
+// TakePayload returns the payload of a RX buffer, which remains valid once the
+// RX buffer is returned: with zero-copy, the payload handed over by the sender
+// is returned as is; otherwise, it is a copy of the payload.
+func (tpt *LoopbackTransport) TakePayload(rx []byte) ([]byte, error) {
+	if payload, ok := tpt.getPayload(rx); ok {
+		return payload, nil
+	}
+	payload, err := tpt.ExtractPayload(rx)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	return data, nil
+}
+
+// ExtractSrc returns the subset of the RX storing the ID of the message's source
+func (tpt *LoopbackTransport) ExtractSrc(rx []byte) []byte {
+	return bytes.TrimRight(rx[srcOffset:srcOffset+srcLen], "\x00")
+}
+
+// ExtractDest returns the message destination endpoint ID from a RX buffer
+func (tpt *LoopbackTransport) ExtractDest(rx []byte) string {
+	return strings.TrimRight(string(rx[dstOffset:dstOffset+dstLen]), "\x00")
+}
+
+// GetRecvQueue returns the queue where the RX buffers of received messages are made available
+func (tpt *LoopbackTransport) GetRecvQueue() chan []byte {
+	return tpt.RecvQueue
+}
+
+// ReturnRX gives a RX buffer back to the RX pool of the transport
+func (tpt *LoopbackTransport) ReturnRX(rx []byte) error {
+	tpt.lock.Lock()
+	delete(tpt.payloads, &rx[0])
+	tpt.lock.Unlock()
+	if int64(len(rx)) > tpt.RxPool.ObjSize {
+		return nil
+	}
+	return tpt.RxPool.Return(rx)
+}
+
+// Close closes the transport; there is no connection to close
+func (tpt *LoopbackTransport) Close() error {
+	return nil
+}
+
+// Fini cleanly finalizes a loopback transport
+func (tpt *LoopbackTransport) Fini() {
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		name     string
+		zeroCopy bool
+		size     int
+	}{
+		{
+			name: "copy",
+			size: len(msg1),
+		},
+		{
+			name: "copy larger than MTU",
+			size: 3 * defaultMTU,
+		},
+		{
+			name:     "zero-copy",
+			zeroCopy: true,
+			size:     3 * defaultMTU,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := LoopbackTransportCfg{
+				ZeroCopy: tt.zeroCopy,
+			}
+			loopback := cfg.Init()
+			loopback.AddEndpoint(serverID)
+			remoteID, err := loopback.Connect(clientID)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+			if remoteID != serverID {
+				t.Fatalf("connected to %s instead of %s", remoteID, serverID)
+			}
+			_, err = loopback.ConnectEP(clientID, "unknown endpoint")
+			if err == nil {
+				t.Fatalf("connection to an unknown endpoint succeeded")
+			}
+
+			payload := bytes.Repeat([]byte{'a'}, tt.size)
+			hdr := TCPHeader{
+				MsgType: DATAMSG,
+				Src:     clientID,
+				Dst:     serverID,
+			}
+			err = loopback.SendMsg(hdr, payload)
+			if err != nil {
+				t.Fatalf("unable to send message: %s", err)
+			}
+
+			rx := <-loopback.RecvQueue
+			if string(loopback.ExtractSrc(rx)) != clientID || loopback.ExtractDest(rx) != serverID {
+				t.Fatalf("invalid source or destination")
+			}
+			data, err := loopback.TakePayload(rx)
+			if err != nil {
+				t.Fatalf("unable to get payload: %s", err)
+			}
+			loopback.ReturnRX(rx)
+			if !bytes.Equal(data, payload) {
+				t.Fatalf("payload corrupted")
+			}
+			if (&data[0] == &payload[0]) != tt.zeroCopy {
+				t.Fatalf("payload handed over: %v, zero-copy: %v", &data[0] == &payload[0], tt.zeroCopy)
+			}
+		})
+	}
+}
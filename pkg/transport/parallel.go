@@ -0,0 +1,343 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gvallee/comm/internal/pkg/util"
+)
+
+const (
+	// ParallelTCPTransportID identifies the parallel TCP transport
+	ParallelTCPTransportID = "PARALLEL-TCP"
+
+	defaultNumParallelConns = 4
+)
+
+// ParallelTCPTransportCfg is the structure capturing the configuration of a
+// parallel TCP transport
+type ParallelTCPTransportCfg struct {
+	// TCP is the configuration of the TCP connections. The i-th connection
+	// uses the i-th port of the [PortLow, PortHigh] range.
+	TCP TCPTransportCfg
+
+	// NumConns is the number of TCP connections between a pair of endpoints
+	NumConns int
+}
+
+// ParallelTCPTransport is the structure representing a transport that stripes
+// messages between a pair of endpoints across several TCP connections. Messages
+// are reassembled and delivered in order to the receive queue.
+type ParallelTCPTransport struct {
+	// Cfg is the configuration of the parallel TCP transport
+	Cfg *ParallelTCPTransportCfg
+
+	// log logs the messages of the transport through the logger of the
+	// configuration of the TCP connections
+	log ComponentLogger
+
+	lanes   []*TCPTransport
+	lock    sync.Mutex
+	sendSeq map[string]uint64
+	// recvSeq is the sequence number of the next message to deliver, per pair of endpoints
+	recvSeq   map[string]uint64
+	stripes   *reassembler
+	completed map[fragKey][]byte
+	// ready are the messages in order waiting to be delivered
+	ready [][]byte
+	// delivering specifies whether a lane is delivering the ready messages
+	delivering bool
+
+	// RecvQueue is the receive queue, accessed by the endpoint to generate RX events
+	RecvQueue chan []byte
+}
+
+// Init creates a new parallel TCP transport based on a configuration
+func (cfg *ParallelTCPTransportCfg) Init() (*ParallelTCPTransport, error) {
+	if cfg.NumConns == 0 {
+		cfg.NumConns = defaultNumParallelConns
+	}
+	portHigh := cfg.TCP.PortHigh
+	if portHigh == 0 {
+		portHigh = cfg.TCP.PortLow + uint16(cfg.NumConns) - 1
+	}
+	if int(portHigh)-int(cfg.TCP.PortLow)+1 < cfg.NumConns {
+		return nil, fmt.Errorf("port range too small for %d connections", cfg.NumConns)
+	}
+
+	var ptcp ParallelTCPTransport
+	ptcp.Cfg = cfg
+	ptcp.log = NewComponentLogger(cfg.TCP.Logger, "ptcp")
+	ptcp.sendSeq = make(map[string]uint64)
+	ptcp.recvSeq = make(map[string]uint64)
+	ptcp.stripes = newReassembler(cfg.TCP.maxMsgSize(), cfg.TCP.maxPendingBytes())
+	ptcp.completed = make(map[fragKey][]byte)
+	ptcp.RecvQueue = make(chan []byte)
+
+	for i := 0; i < cfg.NumConns; i++ {
+		laneCfg := cfg.TCP
+		laneCfg.PortLow = cfg.TCP.PortLow + uint16(i)
+		laneCfg.PortHigh = laneCfg.PortLow
+		lane := newTCPTransport(&laneCfg)
+		if i == 0 {
+			err := lane.initTLS()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// The TLS configuration is loaded once for all the lanes
+			lane.tlsClient = ptcp.lanes[0].tlsClient
+			lane.tlsServer = ptcp.lanes[0].tlsServer
+		}
+		ptcp.lanes = append(ptcp.lanes, lane)
+		go laneRecvThread(&ptcp, lane)
+	}
+
+	if cfg.TCP.Accept {
+		serverID := util.GenerateID()
+		if !cfg.TCP.DoNotBlockOnAccept {
+			err := ptcp.Accept(serverID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to accept incoming connections: %w", err)
+			}
+		} else {
+			go ptcp.Accept(serverID)
+		}
+	}
+
+	return &ptcp, nil
+}
+
+func (tpt *ParallelTCPTransport) chunkSize() int {
+	return int(tpt.lanes[0].TxPool.ObjSize) - payloadOffset - fragHdrLen
+}
+
+// laneRecvThread gets the fragments received on a connection and reassembles the messages
+func laneRecvThread(tpt *ParallelTCPTransport, lane *TCPTransport) {
+	for {
+		select {
+		case rx := <-lane.RecvQueue:
+			err := tpt.handleFragment(lane, rx)
+			if err != nil {
+				tpt.log.Error("unable to handle fragment", ErrorField(err))
+			}
+			lane.ReturnRX(rx)
+		case <-lane.done:
+			return
+		}
+	}
+}
+
+func (tpt *ParallelTCPTransport) handleFragment(lane *TCPTransport, rx []byte) error {
+	frag, err := lane.ExtractPayload(rx)
+	if err != nil {
+		return err
+	}
+
+	tpt.lock.Lock()
+	peers := fragPeers(string(lane.ExtractSrc(rx)), lane.ExtractDest(rx))
+	key, msg, err := tpt.stripes.add(rx, peers, frag)
+	if err != nil || msg == nil {
+		tpt.lock.Unlock()
+		return err
+	}
+
+	// The message is complete, we deliver all the messages between that
+	// pair of endpoints that are now in order
+	tpt.completed[key] = msg
+	for {
+		next := fragKey{peers: peers, seq: tpt.recvSeq[peers]}
+		msg, ok := tpt.completed[next]
+		if !ok {
+			break
+		}
+		delete(tpt.completed, next)
+		tpt.recvSeq[peers]++
+		tpt.ready = append(tpt.ready, msg)
+	}
+
+	// The lock is not held while delivering the messages so that messages
+	// can be sent while the receive queue is not drained. A single lane
+	// delivers the messages at a time to keep them in order, until it is
+	// closed.
+	if tpt.delivering {
+		tpt.lock.Unlock()
+		return nil
+	}
+	tpt.delivering = true
+	for len(tpt.ready) > 0 {
+		msg := tpt.ready[0]
+		tpt.ready = tpt.ready[1:]
+		tpt.lock.Unlock()
+		select {
+		case tpt.RecvQueue <- msg:
+		case <-lane.done:
+			tpt.lock.Lock()
+			tpt.delivering = false
+			tpt.lock.Unlock()
+			return nil
+		}
+		tpt.lock.Lock()
+	}
+	tpt.delivering = false
+	tpt.lock.Unlock()
+	return nil
+}
+
+// SendMsg sends a message by splitting it into fragments that are sent
+// round-robin over the different TCP connections.
+func (tpt *ParallelTCPTransport) SendMsg(hdr TCPHeader, payload []byte) error {
+	if !isDataMsg(hdr.MsgType) {
+		for _, lane := range tpt.lanes {
+			err := lane.SendMsg(hdr, payload)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tpt.lock.Lock()
+	peers := fragPeers(hdr.Src, hdr.Dst)
+	seq := tpt.sendSeq[peers]
+	tpt.sendSeq[peers]++
+	tpt.lock.Unlock()
+
+	// The lanes copy the data before returning so the fragment can be reused
+	return fragment(payload, hdr.MsgType, tpt.chunkSize(), seq, func(i int, frag []byte) error {
+		return tpt.lanes[i%len(tpt.lanes)].SendMsg(hdr, frag)
+	})
+}
+
+// ID returns the identifier of the parallel TCP transport type
+func (tpt *ParallelTCPTransport) ID() string {
+	return ParallelTCPTransportID
+}
+
+// Accept accepts the incoming TCP connections, one per port
+func (tpt *ParallelTCPTransport) Accept(epID string) error {
+	for i, lane := range tpt.lanes {
+		err := lane.Accept(epID)
+		if err != nil {
+			return fmt.Errorf("unable to accept connection %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Connect creates all the TCP connections to the remote endpoint and returns its ID
+func (tpt *ParallelTCPTransport) Connect(epID string) (string, error) {
+	return tpt.ConnectEP(epID, "")
+}
+
+// ConnectEP connects a local endpoint to a specific remote endpoint over all
+// the TCP connections, which are created if necessary.
+func (tpt *ParallelTCPTransport) ConnectEP(epID string, dstID string) (string, error) {
+	var remoteID string
+	for i, lane := range tpt.lanes {
+		id, err := lane.ConnectEP(epID, dstID)
+		if err != nil {
+			return "", fmt.Errorf("connection %d failed: %w", i, err)
+		}
+		if i == 0 {
+			remoteID = id
+		}
+	}
+	return remoteID, nil
+}
+
+// AddEndpoint makes a local endpoint reachable through all the TCP connections
+func (tpt *ParallelTCPTransport) AddEndpoint(epID string) {
+	for _, lane := range tpt.lanes {
+		lane.AddEndpoint(epID)
+	}
+}
+
+// NumChannels returns the number of channels multiplexed over the connections
+func (tpt *ParallelTCPTransport) NumChannels() int {
+	return tpt.lanes[0].NumChannels()
+}
+
+// NumConns returns the number of TCP connections used by the transport
+func (tpt *ParallelTCPTransport) NumConns() int {
+	return len(tpt.lanes)
+}
+
+// AcceptsConns specifies whether the transport is configured to accept incoming connections
+func (tpt *ParallelTCPTransport) AcceptsConns() bool {
+	return tpt.Cfg.TCP.Accept
+}
+
+// IsAcceptingConns checks whether all the TCP connections are accepting incoming connections
+func (tpt *ParallelTCPTransport) IsAcceptingConns() bool {
+	for _, lane := range tpt.lanes {
+		if !lane.IsAcceptingConns() {
+			return false
+		}
+	}
+	return true
+}
+
+// GetRecvQueue returns the queue where reassembled messages are made available
+func (tpt *ParallelTCPTransport) GetRecvQueue() chan []byte {
+	return tpt.RecvQueue
+}
+
+// ReturnRX releases a reassembled message. Reassembled messages are not
+// allocated from a pool, there is nothing to do.
+func (tpt *ParallelTCPTransport) ReturnRX(rx []byte) error {
+	return nil
+}
+
+// ExtractPayload returns the payload from a reassembled message
+func (tpt *ParallelTCPTransport) ExtractPayload(rx []byte) ([]byte, error) {
+	return tpt.lanes[0].ExtractPayload(rx)
+}
+
+// ExtractSrc returns the ID of the source of a reassembled message
+func (tpt *ParallelTCPTransport) ExtractSrc(rx []byte) []byte {
+	return tpt.lanes[0].ExtractSrc(rx)
+}
+
+// ExtractDest returns the ID of the destination of a reassembled message
+func (tpt *ParallelTCPTransport) ExtractDest(rx []byte) string {
+	return tpt.lanes[0].ExtractDest(rx)
+}
+
+// SendTermMsg sends a termination message over all the TCP connections
+func (tpt *ParallelTCPTransport) SendTermMsg(src string, dst string) error {
+	for _, lane := range tpt.lanes {
+		err := lane.SendTermMsg(src, dst)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all the TCP connections, as well as the listeners of the
+// connections still being accepted
+func (tpt *ParallelTCPTransport) Close() error {
+	var err error
+	for _, lane := range tpt.lanes {
+		laneErr := lane.Close()
+		if laneErr != nil {
+			err = laneErr
+		}
+	}
+	return err
+}
+
+// Fini cleanly finalizes a parallel TCP transport
+func (tpt *ParallelTCPTransport) Fini() {
+	for _, lane := range tpt.lanes {
+		lane.Fini()
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	parallelPortLow  = 46000
+	parallelPortHigh = 46010
+	parallelNumConns = 3
+	parallelNumMsgs  = 5
+
+	parallelSendPort = 46020
+)
+
+// parallelMsg returns the i-th test message; the first one is large enough
+// to be striped across all the connections
+func parallelMsg(i int) []byte {
+	if i == 0 {
+		var msg bytes.Buffer
+		for msg.Len() < 10*defaultMTU {
+			fmt.Fprintf(&msg, "%d,", msg.Len())
+		}
+		return msg.Bytes()
+	}
+	return []byte(fmt.Sprintf("message %d", i))
+}
+
+func doParallelServer(t *testing.T, done chan bool) {
+	defer close(done)
+
+	cfg := ParallelTCPTransportCfg{
+		TCP: TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   parallelPortLow,
+			PortHigh:  parallelPortHigh,
+			Accept:    true,
+		},
+		NumConns: parallelNumConns,
+	}
+	ptcp, err := cfg.Init()
+	if err != nil {
+		t.Errorf("unable to instantiate parallel TCP transport: %s", err)
+		return
+	}
+	defer ptcp.Fini()
+
+	// Messages must be received in order, even if the first one is made of
+	// many fragments
+	for i := 0; i < parallelNumMsgs; i++ {
+		rx := <-ptcp.RecvQueue
+		data, err := ptcp.ExtractPayload(rx)
+		if err != nil {
+			t.Errorf("unable to extract payload: %s", err)
+			return
+		}
+		if !bytes.Equal(data, parallelMsg(i)) {
+			t.Errorf("message %d corrupted or out of order (%d bytes)", i, len(data))
+			return
+		}
+		ptcp.ReturnRX(rx)
+	}
+}
+
+func TestParallelTCP(t *testing.T) {
+	done := make(chan bool)
+	go doParallelServer(t, done)
+
+	cfg := ParallelTCPTransportCfg{
+		TCP: TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   parallelPortLow,
+			PortHigh:  parallelPortHigh,
+		},
+		NumConns: parallelNumConns,
+	}
+	ptcp, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate parallel TCP transport: %s", err)
+	}
+	defer ptcp.Close()
+
+	_, err = ptcp.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	if ptcp.NumConns() != parallelNumConns {
+		t.Fatalf("%d connections instead of %d", ptcp.NumConns(), parallelNumConns)
+	}
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	for i := 0; i < parallelNumMsgs; i++ {
+		err = ptcp.SendMsg(hdr, parallelMsg(i))
+		if err != nil {
+			t.Fatalf("unable to send message %d: %s", i, err)
+		}
+	}
+
+	<-done
+}
+
+func TestParallelTCPSendWhileReceiving(t *testing.T) {
+	serverCfg := ParallelTCPTransportCfg{
+		TCP: TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   parallelSendPort,
+			Accept:    true,
+		},
+		NumConns: parallelNumConns,
+	}
+	accepted := make(chan *ParallelTCPTransport, 1)
+	go func() {
+		server, err := serverCfg.Init()
+		if err != nil {
+			t.Errorf("unable to instantiate parallel TCP transport: %s", err)
+		}
+		accepted <- server
+	}()
+
+	cfg := ParallelTCPTransportCfg{
+		TCP: TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   parallelSendPort,
+		},
+		NumConns: parallelNumConns,
+	}
+	client, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate parallel TCP transport: %s", err)
+	}
+	defer client.Close()
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	server := <-accepted
+	if server == nil {
+		return
+	}
+	defer server.Close()
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	err = client.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+
+	// The server sends a message while the message it received is not
+	// consumed yet
+	time.Sleep(100 * time.Millisecond)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- server.SendMsg(TCPHeader{MsgType: DATAMSG}, []byte(msg2))
+	}()
+	select {
+	case err = <-sent:
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("send blocked by the delivery of a received message")
+	}
+
+	rx := <-server.RecvQueue
+	data, _ := server.ExtractPayload(rx)
+	if string(data) != msg1 {
+		t.Fatalf("received %q instead of %q", data, msg1)
+	}
+	rx = <-client.RecvQueue
+	data, _ = client.ExtractPayload(rx)
+	if string(data) != msg2 {
+		t.Fatalf("received %q instead of %q", data, msg2)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// defaultNumChannelNotifications is the number of new channels that
+	// can be notified before being consumed
+	defaultNumChannelNotifications = 1024
+)
+
+// acceptsMultipleConns checks whether the transport accepts connections from
+// more than one client
+func (cfg *TCPTransportCfg) acceptsMultipleConns() bool {
+	return cfg.MaxConns < 0 || cfg.MaxConns > 1
+}
+
+// maxMsgSize returns the maximum size of the messages received as fragments
+// or using the rendezvous protocol
+func (cfg *TCPTransportCfg) maxMsgSize() int64 {
+	if cfg.MaxMsgSize <= 0 {
+		return defaultMaxMsgSize
+	}
+	return cfg.MaxMsgSize
+}
+
+// maxPendingBytes returns the maximum size of the messages being received
+// as fragments, or using the rendezvous protocol, at a given time on a
+// connection
+func (cfg *TCPTransportCfg) maxPendingBytes() int64 {
+	if cfg.MaxPendingBytes <= 0 {
+		return cfg.maxMsgSize()
+	}
+	return cfg.MaxPendingBytes
+}
+
+// newPeerConn creates the object managing the connection of a client, which
+// shares the pools and the receive queue of the transport
+func (tpt *TCPTransport) newPeerConn() *TCPTransport {
+	c := &TCPTransport{
+		Cfg:       tpt.Cfg,
+		log:       tpt.log,
+		parent:    tpt,
+		RxPool:    tpt.RxPool,
+		TxPool:    tpt.TxPool,
+		RecvQueue: tpt.RecvQueue,
+		heapRX:    tpt.heapRX,
+	}
+	c.initConnState()
+	return c
+}
+
+// isFull checks whether the maximum number of clients is connected
+func (tpt *TCPTransport) isFull() bool {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	return tpt.Cfg.MaxConns > 0 && len(tpt.peers) >= tpt.Cfg.MaxConns
+}
+
+// acceptPeer establishes the connection of a new client
+func (tpt *TCPTransport) acceptPeer(conn net.Conn) error {
+	c := tpt.newPeerConn()
+	tpt.lock.Lock()
+	tpt.peers[c] = conn
+	tpt.lock.Unlock()
+	setIdleAcceptor(tpt.Cfg.Interface, tpt.port, !tpt.isFull())
+
+	err := c.acceptConn(conn)
+	if err != nil {
+		tpt.removePeer(c)
+		return err
+	}
+	tpt.log.Info("new client connected", PeerField(conn.RemoteAddr().String()))
+	tpt.connectedOnce.Do(func() {
+		close(tpt.connected)
+	})
+	return nil
+}
+
+// acceptConns accepts the connections of new clients until the listener is
+// closed. Once the maximum number of clients is reached, new clients are
+// redirected.
+func (tpt *TCPTransport) acceptConns(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			setIdleAcceptor(tpt.Cfg.Interface, tpt.port, false)
+			return fmt.Errorf("accept failed: %w", err)
+		}
+		addr := ""
+		if tpt.Cfg.SpreadConns || tpt.isFull() {
+			addr = tpt.redirectTarget(conn)
+		}
+		if addr != "" || tpt.isFull() {
+			go tpt.redirectConn(conn, addr)
+			continue
+		}
+		go func(conn net.Conn) {
+			peer := conn.RemoteAddr().String()
+			conn, err := tpt.secureConn(conn, true)
+			if err == nil {
+				err = tpt.acceptPeer(conn)
+			}
+			if err != nil {
+				tpt.log.Warn("connection rejected", PeerField(peer), ErrorField(err))
+				conn.Close()
+			}
+		}(conn)
+	}
+}
+
+// removePeer stops tracking the connection of a client
+func (tpt *TCPTransport) removePeer(c *TCPTransport) {
+	tpt.lock.Lock()
+	delete(tpt.peers, c)
+	listening := tpt.listener != nil
+	tpt.lock.Unlock()
+	if listening {
+		setIdleAcceptor(tpt.Cfg.Interface, tpt.port, !tpt.isFull())
+	}
+}
+
+// stop stops the send thread once the connection is closed; pending and
+// later sends then fail, including the messages waiting for a CTS
+func (tpt *TCPTransport) stop() {
+	tpt.closeOnce.Do(func() {
+		tpt.lock.Lock()
+		close(tpt.done)
+		pending := tpt.pendingRndv
+		tpt.pendingRndv = make(map[uint64]*rndvSend)
+		tpt.lock.Unlock()
+		for _, s := range pending {
+			s.complete(ErrPeerClosed)
+		}
+	})
+}
+
+// detach releases the connection once closed, including the connection of a
+// client
+func (tpt *TCPTransport) detach() {
+	tpt.stop()
+	if tpt.parent == nil {
+		return
+	}
+	tpt.parent.removePeer(tpt)
+	tpt.Conn.Close()
+	tpt.log.Info("client disconnected", PeerField(tpt.Conn.RemoteAddr().String()))
+}
+
+// hasRemote checks whether a remote endpoint is reachable over the connection
+func (tpt *TCPTransport) hasRemote(remoteEPid string) bool {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for c := range tpt.channels {
+		if c.remote == remoteEPid {
+			return true
+		}
+	}
+	return false
+}
+
+// connTo returns the connection to use to reach a remote endpoint: the
+// connection of the transport or the connection of one of its clients. If
+// the remote endpoint is not specified, the connection of the transport is
+// used, or the connection of the client if there is only one.
+func (tpt *TCPTransport) connTo(remoteEPid string) (*TCPTransport, error) {
+	if tpt.peers == nil || (tpt.Conn != nil && tpt.hasRemote(remoteEPid)) {
+		return tpt, nil
+	}
+
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for c := range tpt.peers {
+		if c.hasRemote(remoteEPid) {
+			return c, nil
+		}
+	}
+	if tpt.Conn != nil {
+		return tpt, nil
+	}
+	if remoteEPid == "" && len(tpt.peers) == 1 {
+		for c := range tpt.peers {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no connection to endpoint %s", remoteEPid)
+}
+
+// notifyChannel notifies a new channel opened by a remote endpoint over the
+// connection of a client
+func (tpt *TCPTransport) notifyChannel(localEPid string, remoteEPid string) {
+	select {
+	case tpt.newChannels <- Channel{Local: localEPid, Remote: remoteEPid}:
+	default:
+		tpt.log.Warn("too many pending notifications, channel not notified", EndpointField(remoteEPid))
+	}
+}
+
+// AcceptedChannels returns the queue where the channels opened by remote
+// endpoints over the connections of the clients are notified. It is nil if
+// the transport does not accept more than one client.
+func (tpt *TCPTransport) AcceptedChannels() <-chan Channel {
+	return tpt.newChannels
+}
+
+// ClosePeer closes the connection of the client hosting a remote endpoint
+func (tpt *TCPTransport) ClosePeer(remoteEPid string) error {
+	c, err := tpt.connTo(remoteEPid)
+	if err != nil {
+		return err
+	}
+	tpt.lock.Lock()
+	conn, ok := tpt.peers[c]
+	tpt.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("endpoint %s is not reachable over the connection of a client", remoteEPid)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTCPRedirects is the maximum number of redirections followed while
+	// connecting, to prevent redirection loops
+	maxTCPRedirects = 4
+)
+
+// idleAcceptors are the TCP transports of the process currently waiting for
+// a connection, i.e., the possible targets of a redirection, indexed by port
+var idleAcceptors = struct {
+	sync.Mutex
+	ifaces map[uint16]string
+}{
+	ifaces: make(map[uint16]string),
+}
+
+func setIdleAcceptor(iface string, port uint16, idle bool) {
+	idleAcceptors.Lock()
+	defer idleAcceptors.Unlock()
+	if idle {
+		idleAcceptors.ifaces[port] = iface
+	} else {
+		delete(idleAcceptors.ifaces, port)
+	}
+}
+
+// redirectError is the error returned by the connection handshake when the
+// remote transport redirects the connection to another address, or notifies
+// that it is busy if the address is not set
+type redirectError struct {
+	ip   string
+	port uint16
+}
+
+func (e *redirectError) Error() string {
+	if e.ip == "" {
+		return "remote transport is busy"
+	}
+	return fmt.Sprintf("connection redirected to %s", net.JoinHostPort(e.ip, strconv.Itoa(int(e.port))))
+}
+
+// redirectTarget returns the address, based on the local IP reached by the
+// client, of another transport of the port range waiting for a connection.
+// It is empty if there is none.
+func (tpt *TCPTransport) redirectTarget(conn net.Conn) string {
+	ip, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return ""
+	}
+
+	idleAcceptors.Lock()
+	defer idleAcceptors.Unlock()
+	target := uint16(0)
+	for port, iface := range idleAcceptors.ifaces {
+		if port == tpt.port || iface != tpt.Cfg.Interface || port < tpt.Cfg.PortLow || port > tpt.Cfg.PortHigh {
+			continue
+		}
+		if target == 0 || port < target {
+			target = port
+		}
+	}
+	if target == 0 {
+		return ""
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(target)))
+}
+
+// redirectConn answers the connection request received on a new connection
+// with a redirection to another address and closes the connection. An empty
+// address notifies the client that no transport is available.
+func (tpt *TCPTransport) redirectConn(conn net.Conn, addr string) {
+	peer := conn.RemoteAddr().String()
+	conn, err := tpt.secureConn(conn, true)
+	if err != nil {
+		tpt.log.Warn("connection rejected", PeerField(peer), ErrorField(err))
+		return
+	}
+	tpt.redirectSecuredConn(conn, addr)
+}
+
+// redirectSecuredConn redirects a connection like redirectConn once the TLS
+// handshake, if any, is performed
+func (tpt *TCPTransport) redirectSecuredConn(conn net.Conn, addr string) {
+	defer conn.Close()
+
+	// The connection does not share the wire header of the connection of
+	// the transport, which may already be negotiated
+	wire := newWireCodec()
+	reader := newFrameReader(conn, int(tpt.RxPool.ObjSize))
+	rx := tpt.RxPool.Get()
+	if rx == nil {
+		tpt.log.Error("unable to get RX buffer")
+		return
+	}
+	// A client that never sends its connection request must not hold the
+	// connection forever
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	_, err := tpt.recvMsg(reader, wire, rx)
+	conn.SetDeadline(time.Time{})
+	msgType := string(rx[msgTypeOffset : msgTypeOffset+msgTypeLen])
+	src := string(tpt.ExtractSrc(rx))
+	tpt.RxPool.Return(rx)
+	if err != nil || msgType != CONNREQ {
+		tpt.log.Error("invalid connection request", PeerField(conn.RemoteAddr().String()))
+		return
+	}
+
+	tx := tpt.TxPool.Get()
+	if tx == nil {
+		tpt.log.Error("unable to get TX buffer")
+		return
+	}
+	hdr := TCPHeader{
+		MsgType: CONNRED,
+		Dst:     src,
+	}
+	setHeader(tx, hdr)
+	setPayload(tx, []byte(addr))
+	err = wire.writeMsg(conn, tx)
+	tpt.TxPool.Return(tx)
+	if err != nil {
+		tpt.log.Error("unable to redirect connection", EndpointField(src), ErrorField(err))
+		return
+	}
+	tpt.log.Info("connection redirected", EndpointField(src), Field{Key: "addr", Value: addr})
+}
+
+// handleConnRedirect gets the address a connection is redirected to
+func handleConnRedirect(tcp *TCPTransport, rx []byte) error {
+	payload, err := tcp.ExtractPayload(rx)
+	if err != nil {
+		return fmt.Errorf("unable to extract payload from RX: %w", err)
+	}
+	if len(payload) == 0 {
+		return &redirectError{}
+	}
+	ip, portStr, err := net.SplitHostPort(string(payload))
+	if err != nil {
+		return fmt.Errorf("invalid redirection address %s: %w", string(payload), err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("failed to extract port from payload: %w", err)
+	}
+	return &redirectError{ip: ip, port: uint16(port)}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Resource describes a local network resource on which a concrete transport
+// can be instantiated
+type Resource struct {
+	// Name is the name of the network interface, e.g., 'eth0'
+	Name string
+
+	// Addr is the address of the network interface as reported by the
+	// system, e.g., '127.0.0.1/8'
+	Addr string
+
+	// Logger is the logger of the engine, to be used by the transport
+	Logger Logger
+}
+
+// ProbeFn checks whether a concrete transport can be instantiated for a given resource
+type ProbeFn func(res Resource) bool
+
+// FactoryFn instantiates a concrete transport for a given resource
+type FactoryFn func(res Resource) (Concrete, error)
+
+// Factory gathers everything a communication engine in 'auto' mode needs to
+// automatically instantiate a type of concrete transport
+type Factory struct {
+	// Priority ranks the different types of concrete transports; when
+	// more than one can be used, the one with the highest priority is preferred
+	Priority int
+
+	// Probe checks if the concrete transport can be used with a local
+	// resource. If not set, the transport is assumed usable with all resources
+	Probe ProbeFn
+
+	// New instantiates the concrete transport
+	New FactoryFn
+}
+
+var registry = struct {
+	sync.Mutex
+	factories map[string]Factory
+}{
+	factories: make(map[string]Factory),
+}
+
+// Register makes a type of concrete transport available to communication
+// engines in 'auto' mode. It is typically called from the init() function
+// of the package implementing the concrete transport.
+func Register(id string, factory Factory) error {
+	if id == "" || factory.New == nil {
+		return fmt.Errorf("invalid parameter(s); unable to register %s transport", id)
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.factories[id]; ok {
+		return fmt.Errorf("%s transport already registered", id)
+	}
+	registry.factories[id] = factory
+
+	return nil
+}
+
+// Unregister removes a type of concrete transport from the registry
+func Unregister(id string) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.factories, id)
+}
+
+// GetFactory returns the factory registered for a given type of concrete transport
+func GetFactory(id string) (Factory, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	factory, ok := registry.factories[id]
+	return factory, ok
+}
+
+// RegisteredIDs returns the identifiers of all the registered types of
+// concrete transports, by decreasing priority
+func RegisteredIDs() []string {
+	registry.Lock()
+	defer registry.Unlock()
+
+	var ids []string
+	for id := range registry.factories {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		pi := registry.factories[ids[i]].Priority
+		pj := registry.factories[ids[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
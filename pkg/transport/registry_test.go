@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"testing"
+)
+
+func newDummyTransport(res Resource) (Concrete, error) {
+	cfg := TCPTransportCfg{
+		Interface: res.Addr,
+	}
+	return cfg.Init()
+}
+
+func TestRegistry(t *testing.T) {
+	tests := []struct {
+		id       string
+		priority int
+	}{
+		{
+			id:       "test:low",
+			priority: 1,
+		},
+		{
+			id:       "test:high",
+			priority: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		factory := Factory{
+			Priority: tt.priority,
+			New:      newDummyTransport,
+		}
+		err := Register(tt.id, factory)
+		if err != nil {
+			t.Fatalf("unable to register %s: %s", tt.id, err)
+		}
+		defer Unregister(tt.id)
+	}
+
+	err := Register(tests[0].id, Factory{New: newDummyTransport})
+	if err == nil {
+		t.Fatalf("registering %s twice succeeded", tests[0].id)
+	}
+
+	err = Register("test:invalid", Factory{})
+	if err == nil {
+		t.Fatalf("registering a transport without factory function succeeded")
+	}
+
+	var ids []string
+	for _, id := range RegisteredIDs() {
+		if id == tests[0].id || id == tests[1].id {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) != 2 || ids[0] != "test:high" || ids[1] != "test:low" {
+		t.Fatalf("transports are not ranked by priority: %v", ids)
+	}
+
+	factory, ok := GetFactory("test:high")
+	if !ok {
+		t.Fatalf("unable to find factory for test:high")
+	}
+	tpt, err := factory.New(Resource{Addr: "127.0.0.1"})
+	if err != nil || tpt == nil {
+		t.Fatalf("unable to instantiate transport: %s", err)
+	}
+}
@@ -0,0 +1,368 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+const (
+	defaultEagerThreshold = 64 * 1024
+
+	/* Payload of the rendezvous control messages */
+	rndvIDOffset  = 0
+	rndvLenOffset = 8
+	rndvHdrLen    = 16
+	// rndvMsgTypeOffset is the offset of the identifier of the type of the
+	// message (see wireMsgTypes) in RTS messages, omitted for a DATAMSG
+	rndvMsgTypeOffset = 16
+	// rndvStatusOffset is the offset of the status of CTS messages, omitted
+	// when the receiver is ready
+	rndvStatusOffset = 16
+
+	// rndvRejected is the status of a CTS rejecting a message too large for the receiver
+	rndvRejected = 1
+	// rndvNoBuffer is the status of a CTS rejecting a message because the
+	// receiver already posted too many buffers
+	rndvNoBuffer = 2
+)
+
+// rndvSend is a message waiting for the receiver to be ready before its data
+// is sent using the rendezvous protocol
+type rndvSend struct {
+	id      uint64
+	hdr     TCPHeader
+	payload []byte
+	done    chan error
+	// notify, if set, is notified once the data is sent instead of done
+	notify SendCompletionFunc
+	// err is the error reported by the receiver instead of being ready, if any
+	err error
+}
+
+// complete notifies that the data of a message is sent
+func (s *rndvSend) complete(err error) {
+	if s.notify == nil {
+		s.done <- err
+		return
+	}
+	if err != nil {
+		s.notify(0, err)
+		return
+	}
+	s.notify(len(s.payload), nil)
+}
+
+func rndvPayload(id uint64, size uint64) []byte {
+	payload := make([]byte, rndvHdrLen)
+	binary.LittleEndian.PutUint64(payload[rndvIDOffset:], id)
+	binary.LittleEndian.PutUint64(payload[rndvLenOffset:], size)
+	return payload
+}
+
+func getRndvPayload(tcp *TCPTransport, rx []byte) (uint64, uint64, error) {
+	payload, err := tcp.ExtractPayload(rx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(payload) < rndvHdrLen {
+		return 0, 0, fmt.Errorf("invalid rendezvous message")
+	}
+	id := binary.LittleEndian.Uint64(payload[rndvIDOffset:])
+	size := binary.LittleEndian.Uint64(payload[rndvLenOffset:])
+	return id, size, nil
+}
+
+// useRendezvous checks whether a payload of a given size must be sent using
+// the rendezvous protocol. Messages that fit in a single TX buffer are always
+// sent eagerly.
+func (tpt *TCPTransport) useRendezvous(size int) bool {
+	if payloadOffset+size <= int(tpt.TxPool.ObjSize) {
+		return false
+	}
+	threshold := tpt.Cfg.EagerThreshold
+	if threshold == 0 {
+		threshold = defaultEagerThreshold
+	}
+	return threshold > 0 && int64(size) > threshold
+}
+
+// isOrderedMsg checks whether a message is delivered in order with the data
+// messages sent using the rendezvous protocol
+func isOrderedMsg(msgType string) bool {
+	return isDataMsg(msgType) || msgType == FRAGMSG || msgType == RTSMSG
+}
+
+// deferSend queues a TX behind the rendezvous message in flight, if any, so
+// that the messages are delivered in the order they are sent. Only one
+// rendezvous message is in flight at a time: its RTS is the last TX sent
+// without being deferred.
+func (tpt *TCPTransport) deferSend(msgType string, desc txDesc) bool {
+	if !isOrderedMsg(msgType) {
+		return false
+	}
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	if tpt.rndvInFlight {
+		tpt.deferredTx = append(tpt.deferredTx, desc)
+		return true
+	}
+	tpt.rndvInFlight = msgType == RTSMSG
+	return false
+}
+
+// releaseDeferred is invoked by the send thread once the data of the
+// rendezvous message in flight is sent and returns the TXs that can now be
+// sent, up to the RTS of the next rendezvous message
+func (tpt *TCPTransport) releaseDeferred() []txDesc {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for i, desc := range tpt.deferredTx {
+		if string(desc.tx[msgTypeOffset:msgTypeOffset+msgTypeLen]) == RTSMSG {
+			released := tpt.deferredTx[:i+1]
+			tpt.deferredTx = tpt.deferredTx[i+1:]
+			return released
+		}
+	}
+	released := tpt.deferredTx
+	tpt.deferredTx = nil
+	tpt.rndvInFlight = false
+	return released
+}
+
+// dropDeferred returns the TXs that will never be sent once the send thread
+// terminates
+func (tpt *TCPTransport) dropDeferred() {
+	tpt.lock.Lock()
+	dropped := tpt.deferredTx
+	tpt.deferredTx = nil
+	tpt.lock.Unlock()
+	for _, desc := range dropped {
+		tpt.TxPool.Return(desc.tx)
+		if desc.done != nil {
+			desc.done(0, ErrPeerClosed)
+		}
+	}
+}
+
+// sendRendezvous sends a data message using the rendezvous protocol: a RTS is
+// sent to the receiver, which answers with a CTS once a destination buffer
+// is posted; the data is then directly written to the connection by the send
+// thread, without being copied to TX buffers. The function returns once the
+// data is sent, unless the completion is notified to done or the context is
+// done first. The messages sent
+// after the RTS wait for the data to be sent so that the order is preserved.
+func (tpt *TCPTransport) sendRendezvous(ctx context.Context, hdr TCPHeader, payload []byte, done SendCompletionFunc) error {
+	s := &rndvSend{
+		id:      atomic.AddUint64(&tpt.rndvSeq, 1),
+		hdr:     hdr,
+		payload: payload,
+		done:    make(chan error, 1),
+		notify:  done,
+	}
+	// The message is failed by stop if the connection is closed before the CTS
+	tpt.lock.Lock()
+	select {
+	case <-tpt.done:
+		tpt.lock.Unlock()
+		return ErrPeerClosed
+	default:
+	}
+	tpt.pendingRndv[s.id] = s
+	tpt.lock.Unlock()
+
+	rts := TCPHeader{
+		MsgType: RTSMSG,
+		Src:     hdr.Src,
+		Dst:     hdr.Dst,
+	}
+	rtsPayload := rndvPayload(s.id, uint64(len(payload)))
+	if hdr.MsgType != DATAMSG {
+		msgType, _ := wireMsgType(hdr.MsgType)
+		rtsPayload = append(rtsPayload, msgType)
+	}
+	err := tpt.SendMsg(rts, rtsPayload)
+	if err != nil {
+		tpt.lock.Lock()
+		delete(tpt.pendingRndv, s.id)
+		tpt.lock.Unlock()
+		return fmt.Errorf("unable to send RTS: %w", err)
+	}
+
+	if done != nil {
+		return nil
+	}
+	select {
+	case err = <-s.done:
+		return err
+	case <-tpt.done:
+		return ErrPeerClosed
+	case <-ctx.Done():
+		// The message is still sent once the remote side is ready
+		return ctx.Err()
+	}
+}
+
+// handleRTS posts a buffer for an incoming message and notifies the sender
+// that it can send the data
+func handleRTS(tcp *TCPTransport, rx []byte) error {
+	id, size, err := getRndvPayload(tcp, rx)
+	if err != nil {
+		return err
+	}
+	msgType := DATAMSG
+	payload, _ := tcp.ExtractPayload(rx)
+	if len(payload) > rndvMsgTypeOffset {
+		msgType = dataMsgType(payload[rndvMsgTypeOffset])
+	}
+
+	src := string(tcp.ExtractSrc(rx))
+	dst := tcp.ExtractDest(rx)
+	cts := TCPHeader{
+		MsgType: CTSMSG,
+		Src:     dst,
+		Dst:     src,
+	}
+	ctsPayload := rndvPayload(id, size)
+
+	// The buffer is not allocated on behalf of the sender above the maximum
+	// size; the sender is notified instead
+	if size > uint64(tcp.Cfg.maxMsgSize()) {
+		ctsPayload = append(ctsPayload, rndvRejected)
+		go tcp.sendCTS(cts, ctsPayload)
+		return fmt.Errorf("message %d of %d bytes rejected: %w", id, size, ErrMessageTooLarge)
+	}
+	if tcp.postedBytes+size > uint64(tcp.Cfg.maxPendingBytes()) {
+		ctsPayload = append(ctsPayload, rndvNoBuffer)
+		go tcp.sendCTS(cts, ctsPayload)
+		return fmt.Errorf("message %d of %d bytes rejected, %d bytes already posted: %w", id, size, tcp.postedBytes, ErrPoolExhausted)
+	}
+
+	// The destination buffer has the same layout than a RX buffer so that
+	// the payload can be extracted the usual way
+	buf := make([]byte, payloadOffset+int(size))
+	copy(buf, rx[:payloadOffset])
+	copy(buf[msgTypeOffset:msgTypeOffset+msgTypeLen], msgType)
+	n := binary.PutUvarint(buf[payloadSizeOffset:payloadOffset], size)
+	buf[sizeOfSizeOffset] = uint8(n)
+
+	tcp.postedRndv[fragKey{peers: fragPeers(src, dst), seq: id}] = buf
+	tcp.postedBytes += size
+
+	// The CTS is sent asynchronously so the receive thread never waits on
+	// the send thread, which may be busy sending a large message
+	go tcp.sendCTS(cts, ctsPayload)
+
+	return nil
+}
+
+func (tcp *TCPTransport) sendCTS(cts TCPHeader, payload []byte) {
+	err := tcp.SendMsg(cts, payload)
+	if err != nil {
+		tcp.log.Error("unable to send CTS", EndpointField(cts.Dst), ErrorField(err))
+	}
+}
+
+// handleCTS hands a message waiting for a CTS over to the send thread
+func handleCTS(tcp *TCPTransport, rx []byte) error {
+	id, size, err := getRndvPayload(tcp, rx)
+	if err != nil {
+		return err
+	}
+
+	tcp.lock.Lock()
+	s, ok := tcp.pendingRndv[id]
+	delete(tcp.pendingRndv, id)
+	tcp.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("CTS for unknown message %d", id)
+	}
+	// The send thread still handles rejected messages to send the messages
+	// queued behind them
+	payload, _ := tcp.ExtractPayload(rx)
+	if len(payload) > rndvStatusOffset {
+		switch payload[rndvStatusOffset] {
+		case rndvRejected:
+			s.err = fmt.Errorf("message of %d bytes rejected by the receiver: %w", size, ErrMessageTooLarge)
+		case rndvNoBuffer:
+			s.err = fmt.Errorf("message of %d bytes rejected by the receiver, out of buffers: %w", size, ErrPoolExhausted)
+		}
+	}
+
+	go func() {
+		select {
+		case tcp.rndvQueue <- s:
+		case <-tcp.done:
+			s.complete(ErrPeerClosed)
+		}
+	}()
+
+	return nil
+}
+
+// sendRndvData is invoked by the send thread to send the data of a message
+// for which a CTS has been received. The data immediately follows the frame
+// of a RNDVMSG header on the connection.
+func sendRndvData(tcp *TCPTransport, s *rndvSend) error {
+	tx := tcp.TxPool.Get()
+	if tx == nil {
+		return fmt.Errorf("unable to get TX buffer: %w", ErrPoolExhausted)
+	}
+	defer tcp.TxPool.Return(tx)
+
+	hdr := s.hdr
+	hdr.MsgType = RNDVMSG
+	setHeader(tx, hdr)
+	setPayload(tx, rndvPayload(s.id, uint64(len(s.payload))))
+	err := tcp.wire.writeMsg(tcp.Conn, tx, s.payload)
+	if err != nil {
+		return fmt.Errorf("unable to send rendezvous data: %w", err)
+	}
+	return nil
+}
+
+// handleRndvData reads the data of a rendezvous message directly from the
+// connection into the buffer posted when the RTS was received and makes the
+// message available in the receive queue
+func handleRndvData(tcp *TCPTransport, rx []byte) error {
+	id, size, err := getRndvPayload(tcp, rx)
+	if err != nil {
+		return err
+	}
+
+	key := fragKey{
+		peers: fragPeers(string(tcp.ExtractSrc(rx)), tcp.ExtractDest(rx)),
+		seq:   id,
+	}
+	buf, ok := tcp.postedRndv[key]
+	if ok {
+		delete(tcp.postedRndv, key)
+		tcp.postedBytes -= uint64(len(buf) - payloadOffset)
+	}
+	if !ok || uint64(len(buf)) != payloadOffset+size {
+		// Drop the data to keep the stream consistent
+		_, err = io.CopyN(ioutil.Discard, tcp.reader, int64(size))
+		if err != nil {
+			return fmt.Errorf("unable to drop rendezvous data: %w", err)
+		}
+		return fmt.Errorf("no buffer posted for message %d", id)
+	}
+
+	_, err = io.ReadFull(tcp.reader, buf[payloadOffset:])
+	if err != nil {
+		return fmt.Errorf("unable to receive rendezvous data: %w", err)
+	}
+	tcp.heapRX.add(buf)
+	tcp.queueRX(buf)
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"os"
+	"syscall"
+)
+
+func mapSegment(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func unmapSegment(mem []byte) error {
+	return syscall.Munmap(mem)
+}
+
+// lockSegment locks the file of a segment on behalf of the transport owning
+// it, the lock being released when the file is closed, including when the
+// process terminates. It fails if the segment is owned by another transport.
+func lockSegment(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"fmt"
+	"os"
+)
+
+func mapSegment(f *os.File, size int) ([]byte, error) {
+	return nil, fmt.Errorf("shared memory segments are not supported on this platform")
+}
+
+func unmapSegment(mem []byte) error {
+	return nil
+}
+
+func lockSegment(f *os.File) error {
+	return fmt.Errorf("shared memory segments are not supported on this platform")
+}
@@ -7,7 +7,869 @@
 
 package transport
 
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gvallee/comm/internal/pkg/util"
+	"github.com/gvallee/memory_pool/pkg/pool"
+)
+
 const (
-	// SMTransport identifies the TCP transport
+	// SMTransportID identifies the shared memory transport
 	SMTransportID = "SM"
+
+	defaultSMDir      = "/dev/shm"
+	defaultSMRingSize = 4 * 1024 * 1024
+	defaultSMMaxRetry = 5
+	smPollInterval    = 50 * time.Microsecond
+
+	/* Layout of the shared memory segment: a header followed by two rings */
+	smMagic          = 0x636f6d6d2d736d00 // "comm-sm"
+	smMagicOffset    = 0
+	smStateOffset    = 8
+	smRingSizeOffset = 16
+	smHdrLen         = 64
+
+	/* Layout of a ring: a header with the producer and consumer positions followed by the data */
+	smRingHeadOffset = 0
+	smRingTailOffset = 8
+	smRingHdrLen     = 64
+	smRecordHdrLen   = 8
+
+	/* States of a shared memory segment */
+	smStateListening = 1
+	smStateConnected = 2
+	smStateClosed    = 3
+
+	/* Predefined statuses of the shared memory transport */
+	smTransportStatusAccepting = "transport:sm:status:accepting"
+)
+
+var (
+	// errSMRingCorrupted is returned when a ring holds a record larger
+	// than the data written to it
+	errSMRingCorrupted = errors.New("shared memory ring corrupted")
+
+	// errSMAcceptAborted is returned when the transport stops waiting for
+	// a peer to connect to its segment
+	errSMAcceptAborted = errors.New("accept aborted")
 )
+
+// SMTransportCfg is the structure capturing the configuration of a
+// shared memory transport
+type SMTransportCfg struct {
+	// Name identifies the shared memory segment used to connect the two sides
+	// of the transport; both sides must use the same name
+	Name string
+
+	// Dir is the directory where the shared memory segment is created,
+	// '/dev/shm' by default
+	Dir string
+
+	// NameRange is the number of names that can be used for the segment,
+	// similarly to a range of ports with TCP: the segment is created with
+	// the first name not owned by another transport among Name, Name.1, ...,
+	// Name.<NameRange-1>, and connecting tries all of them
+	NameRange int
+
+	// Accept specifies whether the transport accepts incoming connections
+	Accept bool
+
+	// DoNotBlockOnAccept specifies if the accept call should be performed
+	// in a separate routine or not, i.e., to avoid the caller to block. If
+	// 'Accept' is not set to true, this will be ignored
+	DoNotBlockOnAccept bool
+
+	// MaxRetry is the maximum of retries when trying to connect
+	MaxRetry int
+
+	// MTU is the requested MTU size
+	MTU int64
+
+	// RingSize is the size in bytes of each of the two ring buffers (one per
+	// direction) of the shared memory segment
+	RingSize uint64
+
+	// Logger is the logger of the transport, nothing is logged if not set
+	Logger Logger
+}
+
+// smRing is a single producer/single consumer ring buffer stored in a
+// shared memory segment
+type smRing struct {
+	hdr  []byte
+	data []byte
+}
+
+// SMTransport is the structure representing a given instantiation of a shared memory transport
+type SMTransport struct {
+	// Cfg is the configuration of the shared memory transport
+	Cfg *SMTransportCfg
+
+	// Status is the current status of the transport
+	Status string
+
+	// log logs the messages of the transport through the logger of the configuration
+	log ComponentLogger
+
+	receiverEPs []string
+	remoteEPs   []string
+	path        string
+	segment     []byte
+	state       *uint64
+	txRing      smRing
+	rxRing      smRing
+	done        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+	// owner is the file of the segment created by the transport, locked as
+	// long as the transport is alive so that stale segments are detected
+	owner *os.File
+	// abort is closed to stop waiting for a peer to connect to the segment
+	// of the transport, e.g., to connect to the segment of another transport
+	abort     chan struct{}
+	abortOnce sync.Once
+	// acceptDone is closed once Accept returns
+	acceptDone chan struct{}
+
+	// RX pool
+	RxPool pool.Pool
+	// TX pool
+	TxPool pool.Pool
+	// sendQueue
+	sendQueue chan []byte
+	// RecvQueue is the receive queue, accessed by the endpoint to generate RX events
+	RecvQueue chan []byte
+}
+
+func segmentLen(ringSize uint64) int {
+	return smHdrLen + 2*(smRingHdrLen+int(ringSize))
+}
+
+// paths returns the paths of the segments that can be used to establish connections
+func (cfg *SMTransportCfg) paths() []string {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = defaultSMDir
+	}
+	path := filepath.Join(dir, cfg.Name)
+	paths := []string{path}
+	for i := 1; i < cfg.NameRange; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", path, i))
+	}
+	return paths
+}
+
+func uint64At(mem []byte, offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&mem[offset]))
+}
+
+// setRings maps the two rings of the segment. The first ring carries data from
+// the connecting side to the accepting side, the second one the reverse.
+func (tpt *SMTransport) setRings(ringSize uint64, accepting bool) {
+	rings := make([]smRing, 2)
+	offset := smHdrLen
+	for i := range rings {
+		rings[i].hdr = tpt.segment[offset : offset+smRingHdrLen]
+		offset += smRingHdrLen
+		rings[i].data = tpt.segment[offset : offset+int(ringSize)]
+		offset += int(ringSize)
+	}
+	if accepting {
+		tpt.rxRing, tpt.txRing = rings[0], rings[1]
+	} else {
+		tpt.txRing, tpt.rxRing = rings[0], rings[1]
+	}
+	tpt.state = uint64At(tpt.segment, smStateOffset)
+}
+
+func (r *smRing) copyIn(pos uint64, src []byte) {
+	size := uint64(len(r.data))
+	start := pos % size
+	n := copy(r.data[start:], src)
+	copy(r.data, src[n:])
+}
+
+func (r *smRing) copyOut(pos uint64, dst []byte) {
+	size := uint64(len(r.data))
+	start := pos % size
+	n := copy(dst, r.data[start:])
+	copy(dst[n:], r.data)
+}
+
+func (tpt *SMTransport) isClosed() bool {
+	select {
+	case <-tpt.done:
+		return true
+	default:
+	}
+	return atomic.LoadUint64(tpt.state) == smStateClosed
+}
+
+// put writes a message in the ring, waiting for enough space to be available
+func (tpt *SMTransport) put(msg []byte) error {
+	r := &tpt.txRing
+	recordLen := uint64(smRecordHdrLen + len(msg))
+	if recordLen > uint64(len(r.data)) {
+		return fmt.Errorf("message of %d bytes does not fit in the ring: %w", len(msg), ErrMessageTooLarge)
+	}
+	head := uint64At(r.hdr, smRingHeadOffset)
+	tail := atomic.LoadUint64(uint64At(r.hdr, smRingTailOffset))
+	for uint64(len(r.data))-(tail-atomic.LoadUint64(head)) < recordLen {
+		if tpt.isClosed() {
+			return fmt.Errorf("shared memory transport closed")
+		}
+		time.Sleep(smPollInterval)
+	}
+
+	var recordHdr [smRecordHdrLen]byte
+	binary.LittleEndian.PutUint64(recordHdr[:], uint64(len(msg)))
+	r.copyIn(tail, recordHdr[:])
+	r.copyIn(tail+smRecordHdrLen, msg)
+	atomic.StoreUint64(uint64At(r.hdr, smRingTailOffset), tail+recordLen)
+
+	return nil
+}
+
+// get reads the next message from the ring into a RX buffer, waiting for a
+// message to be available unless abort is closed
+func (tpt *SMTransport) get(rx []byte, abort chan struct{}) (int, error) {
+	r := &tpt.rxRing
+	tail := uint64At(r.hdr, smRingTailOffset)
+	head := atomic.LoadUint64(uint64At(r.hdr, smRingHeadOffset))
+	for atomic.LoadUint64(tail) == head {
+		if tpt.isClosed() {
+			return 0, nil
+		}
+		select {
+		case <-abort:
+			return 0, errSMAcceptAborted
+		default:
+		}
+		time.Sleep(smPollInterval)
+	}
+
+	var recordHdr [smRecordHdrLen]byte
+	r.copyOut(head, recordHdr[:])
+	msgLen := binary.LittleEndian.Uint64(recordHdr[:])
+	available := atomic.LoadUint64(tail) - head
+	if available < smRecordHdrLen || msgLen > available-smRecordHdrLen {
+		// The record is not consistent with the data written by the peer,
+		// the ring cannot be read anymore
+		return 0, errSMRingCorrupted
+	}
+	if msgLen > uint64(len(rx)) {
+		// The record is skipped so that the next messages can be received
+		atomic.StoreUint64(uint64At(r.hdr, smRingHeadOffset), head+smRecordHdrLen+msgLen)
+		return 0, fmt.Errorf("message of %d bytes larger than RX buffer: %w", msgLen, ErrMessageTooLarge)
+	}
+	r.copyOut(head+smRecordHdrLen, rx[:msgLen])
+	atomic.StoreUint64(uint64At(r.hdr, smRingHeadOffset), head+smRecordHdrLen+msgLen)
+
+	return int(msgLen), nil
+}
+
+// msgLen returns the number of bytes of a TX/RX buffer actually used by the message it stores
+func msgLen(buf []byte) (int, error) {
+	sizeOfSize := int(buf[sizeOfSizeOffset])
+	if sizeOfSize > payloadSizeLen {
+		return 0, fmt.Errorf("invalid size of the payload size: %d", sizeOfSize)
+	}
+	payloadSize, n := binary.Uvarint(buf[payloadSizeOffset : payloadSizeOffset+sizeOfSize])
+	if n != sizeOfSize {
+		return 0, fmt.Errorf("failed to read the payload size from msg")
+	}
+	return payloadOffset + int(payloadSize), nil
+}
+
+func (tpt *SMTransport) putMsg(hdr TCPHeader, payload []byte) error {
+	tx := tpt.TxPool.Get()
+	if tx == nil {
+		return fmt.Errorf("unable to get TX buffer: %w", ErrPoolExhausted)
+	}
+	defer tpt.TxPool.Return(tx)
+
+	setHeader(tx, hdr)
+	setPayload(tx, payload)
+	return tpt.put(tx[:payloadOffset+len(payload)])
+}
+
+// getMsg waits for a message of a specific type, which is used during the
+// connection handshake, unless abort is closed
+func (tpt *SMTransport) getMsg(msgType string, abort chan struct{}) ([]byte, error) {
+	rx := tpt.RxPool.Get()
+	if rx == nil {
+		return nil, fmt.Errorf("unable to get RX buffer: %w", ErrPoolExhausted)
+	}
+	n, err := tpt.get(rx, abort)
+	if n == 0 && err == nil {
+		err = fmt.Errorf("shared memory transport closed")
+	}
+	if err != nil {
+		tpt.RxPool.Return(rx)
+		return nil, err
+	}
+	t := tpt.GetMsgTypeFromRX(rx)
+	if t != msgType {
+		tpt.RxPool.Return(rx)
+		return nil, fmt.Errorf("receive a %s message instead of %s", t, msgType)
+	}
+	return rx, nil
+}
+
+func smRecvThread(sm *SMTransport) {
+	defer sm.wg.Done()
+	for {
+		rx := sm.RxPool.Get()
+		if rx == nil {
+			sm.log.Error("unable to get RX buffer")
+			return
+		}
+
+		n, err := sm.get(rx, nil)
+		if n == 0 && err == nil {
+			sm.log.Debug("transport closed, receive thread terminating")
+			sm.RxPool.Return(rx)
+			return
+		}
+		if errors.Is(err, errSMRingCorrupted) {
+			// The transport is failed, the peer is notified
+			sm.log.Error("unable to receive data, receive thread terminating", ErrorField(err))
+			atomic.StoreUint64(sm.state, smStateClosed)
+			sm.RxPool.Return(rx)
+			return
+		}
+		if err != nil {
+			sm.log.Error("unable to receive data", ErrorField(err))
+			sm.RxPool.Return(rx)
+			continue
+		}
+
+		msgType := sm.GetMsgTypeFromRX(rx)
+		switch msgType {
+		case DATAMSG, TAGMSG:
+			select {
+			case sm.RecvQueue <- rx:
+			case <-sm.done:
+				sm.RxPool.Return(rx)
+				return
+			}
+		case TERMMSG:
+			// A shared memory segment connects a single pair of endpoints
+			sm.RxPool.Return(rx)
+			return
+		default:
+			sm.log.Error("unsupported message", MsgTypeField(msgType))
+			sm.RxPool.Return(rx)
+		}
+	}
+}
+
+func (tpt *SMTransport) sendTX(tx []byte) {
+	n, err := msgLen(tx)
+	if err == nil {
+		err = tpt.put(tx[:n])
+	}
+	if err != nil {
+		tpt.log.Error("unable to send TX", ErrorField(err))
+	}
+	// even if put() failed, we return the TX
+	err = tpt.TxPool.Return(tx)
+	if err != nil {
+		tpt.log.Error("unable to return TX buffer", ErrorField(err))
+	}
+}
+
+func smSendThread(sm *SMTransport) {
+	defer sm.wg.Done()
+	for {
+		select {
+		case tx := <-sm.sendQueue:
+			sm.sendTX(tx)
+		case <-sm.done:
+			// Messages queued before the transport was closed are still
+			// written to the ring, the peer reads them before noticing
+			// that the segment is closed
+			for {
+				select {
+				case tx := <-sm.sendQueue:
+					sm.sendTX(tx)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (tpt *SMTransport) startThreads() {
+	tpt.wg.Add(2)
+	go smSendThread(tpt)
+	go smRecvThread(tpt)
+}
+
+func doSMAccept(serverID string, sm *SMTransport) error {
+	err := sm.Accept(serverID)
+	if errors.Is(err, errSMAcceptAborted) {
+		sm.log.Debug("no longer accepting connections")
+		return err
+	}
+	if err != nil {
+		sm.log.Error("unable to accept incoming connections", ErrorField(err))
+		return err
+	}
+	return nil
+}
+
+// Init creates a new shared memory transport based on a configuration
+func (cfg *SMTransportCfg) Init() (*SMTransport, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("undefined segment name")
+	}
+
+	var sm SMTransport
+	sm.Cfg = cfg
+	sm.log = NewComponentLogger(cfg.Logger, "sm")
+	if sm.Cfg.MaxRetry == 0 {
+		sm.Cfg.MaxRetry = defaultSMMaxRetry
+	}
+	if sm.Cfg.RingSize == 0 {
+		sm.Cfg.RingSize = defaultSMRingSize
+	}
+	sm.path = cfg.paths()[0]
+	sm.done = make(chan struct{})
+	if cfg.Accept {
+		sm.abort = make(chan struct{})
+		sm.acceptDone = make(chan struct{})
+	}
+
+	sm.TxPool = pool.Pool{
+		ObjSize:    defaultMTU,
+		NObj:       defaultNumTX,
+		GrowFactor: 0,
+		Erase:      true,
+	}
+
+	sm.RxPool = pool.Pool{
+		ObjSize:    defaultMTU,
+		NObj:       defaultNumRX,
+		GrowFactor: 0,
+		Erase:      true,
+	}
+	if cfg.MTU != 0 {
+		sm.TxPool.ObjSize = cfg.MTU
+		sm.RxPool.ObjSize = cfg.MTU
+	}
+
+	sm.TxPool.New()
+	sm.RxPool.New()
+
+	sm.sendQueue = make(chan []byte)
+	sm.RecvQueue = make(chan []byte)
+
+	if cfg.Accept {
+		serverID := util.GenerateID()
+		sm.log.Info("waiting for connection", Field{Key: "addr", Value: sm.path})
+		if !cfg.DoNotBlockOnAccept {
+			err := sm.Accept(serverID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to accept incoming connections: %w", err)
+			}
+		} else {
+			go doSMAccept(serverID, &sm)
+		}
+	}
+
+	return &sm, nil
+}
+
+// IsAcceptingConns checks the status of the transport and if incoming connections can be accepted
+func (tpt *SMTransport) IsAcceptingConns() bool {
+	if tpt == nil {
+		return false
+	}
+
+	return tpt.Status == smTransportStatusAccepting
+}
+
+// createSegment creates the segment of the transport using the first path
+// not owned by another transport and locks it. Segments left behind by
+// transports that are not alive anymore are reused.
+func (tpt *SMTransport) createSegment() (*os.File, error) {
+	var lastErr error
+	for _, path := range tpt.Cfg.paths() {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = lockSegment(f)
+		if err != nil {
+			f.Close()
+			lastErr = fmt.Errorf("%s is in use", path)
+			continue
+		}
+		err = f.Truncate(0)
+		if err == nil {
+			err = f.Truncate(int64(segmentLen(tpt.Cfg.RingSize)))
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("unable to size shared memory segment: %w", err)
+		}
+		tpt.path = path
+		return f, nil
+	}
+	return nil, fmt.Errorf("unable to create shared memory segment: %w", lastErr)
+}
+
+// releaseSegment releases the segment of the transport when no peer connected
+// to it; a peer connecting at the same time is notified
+func (tpt *SMTransport) releaseSegment() {
+	if tpt.segment != nil {
+		atomic.StoreUint64(tpt.state, smStateClosed)
+		unmapSegment(tpt.segment)
+		tpt.segment = nil
+		tpt.state = nil
+		tpt.txRing = smRing{}
+		tpt.rxRing = smRing{}
+	}
+	os.Remove(tpt.path)
+	tpt.owner.Close()
+	tpt.owner = nil
+}
+
+// stopAccepting stops waiting for a peer to connect to the segment of the
+// transport and checks whether a peer connected in the meantime
+func (tpt *SMTransport) stopAccepting() bool {
+	if tpt.acceptDone == nil {
+		return false
+	}
+	tpt.abortOnce.Do(func() {
+		close(tpt.abort)
+	})
+	<-tpt.acceptDone
+	return len(tpt.remoteEPs) > 0
+}
+
+// Accept creates the shared memory segment and waits for a peer to connect to it
+func (tpt *SMTransport) Accept(epID string) error {
+	if tpt == nil || tpt.Cfg == nil {
+		return fmt.Errorf("corrupted transport object")
+	}
+
+	if !tpt.Cfg.Accept {
+		return fmt.Errorf("attempting to accept connections on a transport not setup for it")
+	}
+	defer close(tpt.acceptDone)
+	tpt.Status = smTransportStatusAccepting
+	tpt.receiverEPs = append(tpt.receiverEPs, epID)
+
+	f, err := tpt.createSegment()
+	if err != nil {
+		return err
+	}
+	tpt.owner = f
+	tpt.segment, err = mapSegment(f, segmentLen(tpt.Cfg.RingSize))
+	if err != nil {
+		tpt.releaseSegment()
+		return fmt.Errorf("unable to map shared memory segment: %w", err)
+	}
+	tpt.setRings(tpt.Cfg.RingSize, true)
+	binary.LittleEndian.PutUint64(tpt.segment[smMagicOffset:], smMagic)
+	binary.LittleEndian.PutUint64(tpt.segment[smRingSizeOffset:], tpt.Cfg.RingSize)
+	// The state is set last, it is what the connecting side is waiting for
+	atomic.StoreUint64(tpt.state, smStateListening)
+	tpt.log.Info("listening", Field{Key: "addr", Value: tpt.path})
+
+	// Wait for the connection request
+	rx, err := tpt.getMsg(CONNREQ, tpt.abort)
+	if err != nil {
+		tpt.releaseSegment()
+		return fmt.Errorf("connection handshake failed: %w", err)
+	}
+	remoteEPid := string(tpt.ExtractSrc(rx))
+	tpt.RxPool.Return(rx)
+
+	hdr := TCPHeader{
+		MsgType: CONNACK,
+		Src:     epID,
+		Dst:     remoteEPid,
+	}
+	err = tpt.putMsg(hdr, nil)
+	if err != nil {
+		tpt.releaseSegment()
+		return fmt.Errorf("unable to send connection ack: %w", err)
+	}
+	tpt.remoteEPs = append(tpt.remoteEPs, remoteEPid)
+
+	// Both sides have the segment mapped, the name is not needed anymore
+	os.Remove(tpt.path)
+
+	tpt.startThreads()
+
+	tpt.log.Info("connection accepted", EndpointField(remoteEPid))
+
+	return nil
+}
+
+// openSegment maps the segment of a transport waiting for a peer to connect to it
+func (tpt *SMTransport) openSegment(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var hdr [smHdrLen]byte
+	_, err = f.ReadAt(hdr[:], 0)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(hdr[smMagicOffset:]) != smMagic ||
+		binary.LittleEndian.Uint64(hdr[smStateOffset:]) != smStateListening {
+		return fmt.Errorf("%s is not ready to accept connections", path)
+	}
+	// The transport owning the segment keeps it locked
+	if lockSegment(f) == nil {
+		return fmt.Errorf("%s is not owned by a transport anymore", path)
+	}
+
+	// The size of the rings is checked against the size of the segment,
+	// accessing memory beyond the end of the file would crash the process
+	ringSize := binary.LittleEndian.Uint64(hdr[smRingSizeOffset:])
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to get size of shared memory segment: %w", err)
+	}
+	if ringSize == 0 || ringSize > uint64(fi.Size()) || int64(segmentLen(ringSize)) != fi.Size() {
+		return fmt.Errorf("ring size %d inconsistent with the size of %s (%d bytes)", ringSize, path, fi.Size())
+	}
+	tpt.segment, err = mapSegment(f, segmentLen(ringSize))
+	if err != nil {
+		return fmt.Errorf("unable to map shared memory segment: %w", err)
+	}
+	tpt.setRings(ringSize, false)
+	if !atomic.CompareAndSwapUint64(tpt.state, smStateListening, smStateConnected) {
+		unmapSegment(tpt.segment)
+		tpt.segment = nil
+		tpt.state = nil
+		return fmt.Errorf("%s is already connected", path)
+	}
+	tpt.path = path
+	return nil
+}
+
+// Connect connects to the shared memory segment of a peer accepting
+// connections and includes the endpoint ID of the caller in the connection
+// handshake. The ID of the remote endpoint is returned upon success. A
+// segment connects a single pair of transports: a transport accepting
+// connections stops waiting for a peer to connect to its own segment.
+func (tpt *SMTransport) Connect(epID string) (string, error) {
+	if tpt == nil || tpt.Cfg == nil {
+		return "", fmt.Errorf("corrupted transport object")
+	}
+	if tpt.stopAccepting() || tpt.segment != nil {
+		return "", fmt.Errorf("shared memory transport already connected")
+	}
+
+	var err error
+	for retry := 0; ; retry++ {
+		for _, path := range tpt.Cfg.paths() {
+			err = tpt.openSegment(path)
+			if err == nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+		if retry >= tpt.Cfg.MaxRetry {
+			return "", fmt.Errorf("unable to open shared memory segment: %w", err)
+		}
+		waitRetry(context.Background(), retry)
+	}
+
+	connReq := TCPHeader{
+		MsgType: CONNREQ,
+		Src:     epID,
+	}
+	err = tpt.putMsg(connReq, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to send connection request: %w", err)
+	}
+	rx, err := tpt.getMsg(CONNACK, nil)
+	if err != nil {
+		return "", fmt.Errorf("connection handshake failed: %w", err)
+	}
+	serverID := string(tpt.ExtractSrc(rx))
+	tpt.RxPool.Return(rx)
+	tpt.remoteEPs = append(tpt.remoteEPs, serverID)
+
+	tpt.startThreads()
+
+	tpt.log.Info("connected", EndpointField(serverID))
+	return serverID, nil
+}
+
+// SendMsg sends a message, i.e., a header and payload using a specific
+// transport. Like with the TCP transport, the header and payload are copied
+// to a TX buffer and queued to a send queue for a separate thread to perform
+// the actual send.
+func (tpt *SMTransport) SendMsg(hdr TCPHeader, payload []byte) error {
+	tx := tpt.TxPool.Get()
+	if tx == nil {
+		return fmt.Errorf("unable to get TX buffer: %w", ErrPoolExhausted)
+	}
+	if payloadOffset+len(payload) > len(tx) {
+		tpt.TxPool.Return(tx)
+		return fmt.Errorf("payload of %d bytes larger than MTU: %w", len(payload), ErrMessageTooLarge)
+	}
+
+	setHeader(tx, hdr)
+	setPayload(tx, payload)
+	select {
+	case tpt.sendQueue <- tx:
+	case <-tpt.done:
+		tpt.TxPool.Return(tx)
+		return fmt.Errorf("shared memory transport closed")
+	}
+
+	return nil
+}
+
+// SendTermMsg is a helper function that sends a termination message
+func (tpt *SMTransport) SendTermMsg(src string, dst string) error {
+	hdr := TCPHeader{
+		MsgType: TERMMSG,
+		Src:     src,
+		Dst:     dst,
+	}
+	err := tpt.SendMsg(hdr, nil)
+	if err != nil {
+		return fmt.Errorf("unable to send termination message: %w", err)
+	}
+
+	return nil
+}
+
+// ExtractPayload returns the payload from a RX buffer. The caller is in charge
+// of copying the data as required since the data returned by this function is
+// not guaranteed once the RX buffer is returned.
+func (tpt *SMTransport) ExtractPayload(rx []byte) ([]byte, error) {
+	n, err := msgLen(rx)
+	if err != nil {
+		return nil, err
+	}
+	return rx[payloadOffset:n], nil
+}
+
+// ExtractDest returns the message destination endpoint ID from a RX buffer.
+func (tpt *SMTransport) ExtractDest(rx []byte) string {
+	return strings.TrimRight(string(rx[dstOffset:dstOffset+dstLen]), "\x00")
+}
+
+// ExtractSrc returns the subset of the RX storing the ID of the message's source.
+// Note that the value is concidered invalid once the RX is returned; it is the
+// responsability of the caller to make a copy as required.
+func (tpt *SMTransport) ExtractSrc(rx []byte) []byte {
+	return bytes.TrimRight(rx[srcOffset:srcOffset+srcLen], "\x00")
+}
+
+// GetMsgTypeFromRX is a helper function that parses a given RX buffer and returns the
+// message type
+func (tpt *SMTransport) GetMsgTypeFromRX(rx []byte) string {
+	return string(rx[msgTypeOffset : msgTypeOffset+msgTypeLen])
+}
+
+// GetPayloadFromRX is a helper function that parses a given RX buffer and returns the
+// payload
+func (tpt *SMTransport) GetPayloadFromRX(rx []byte) []byte {
+	payload, err := tpt.ExtractPayload(rx)
+	if err != nil {
+		tpt.log.Error("unable to extract payload", ErrorField(err))
+		return nil
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	return payload
+}
+
+// ID returns the identifier of the shared memory transport type
+func (tpt *SMTransport) ID() string {
+	return SMTransportID
+}
+
+// AcceptsConns specifies whether the transport is configured to accept
+// incoming connections and did not connect to the segment of a peer instead
+func (tpt *SMTransport) AcceptsConns() bool {
+	if tpt.Cfg == nil || !tpt.Cfg.Accept {
+		return false
+	}
+	select {
+	case <-tpt.abort:
+		return false
+	default:
+		return true
+	}
+}
+
+// GetRecvQueue returns the queue where the RX buffers of received messages are made available
+func (tpt *SMTransport) GetRecvQueue() chan []byte {
+	return tpt.RecvQueue
+}
+
+// ReturnRX gives a RX buffer back to the RX pool of the transport
+func (tpt *SMTransport) ReturnRX(rx []byte) error {
+	return tpt.RxPool.Return(rx)
+}
+
+// Close closes the shared memory connection: the peer is notified, the
+// threads of the transport are stopped and the segment is unmapped
+func (tpt *SMTransport) Close() error {
+	var err error
+	tpt.closeOnce.Do(func() {
+		close(tpt.done)
+		// A pending accept returns once done is closed, releasing the segment
+		if tpt.acceptDone != nil {
+			<-tpt.acceptDone
+		}
+		tpt.wg.Wait()
+		// The peer is notified once all the pending messages are sent
+		if tpt.state != nil {
+			atomic.StoreUint64(tpt.state, smStateClosed)
+		}
+		if tpt.segment != nil {
+			err = unmapSegment(tpt.segment)
+			tpt.segment = nil
+		}
+		if tpt.owner != nil {
+			tpt.owner.Close()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("unable to unmap shared memory segment: %w", err)
+	}
+
+	return nil
+}
+
+// Fini cleanly finalizes a shared memory transport
+func (tpt *SMTransport) Fini() {
+	err := tpt.Close()
+	if err != nil {
+		tpt.log.Error("unable to close transport", ErrorField(err))
+	}
+}
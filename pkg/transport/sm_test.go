@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	smTestName = "comm-sm-test"
+)
+
+func doSMServer(t *testing.T, dir string, done chan bool) {
+	defer close(done)
+
+	cfg := SMTransportCfg{
+		Name:   smTestName,
+		Dir:    dir,
+		Accept: true,
+	}
+	sm, err := cfg.Init()
+	if err != nil {
+		t.Errorf("unable to instantiate shared memory transport: %s", err)
+		return
+	}
+	defer sm.Fini()
+
+	for _, expected := range []string{msg1, msg2} {
+		rx := <-sm.RecvQueue
+		data, err := sm.ExtractPayload(rx)
+		if err != nil {
+			t.Errorf("unable to extract payload: %s", err)
+			return
+		}
+		if string(data) != expected {
+			t.Errorf("received %s instead of %s", string(data), expected)
+			return
+		}
+		log.Printf("Successfully received: %s\n", string(data))
+		err = sm.RxPool.Return(rx)
+		if err != nil {
+			t.Errorf("unable to return RX: %s", err)
+			return
+		}
+	}
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Dst:     clientID,
+	}
+	err = sm.SendMsg(hdr, []byte(allDoneMsg))
+	if err != nil {
+		t.Errorf("unable to send message: %s", err)
+	}
+}
+
+func TestSM(t *testing.T) {
+	dir := os.TempDir()
+	done := make(chan bool)
+	go doSMServer(t, dir, done)
+
+	cfg := SMTransportCfg{
+		Name: smTestName,
+		Dir:  dir,
+	}
+	sm, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate shared memory transport: %s", err)
+	}
+
+	serverID, err := sm.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	if len(serverID) == 0 {
+		t.Fatalf("connect did not return the server's endpoint ID")
+	}
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+	}
+	err = sm.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send first message: %s", err)
+	}
+	err = sm.SendMsg(hdr, []byte(msg2))
+	if err != nil {
+		t.Fatalf("unable to send second message: %s", err)
+	}
+
+	rx := <-sm.RecvQueue
+	data, err := sm.ExtractPayload(rx)
+	if err != nil {
+		t.Fatalf("unable to extract payload: %s", err)
+	}
+	if string(data) != allDoneMsg {
+		t.Fatalf("received %s instead of the 'all done' message", string(data))
+	}
+	sm.RxPool.Return(rx)
+
+	<-done
+	err = sm.Close()
+	if err != nil {
+		t.Fatalf("unable to close transport: %s", err)
+	}
+}
+
+func TestSMInvalidSegment(t *testing.T) {
+	dir := os.TempDir()
+	name := smTestName + "-invalid"
+
+	// The header of the segment advertises rings larger than the segment
+	var hdr [smHdrLen]byte
+	binary.LittleEndian.PutUint64(hdr[smMagicOffset:], smMagic)
+	binary.LittleEndian.PutUint64(hdr[smStateOffset:], smStateListening)
+	binary.LittleEndian.PutUint64(hdr[smRingSizeOffset:], defaultSMRingSize)
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, hdr[:], 0600)
+	if err != nil {
+		t.Fatalf("unable to create segment: %s", err)
+	}
+	defer os.Remove(path)
+
+	cfg := SMTransportCfg{
+		Name: name,
+		Dir:  dir,
+	}
+	sm, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate shared memory transport: %s", err)
+	}
+	err = sm.openSegment(path)
+	if err == nil {
+		t.Fatal("stale segment used")
+	}
+
+	// The segment is owned by a live transport
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open segment: %s", err)
+	}
+	defer f.Close()
+	err = lockSegment(f)
+	if err != nil {
+		t.Fatalf("unable to lock segment: %s", err)
+	}
+	err = sm.openSegment(path)
+	if err == nil || sm.segment != nil {
+		t.Fatal("mapped a segment smaller than its rings")
+	}
+}
+
+func TestSMOversizedRecord(t *testing.T) {
+	dir := os.TempDir()
+	name := smTestName + "-oversized"
+	accepted := make(chan *SMTransport, 1)
+	go func() {
+		cfg := SMTransportCfg{
+			Name:   name,
+			Dir:    dir,
+			Accept: true,
+		}
+		server, err := cfg.Init()
+		if err != nil {
+			t.Errorf("unable to instantiate shared memory transport: %s", err)
+		}
+		accepted <- server
+	}()
+
+	cfg := SMTransportCfg{
+		Name: name,
+		Dir:  dir,
+	}
+	client, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate shared memory transport: %s", err)
+	}
+	defer client.Close()
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	server := <-accepted
+	if server == nil {
+		return
+	}
+	defer server.Close()
+
+	// A record larger than the RX buffers of the server is skipped
+	err = client.put(make([]byte, 2*defaultMTU))
+	if err != nil {
+		t.Fatalf("unable to write record: %s", err)
+	}
+	err = client.SendMsg(TCPHeader{MsgType: DATAMSG}, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	select {
+	case rx := <-server.RecvQueue:
+		data, _ := server.ExtractPayload(rx)
+		if string(data) != msg1 {
+			t.Fatalf("received %q instead of %q", data, msg1)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message after an oversized record not received")
+	}
+}
+
+func TestSMNameRange(t *testing.T) {
+	// Two transports accepting connections in the same range of names, one
+	// of them connects to the other
+	newAcceptingSM := func() *SMTransport {
+		cfg := SMTransportCfg{
+			Name:               smTestName + "-range",
+			Dir:                os.TempDir(),
+			NameRange:          2,
+			Accept:             true,
+			DoNotBlockOnAccept: true,
+		}
+		sm, err := cfg.Init()
+		if err != nil {
+			t.Fatalf("unable to instantiate shared memory transport: %s", err)
+		}
+		return sm
+	}
+	server := newAcceptingSM()
+	defer server.Close()
+	client := newAcceptingSM()
+	defer client.Close()
+
+	_, err := client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	err = client.SendMsg(TCPHeader{MsgType: DATAMSG}, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	rx := <-server.RecvQueue
+	data, _ := server.ExtractPayload(rx)
+	if string(data) != msg1 {
+		t.Fatalf("received %q instead of %q", data, msg1)
+	}
+
+	// The segment of each transport connects a single pair of transports
+	_, err = client.Connect(clientID)
+	if err == nil {
+		t.Fatal("connected twice")
+	}
+}
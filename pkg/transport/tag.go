@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// tagLen is the size of the tag at the beginning of the payload of a TAGMSG
+	tagLen = 8
+)
+
+// isDataMsg checks whether a message type carries application data, in which
+// case the message can be fragmented or sent using the rendezvous protocol
+func isDataMsg(msgType string) bool {
+	return msgType == DATAMSG || msgType == TAGMSG
+}
+
+// dataMsgType returns the type of a data message based on its identifier
+// (see wireMsgTypes); unknown identifiers are considered as a DATAMSG
+func dataMsgType(id uint8) string {
+	if int(id) < len(wireMsgTypes) && isDataMsg(wireMsgTypes[id]) {
+		return wireMsgTypes[id]
+	}
+	return DATAMSG
+}
+
+// ExtractMsgType returns the type of a message from a RX buffer
+func ExtractMsgType(rx []byte) string {
+	if len(rx) < msgTypeOffset+msgTypeLen {
+		return INVALID
+	}
+	return string(rx[msgTypeOffset : msgTypeOffset+msgTypeLen])
+}
+
+// TaggedPayload returns the payload of a TAGMSG message carrying data with a tag
+func TaggedPayload(tag uint64, data []byte) []byte {
+	payload := make([]byte, tagLen+len(data))
+	binary.LittleEndian.PutUint64(payload, tag)
+	copy(payload[tagLen:], data)
+	return payload
+}
+
+// SplitTaggedPayload returns the tag and the data from the payload of a TAGMSG message
+func SplitTaggedPayload(payload []byte) (uint64, []byte, error) {
+	if len(payload) < tagLen {
+		return 0, nil, fmt.Errorf("invalid tagged message of %d bytes", len(payload))
+	}
+	return binary.LittleEndian.Uint64(payload), payload[tagLen:], nil
+}
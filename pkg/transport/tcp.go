@@ -8,11 +8,18 @@
 package transport
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gvallee/comm/internal/pkg/util"
@@ -27,6 +34,11 @@ const (
 	defaultNumRX       = 1024
 	defaultNumTX       = 1024
 	defaultMTU         = 4096
+	defaultMaxMsgSize  = 256 * 1024 * 1024
+
+	// Delay before the first connection retry, doubled after each retry
+	tcpConnectBackoff    = 100 * time.Millisecond
+	tcpMaxConnectBackoff = 2 * time.Second
 
 	/* Message type specific constants */
 	msgTypeLen     = 16
@@ -59,6 +71,16 @@ const (
 	CONNACK = "INTERNAL:CONNACK"
 	// DATA is the type for a data message
 	DATAMSG = "INTERNAL:DATAMSG"
+	// TAGMSG is the type for a data message whose payload starts with a tag
+	TAGMSG = "INTERNAL:TAGGMSG"
+	// FRAGMSG is the type for a fragment of a data message larger than the MTU
+	FRAGMSG = "INTERNAL:FRAGMNT"
+	// RTSMSG is the type for a rendezvous request-to-send message
+	RTSMSG = "INTERNAL:RNDVRTS"
+	// CTSMSG is the type for a rendezvous clear-to-send message
+	CTSMSG = "INTERNAL:RNDVCTS"
+	// RNDVMSG is the type for the header of the data sent using the rendezvous protocol
+	RNDVMSG = "INTERNAL:RNDVDAT"
 )
 
 // TCPTransportCfg is the structure capturing the configuration of a
@@ -86,6 +108,68 @@ type TCPTransportCfg struct {
 
 	// MTU is the requested MTU size
 	MTU int64
+
+	// EagerThreshold is the size, in bytes, above which data messages are
+	// sent using the rendezvous protocol. Messages that fit in a single
+	// frame are always sent eagerly. 0 means the default threshold, a
+	// negative value disables the rendezvous protocol.
+	EagerThreshold int64
+
+	// MaxMsgSize is the maximum size, in bytes, of the messages received
+	// as fragments or using the rendezvous protocol, i.e., of the buffers
+	// allocated on behalf of the remote peer. 0 means the default size.
+	MaxMsgSize int64
+
+	// MaxPendingBytes is the maximum size, in bytes, of the messages being
+	// received as fragments, and of the messages being received using the
+	// rendezvous protocol, at a given time on a connection. The fragments of
+	// the messages beyond that size are dropped and the rendezvous messages
+	// are rejected. 0 means MaxMsgSize.
+	MaxPendingBytes int64
+
+	// LegacyWireHeader forces the use of the legacy wire header, i.e., with
+	// string message types and endpoint IDs, instead of negotiating the
+	// compact header with the remote peer
+	LegacyWireHeader bool
+
+	// TLS specifies whether connections are secured using TLS
+	TLS bool
+
+	// CertFile and KeyFile are the paths to the PEM-encoded certificate and
+	// private key of the transport, required to accept TLS connections and
+	// to authenticate to servers requiring client certificates
+	CertFile string
+	KeyFile  string
+
+	// CAFile is the path to the PEM-encoded certificates of the CAs used to
+	// verify the certificate of the peer. If not set, servers are verified
+	// using the system's CAs and clients are not authenticated.
+	CAFile string
+
+	// ServerName is the name expected in the certificate of the server,
+	// 'Interface' by default
+	ServerName string
+
+	// RequireClientCert enables mutual authentication: clients without a
+	// certificate signed by the CA are rejected
+	RequireClientCert bool
+
+	// SpreadConns specifies whether incoming connections are redirected to
+	// the other transports of the process waiting for a connection in the
+	// port range, if any, even if the transport is not connected yet. The
+	// transport then only gets a connection when all the others are busy.
+	// Once connected, a transport always redirects new clients.
+	SpreadConns bool
+
+	// MaxConns is the maximum number of clients connected at the same time,
+	// 1 by default, a negative value meaning no limit. Each client gets its
+	// own connection and messages are sent over the connection of the client
+	// hosting the destination endpoint. Once the limit is reached, new
+	// clients are redirected.
+	MaxConns int
+
+	// Logger is the logger of the transport, nothing is logged if not set
+	Logger Logger
 }
 
 // TCPTransport is the structure representing a given instantiation of a TCP transport
@@ -96,23 +180,127 @@ type TCPTransport struct {
 	// Status is the current status of the transport`
 	Status string
 
+	// log logs the messages of the transport through the logger of the configuration
+	log ComponentLogger
+
 	// Conn is a pointer to the underlying TCP connection
 	Conn net.Conn
-
+	// reader reads the frames received on the connection
+	reader *frameReader
+	// wire encodes and decodes the headers of the frames sent over the connection
+	wire *wireCodec
+	// peerIdentity is the identity of the peer verified during the TLS handshake, if any
+	peerIdentity string
+	// tlsClient and tlsServer are the TLS configurations used to secure the
+	// connections, loaded once when the transport is created
+	tlsClient *tls.Config
+	tlsServer *tls.Config
+
+	// receiverEPs are the local endpoints reachable through the transport,
+	// the first one being the default target of incoming connection requests
 	receiverEPs []string
-	remoteEPs   []string
-	port        uint16
+	// channels are the endpoint-to-endpoint channels multiplexed over the connection
+	channels map[tcpChannel]bool
+	// pendingChannels are the channels waiting for a CONNACK, indexed by local endpoint ID
+	pendingChannels map[string]chan string
+	lock            sync.Mutex
+	port            uint16
+	// listener is the socket accepting connections, kept open once the
+	// transport is connected to redirect new clients
+	listener net.Listener
+	// peers are the connections of the clients when accepting more than one
+	peers map[*TCPTransport]net.Conn
+	// parent is the transport which accepted the connection, when managing
+	// the connection of one of its clients
+	parent *TCPTransport
+	// newChannels notifies the channels opened by remote endpoints over the
+	// connections of the clients
+	newChannels chan Channel
+	// connected is closed once the first client is connected
+	connected     chan struct{}
+	connectedOnce sync.Once
+	// done is closed to stop the send thread once the connection is closed
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// fragSeq is the sequence number of the next fragmented message
+	fragSeq uint64
+	// fragments are the fragmented messages being reassembled, only accessed
+	// by the receive thread
+	fragments *reassembler
+
+	// rndvSeq is the identifier of the last message sent using the rendezvous protocol
+	rndvSeq uint64
+	// pendingRndv are the messages waiting for a CTS, indexed by identifier
+	pendingRndv map[uint64]*rndvSend
+	// postedRndv are the buffers posted for incoming rendezvous messages,
+	// only accessed by the receive thread
+	postedRndv map[fragKey][]byte
+	// postedBytes is the size of the messages of the posted buffers
+	postedBytes uint64
+	// rndvQueue is the queue of messages ready to be sent by the send thread
+	rndvQueue chan *rndvSend
+	// rndvInFlight specifies whether a rendezvous message is waiting for its
+	// data to be sent, in which case the messages sent after it are deferred
+	rndvInFlight bool
+	// deferredTx are the TXs waiting for the rendezvous message in flight
+	deferredTx []txDesc
 
 	// RX pool
 	RxPool pool.Pool
+	// heapRX are the RX buffers delivered to the receive queue that are not
+	// allocated from the RX pool, i.e., reassembled and rendezvous messages
+	heapRX *rxSet
 	// TX pool
 	TxPool pool.Pool
 	// sendQueue
-	sendQueue chan []byte
+	sendQueue chan txDesc
 	// RecvQueue is the receive queue, accessed by the endpoint to generate RX events
 	RecvQueue chan []byte
 }
 
+// txDesc is a TX buffer queued to the send thread
+type txDesc struct {
+	tx []byte
+	// size is the size of the payload reported once the TX is sent
+	size int
+	// done, if set, is notified once the TX is sent
+	done SendCompletionFunc
+}
+
+// rxSet is a set of RX buffers, shared by the connections of the clients of
+// a transport
+type rxSet struct {
+	lock sync.Mutex
+	bufs map[*byte]bool
+}
+
+func newRxSet() *rxSet {
+	return &rxSet{
+		bufs: make(map[*byte]bool),
+	}
+}
+
+func (s *rxSet) add(rx []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bufs[&rx[0]] = true
+}
+
+// remove removes a RX buffer from the set and returns whether it was part of it
+func (s *rxSet) remove(rx []byte) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.bufs[&rx[0]] {
+		return false
+	}
+	delete(s.bufs, &rx[0])
+	return true
+}
+
 type TCPHeader struct {
 	// MsgType is the type of the message (specific to the transport)
 	MsgType string
@@ -124,6 +312,12 @@ type TCPHeader struct {
 	Dst string
 }
 
+// tcpChannel is a channel between a local and a remote endpoint
+type tcpChannel struct {
+	local  string
+	remote string
+}
+
 type tcpMsg struct {
 	hdr     TCPHeader
 	payload []byte
@@ -134,9 +328,9 @@ func (tpt *TCPTransport) sendTX(tx []byte) error {
 		return fmt.Errorf("undefined transport")
 	}
 
-	s, err := tpt.Conn.Write(tx)
-	if err != nil || s != len(tx) {
-		return fmt.Errorf("failed to send TX")
+	err := tpt.wire.writeMsg(tpt.Conn, tx)
+	if err != nil {
+		return fmt.Errorf("failed to send TX: %w", netError("write", tpt.Conn.RemoteAddr().String(), err))
 	}
 
 	return nil
@@ -157,30 +351,30 @@ func setHeader(tx []byte, hdr TCPHeader) {
 	}
 }
 
-func getHeader(conn net.Conn, rx []byte) error {
-	addr := conn.LocalAddr()
-	log.Printf("Receiving header from %s:%s\n", addr.Network(), addr.String())
-
+func (tpt *TCPTransport) getHeader(conn net.Conn, rx []byte) error {
 	// Get the message's type
-	n, err := conn.Read(rx[msgTypeOffset:msgTypeLen])
-	if err != nil || n != msgTypeLen {
+	_, err := io.ReadFull(conn, rx[msgTypeOffset:msgTypeLen])
+	if err != nil {
 		return fmt.Errorf("unable to get TCP message header")
 	}
-	log.Printf("(%s) Msg type: %s", addr.String(), string(rx[msgTypeOffset:msgTypeLen]))
 
 	// Get the src endpoint ID
-	n, err = conn.Read(rx[srcOffset : srcOffset+srcLen])
-	if err != nil || n != srcLen {
+	_, err = io.ReadFull(conn, rx[srcOffset:srcOffset+srcLen])
+	if err != nil {
 		return fmt.Errorf("unable to get TCP message header")
 	}
-	log.Printf("(%s) Msg recv'd from '%s'", addr.String(), string(rx[srcOffset:srcOffset+srcLen]))
 
 	// Get the dst endpoint ID
-	n, err = conn.Read(rx[dstOffset : dstOffset+dstLen])
-	if err != nil || n != dstLen {
+	_, err = io.ReadFull(conn, rx[dstOffset:dstOffset+dstLen])
+	if err != nil {
 		return fmt.Errorf("unable to get TCP message header")
 	}
-	log.Printf("(%s) Msg to '%s'", addr.String(), string(rx[dstOffset:dstOffset+dstLen]))
+	if tpt.log.DebugEnabled() {
+		tpt.log.Debug("header received",
+			PeerField(conn.RemoteAddr().String()),
+			MsgTypeField(string(rx[msgTypeOffset:msgTypeLen])),
+			EndpointField(string(tpt.ExtractSrc(rx))))
+	}
 
 	return nil
 }
@@ -190,8 +384,8 @@ func getPayloadWithSize(conn net.Conn, payloadSize uint64, rx []byte) error {
 		return nil
 	}
 
-	readSize, err := conn.Read(rx[payloadOffset:])
-	if readSize != int(payloadSize) || err != nil {
+	_, err := io.ReadFull(conn, rx[payloadOffset:payloadOffset+int(payloadSize)])
+	if err != nil {
 		return fmt.Errorf("unable to receive payload")
 	}
 	return nil
@@ -225,38 +419,159 @@ func getPayload(conn net.Conn, rx []byte) error {
 // transport. Remember that the header and payload will be copied to a
 // TX buffer and queued to a send queue for a separate thread to perform
 // the actual send.
+// Data messages that do not fit in a TX buffer are transparently split into
+// fragments that are reassembled by the receiver before reaching its receive
+// queue, unless they are above the eager threshold, in which case they are
+// sent using the rendezvous protocol and the call blocks until the data is sent.
 func (tpt *TCPTransport) SendMsg(hdr TCPHeader, payload []byte) error {
+	return tpt.SendMsgNotify(hdr, payload, nil)
+}
+
+// SendMsgNotify sends a message like SendMsg and invokes done from the send
+// thread once the message is written to the connection, so done must not
+// block. Messages sent using the rendezvous protocol do not block the caller
+// when done is set; the messages sent after them are still delivered in order.
+func (tpt *TCPTransport) SendMsgNotify(hdr TCPHeader, payload []byte, done SendCompletionFunc) error {
+	return tpt.sendMsg(context.Background(), hdr, payload, done)
+}
+
+// SendMsgContext sends a message like SendMsg until the context is done, in
+// which case the error of the context is returned. The context bounds the
+// wait for room in the send queue and, with the rendezvous protocol, for the
+// remote side to be ready, the payload being referenced until the message is
+// sent. Once the first fragment of a message is queued, all the fragments are
+// sent regardless of the context.
+func (tpt *TCPTransport) SendMsgContext(ctx context.Context, hdr TCPHeader, payload []byte) error {
+	return tpt.sendMsg(ctx, hdr, payload, nil)
+}
+
+func (tpt *TCPTransport) sendMsg(ctx context.Context, hdr TCPHeader, payload []byte, done SendCompletionFunc) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	conn, err := tpt.connTo(hdr.Dst)
+	if err != nil {
+		return err
+	}
+	if conn != tpt {
+		return conn.sendMsg(ctx, hdr, payload, done)
+	}
+
+	if payloadOffset+len(payload) > int(tpt.TxPool.ObjSize) {
+		if isDataMsg(hdr.MsgType) && tpt.useRendezvous(len(payload)) {
+			return tpt.sendRendezvous(ctx, hdr, payload, done)
+		}
+		return tpt.sendFragments(hdr, payload, done)
+	}
+
 	tx := tpt.TxPool.Get()
 	if tx == nil {
-		return fmt.Errorf("unable to get TX buffer")
+		return fmt.Errorf("unable to get TX buffer: %w", ErrPoolExhausted)
 	}
 
 	setHeader(tx, hdr)
 	setPayload(tx, payload)
-	tpt.sendQueue <- tx
+	desc := txDesc{tx: tx, size: len(payload), done: done}
+	if tpt.deferSend(hdr.MsgType, desc) {
+		return nil
+	}
+	return tpt.queueTxContext(ctx, desc)
+}
 
-	return nil
+// queueTx queues a TX to the send thread, unless the connection is closed
+func (tpt *TCPTransport) queueTx(desc txDesc) error {
+	return tpt.queueTxContext(context.Background(), desc)
 }
 
-func recvMsg(conn net.Conn, rx []byte) (int, error) {
-	n, err := conn.Read(rx)
-	if n == 0 {
-		log.Println("[tcp:recvMsg] Conection closed, terminating...")
-		return 0, nil
+// queueTxContext queues a TX to the send thread, unless the connection is
+// closed or the context is done first
+func (tpt *TCPTransport) queueTxContext(ctx context.Context, desc txDesc) error {
+	var err error
+	select {
+	case tpt.sendQueue <- desc:
+		return nil
+	case <-tpt.done:
+		err = ErrPeerClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if desc.tx != nil {
+		tpt.TxPool.Return(desc.tx)
+	}
+	return err
+}
+
+// sendFragments sends a data message larger than the MTU as a sequence of
+// fragments, each of them fitting in a TX buffer. The completion of the
+// message is notified once its last fragment is sent.
+func (tpt *TCPTransport) sendFragments(hdr TCPHeader, payload []byte, done SendCompletionFunc) error {
+	if !isDataMsg(hdr.MsgType) {
+		return fmt.Errorf("%s message of %d bytes exceeds the MTU: %w", hdr.MsgType, len(payload), ErrMessageTooLarge)
+	}
+
+	fragHdr := hdr
+	fragHdr.MsgType = FRAGMSG
+	chunkSize := int(tpt.TxPool.ObjSize) - payloadOffset - fragHdrLen
+	seq := atomic.AddUint64(&tpt.fragSeq, 1)
+
+	var fragDone, lastFragDone SendCompletionFunc
+	if done != nil {
+		// The fragments are all sent by the send thread, in order
+		var fragErr error
+		fragDone = func(_ int, err error) {
+			if fragErr == nil {
+				fragErr = err
+			}
+		}
+		lastFragDone = func(_ int, err error) {
+			fragDone(0, err)
+			if fragErr != nil {
+				done(0, fragErr)
+				return
+			}
+			done(len(payload), nil)
+		}
+	}
+	lastFrag := numFragments(len(payload), chunkSize) - 1
+
+	// The fragment is copied to a TX buffer before SendMsgNotify returns so it can be reused
+	return fragment(payload, hdr.MsgType, chunkSize, seq, func(i int, frag []byte) error {
+		if i == lastFrag {
+			return tpt.SendMsgNotify(fragHdr, frag, lastFragDone)
+		}
+		return tpt.SendMsgNotify(fragHdr, frag, fragDone)
+	})
+}
+
+// recvMsg reads the next frame from the connection into a RX buffer,
+// regardless of how the data is split or coalesced by the network
+func (tpt *TCPTransport) recvMsg(reader *frameReader, wire *wireCodec, rx []byte) (int, error) {
+	n, err := wire.readMsg(reader, rx)
+	if err == io.EOF {
+		tpt.log.Debug("connection closed by peer")
+		return 0, ErrPeerClosed
 	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to received data")
+		return 0, fmt.Errorf("failed to received data: %w", netError("read", "", err))
+	}
+	size, err := msgLen(rx)
+	if err != nil || size > n {
+		return 0, fmt.Errorf("payload size inconsistent with frame length %d", n)
+	}
+	if tpt.log.DebugEnabled() {
+		tpt.log.Debug(fmt.Sprintf("%d bytes received", n),
+			MsgTypeField(string(rx[msgTypeOffset:msgTypeOffset+msgTypeLen])),
+			EndpointField(tpt.ExtractDest(rx)))
 	}
-	log.Printf("Successfully received %d bytes\n", n)
 
 	return n, nil
 }
 
-func sendConnAck(tcp *TCPTransport, src string, dst string) error {
+func sendConnAck(tcp *TCPTransport, src string, dst string, payload []byte) error {
 	// Get an TX
 	tx := tcp.TxPool.Get()
 	if tx == nil {
-		return fmt.Errorf("unable to get TX")
+		return fmt.Errorf("unable to get TX buffer: %w", ErrPoolExhausted)
 	}
 
 	// Set the TX
@@ -266,33 +581,113 @@ func sendConnAck(tcp *TCPTransport, src string, dst string) error {
 		Dst:     dst,
 	}
 
-	// No payload
+	// The payload is the negotiated version of the wire header
 	setHeader(tx, hdr)
-	setPayload(tx, nil)
+	setPayload(tx, payload)
 
 	// Add the send queue
-	tcp.sendQueue <- tx
+	return tcp.queueTx(txDesc{tx: tx})
+}
 
-	return nil
+// AddEndpoint makes a local endpoint reachable through the transport so that
+// remote endpoints can open a channel to it over the existing connection
+func (tpt *TCPTransport) AddEndpoint(epID string) {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for _, id := range tpt.receiverEPs {
+		if id == epID {
+			return
+		}
+	}
+	tpt.receiverEPs = append(tpt.receiverEPs, epID)
+}
+
+// lookupReceiver returns the local endpoint targeted by a connection request;
+// if the target is not specified or unknown, the default endpoint is used
+func (tpt *TCPTransport) lookupReceiver(epID string) string {
+	if tpt.parent != nil {
+		// The endpoints are registered with the transport which accepted the connection
+		return tpt.parent.lookupReceiver(epID)
+	}
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for _, id := range tpt.receiverEPs {
+		if id == epID {
+			return id
+		}
+	}
+	if len(tpt.receiverEPs) == 0 {
+		return ""
+	}
+	return tpt.receiverEPs[0]
+}
+
+func (tpt *TCPTransport) addChannel(remoteEPid string, localEPid string) {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	tpt.channels[tcpChannel{local: localEPid, remote: remoteEPid}] = true
+}
+
+func (tpt *TCPTransport) hasChannel(c tcpChannel) bool {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	return tpt.channels[c]
+}
+
+// NumChannels returns the number of endpoint-to-endpoint channels currently
+// multiplexed over the connection of the transport, including the connections
+// of its clients
+func (tpt *TCPTransport) NumChannels() int {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	n := len(tpt.channels)
+	for c := range tpt.peers {
+		n += c.NumChannels()
+	}
+	return n
 }
 
 func handleConnReq(tcp *TCPTransport, rx []byte) {
-	// if more than one port are to the used and the port is not the lower one,
-	// accept the connection
-	src := tcp.receiverEPs[0] // todo: handle multiple endpoints per transport
-	dst := string(rx[srcOffset : srcOffset+srcLen])
-	log.Printf("Recv'd connection request from %s\n", dst)
-	log.Println("Sending connection ack")
-	sendConnAck(tcp, src, dst)
+	// The connection request may target a specific local endpoint, in which
+	// case the new channel is between that endpoint and the remote one
+	remoteEPid := string(tcp.ExtractSrc(rx))
+	localEPid := tcp.lookupReceiver(tcp.ExtractDest(rx))
+	tcp.log.Debug("connection request received", EndpointField(remoteEPid))
+	tcp.addChannel(remoteEPid, localEPid)
+	if tcp.parent != nil {
+		tcp.parent.notifyChannel(localEPid, remoteEPid)
+	}
+
+	// The connection request advertises the most recent version of the
+	// wire header supported by the remote peer
+	payload, err := tcp.ExtractPayload(rx)
+	if err != nil {
+		tcp.log.Error("unable to extract payload from CONNREQ", ErrorField(err))
+	}
+	version := negotiateWireVersion(tcp.supportedWireVersion(), payload)
+	tcp.wire.setVersion(version)
 
-	// todo: if all the ports available are used: multiplex
+	sendConnAck(tcp, localEPid, remoteEPid, wireVersionPayload(version))
 }
 
-func handleTermMsg() bool {
-	// In case of multiplexing, we need to go through the data we track to
-	// know if we need to stop the receive thread. Otherwise, we just stop the
-	// receive thread
-	return true
+func handleTermMsg(tcp *TCPTransport, rx []byte) bool {
+	// With multiplexing, a termination message only closes the channel with
+	// the remote endpoint; we stop the receive thread once all the channels
+	// are closed.
+	c := tcpChannel{
+		local:  tcp.ExtractDest(rx),
+		remote: string(tcp.ExtractSrc(rx)),
+	}
+	if !tcp.hasChannel(c) {
+		c.local = tcp.lookupReceiver(c.local)
+	}
+	// The messages being reassembled on the channel will never complete
+	tcp.fragments.drop(fragPeers(c.remote, c.local))
+
+	tcp.lock.Lock()
+	defer tcp.lock.Unlock()
+	delete(tcp.channels, c)
+	return len(tcp.channels) == 0
 }
 
 // ExtractPayload returns the payload from a RX buffer. The caller is in charge
@@ -311,137 +706,228 @@ func (t *TCPTransport) ExtractPayload(rx []byte) ([]byte, error) {
 // The caller is in charge of copying the data as required since the data
 // returned by this function is not guaranteed once the RX buffer is returned.
 func (t *TCPTransport) ExtractDest(rx []byte) string {
-	return string(rx[dstOffset : dstOffset+dstLen])
+	return strings.TrimRight(string(rx[dstOffset:dstOffset+dstLen]), "\x00")
 }
 
 // GetSrcFromRX returns the subset of the RX storing the ID of the message's source.
 // Note that the value is concidered invalid once the RX is returned; it is the
 // responsability of the caller to make a copy as required.
 func (tpt *TCPTransport) ExtractSrc(rx []byte) []byte {
-	return rx[srcOffset : srcOffset+srcLen]
+	return bytes.TrimRight(rx[srcOffset:srcOffset+srcLen], "\x00")
 }
 
-func handleConnRedirect(tcp *TCPTransport, rx []byte) error {
-	// During a connection attempt, we are being redirected to another port
-	src := string(rx[srcOffset : srcOffset+srcLen])
-	payload, err := tcp.ExtractPayload(rx)
+// handleFragment adds a fragment to the message being reassembled and, once
+// all its fragments are received, makes the message available in the receive queue
+func handleFragment(tcp *TCPTransport, rx []byte) error {
+	frag, err := tcp.ExtractPayload(rx)
 	if err != nil {
-		return fmt.Errorf("unable to extract payload from RX: %w", err)
+		return err
 	}
-	port, err := strconv.Atoi(string(payload))
+	peers := fragPeers(string(tcp.ExtractSrc(rx)), tcp.ExtractDest(rx))
+	_, msg, err := tcp.fragments.add(rx, peers, frag)
 	if err != nil {
-		return fmt.Errorf("failed to extract port from payload: %w", err)
+		return err
 	}
-	ip := "notvalid"
-	_, err = tcp.ConnectToPort(src, ip, uint16(port))
-	if err != nil {
-		return fmt.Errorf("connect failed: %w", err)
+	if msg != nil {
+		tcp.heapRX.add(msg)
+		tcp.queueRX(msg)
 	}
-
 	return nil
 }
 
+// queueRX makes a received message available in the receive queue. False is
+// returned, and the RX buffer released, if the transport is closed first.
+func (tcp *TCPTransport) queueRX(rx []byte) bool {
+	select {
+	case tcp.RecvQueue <- rx:
+		return true
+	case <-tcp.done:
+		tcp.ReturnRX(rx)
+		return false
+	}
+}
+
 func handleConnAck(tcp *TCPTransport, rx []byte) {
-	// Connection succeeded, we get the remote endpoint ID, save it and return the RX
-	remoteEPid := rx[dstOffset : dstOffset+dstLen]
-	tcp.remoteEPs = append(tcp.remoteEPs, string(remoteEPid))
-	err := tcp.RxPool.Return(rx)
-	if err != nil {
-		log.Println("[ERROR:tcp] unable to return RX")
+	// Connection succeeded, we get the remote endpoint ID, save it and notify
+	// the local endpoint waiting for the new channel
+	remoteEPid := string(tcp.ExtractSrc(rx))
+	localEPid := tcp.ExtractDest(rx)
+	tcp.addChannel(remoteEPid, localEPid)
+	tcp.setWireVersion(rx)
+
+	tcp.lock.Lock()
+	ack, ok := tcp.pendingChannels[localEPid]
+	tcp.lock.Unlock()
+	if ok {
+		ack <- remoteEPid
 	}
-	log.Println("CONNACK successfully handled; connection fully established")
+	tcp.log.Debug("connection established", EndpointField(localEPid))
 }
 
 func recvThread(tcp *TCPTransport) {
+	defer tcp.detach()
+	// The messages being reassembled will never complete once disconnected
+	defer tcp.fragments.reset()
 	for {
 		rx := tcp.RxPool.Get()
 		if rx == nil {
-			log.Println("[ERROR:tcp] unable to get RX buffer")
+			tcp.log.Error("unable to get RX buffer")
 			return
 		}
 
-		n, err := recvMsg(tcp.Conn, rx)
-		if n == 0 && err == nil {
-			// Connection close, terminating
-			log.Println("[tcp:recvThread] Terminating...")
+		n, err := tcp.recvMsg(tcp.reader, tcp.wire, rx)
+		if n == 0 {
+			// Connection closed or stream corrupted, terminating
+			if err != nil && !errors.Is(err, ErrPeerClosed) {
+				tcp.log.Error("unable to receive data", ErrorField(err))
+			}
+			tcp.log.Debug("receive thread terminating")
+			tcp.RxPool.Return(rx)
 			return
 		}
-		if err != nil {
-			log.Printf("unable to receive data: %s", err)
-		}
 
 		msgType := string(rx[msgTypeOffset : msgTypeOffset+msgTypeLen])
 		switch msgType {
-		case DATAMSG:
-			log.Println("DATAMSG recv'd")
-			tcp.RecvQueue <- rx
+		case DATAMSG, TAGMSG:
+			if !tcp.queueRX(rx) {
+				tcp.log.Debug("receive thread terminating")
+				return
+			}
 			// The event thread at the endpoint level will get the RX and generate
 			// an event so that the application can do a ep.GetRXEvent()
+		case FRAGMSG:
+			err := handleFragment(tcp, rx)
+			if err != nil {
+				tcp.log.Error("unable to handle fragment", ErrorField(err))
+			}
+			err = tcp.RxPool.Return(rx)
+			if err != nil {
+				tcp.log.Error("unable to return RX buffer", ErrorField(err))
+			}
+		case RTSMSG, CTSMSG, RNDVMSG:
+			var err error
+			switch msgType {
+			case RTSMSG:
+				err = handleRTS(tcp, rx)
+			case CTSMSG:
+				err = handleCTS(tcp, rx)
+			default:
+				err = handleRndvData(tcp, rx)
+			}
+			if err != nil {
+				tcp.log.Error("unable to handle message", MsgTypeField(msgType), ErrorField(err))
+			}
+			err = tcp.RxPool.Return(rx)
+			if err != nil {
+				tcp.log.Error("unable to return RX buffer", ErrorField(err))
+			}
 		case CONNREQ:
-			log.Println("CONNREQ recv'd")
 			handleConnReq(tcp, rx)
 			err := tcp.RxPool.Return(rx)
 			if err != nil {
-				log.Println("unable to return RX buffer")
+				tcp.log.Error("unable to return RX buffer", ErrorField(err))
 			}
 		case TERMMSG:
-			log.Println("TERMMSG recv'd")
-			mustExit := handleTermMsg()
+			tcp.log.Debug("termination message received", EndpointField(string(tcp.ExtractSrc(rx))))
+			mustExit := handleTermMsg(tcp, rx)
 			err := tcp.RxPool.Return(rx)
 			if err != nil {
-				log.Println("unable to return RX buffer")
+				tcp.log.Error("unable to return RX buffer", ErrorField(err))
 			}
 			if mustExit {
 				return
 			}
 		case CONNRED:
-			log.Println("CONNRED recv'd")
-			handleConnRedirect(tcp, rx)
+			// Redirections are only expected during the connection handshake
+			tcp.log.Error("unexpected message", MsgTypeField(msgType))
 			err := tcp.RxPool.Return(rx)
 			if err != nil {
-				log.Println("unable to return RX buffer")
+				tcp.log.Error("unable to return RX buffer", ErrorField(err))
 			}
 		case CONNACK:
-			log.Println("CONNACK recv'd")
 			handleConnAck(tcp, rx)
 			err := tcp.RxPool.Return(rx)
 			if err != nil {
-				log.Println("unable to return RX buffer")
+				tcp.log.Error("unable to return RX buffer", ErrorField(err))
 			}
 		default:
-			log.Printf("[ERROR:tcp] messages of type %s are not yet supported", msgType)
+			tcp.log.Error("unsupported message", MsgTypeField(msgType))
 			err := tcp.RxPool.Return(rx)
 			if err != nil {
-				log.Println("unable to return RX buffer")
+				tcp.log.Error("unable to return RX buffer", ErrorField(err))
 			}
 		}
 	}
 }
 
+// writeTx writes a TX to the connection and notifies its completion
+func (tcp *TCPTransport) writeTx(desc txDesc) error {
+	var msgType string
+	if tcp.log.DebugEnabled() {
+		msgType = string(desc.tx[msgTypeOffset : msgTypeOffset+msgTypeLen])
+	}
+	sendErr := tcp.wire.writeMsg(tcp.Conn, desc.tx)
+	if sendErr != nil {
+		sendErr = netError("write", tcp.Conn.RemoteAddr().String(), sendErr)
+	}
+	// at the moment, even if send() failed, we return the TX
+	err := tcp.TxPool.Return(desc.tx)
+	if err != nil {
+		tcp.log.Error("unable to return TX buffer", ErrorField(err))
+	}
+	if desc.done != nil {
+		if sendErr != nil {
+			desc.done(0, sendErr)
+		} else {
+			desc.done(desc.size, nil)
+		}
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	if tcp.log.DebugEnabled() {
+		tcp.log.Debug(fmt.Sprintf("%d bytes sent", desc.size),
+			PeerField(tcp.Conn.RemoteAddr().String()),
+			MsgTypeField(msgType))
+	}
+	return nil
+}
+
 func sendThread(tcp *TCPTransport) {
+	defer tcp.dropDeferred()
 	for {
 		if tcp != nil && tcp.Conn != nil {
-			addr := tcp.Conn.LocalAddr()
-
-			tx := <-tcp.sendQueue
-			if tx == nil {
+			var desc txDesc
+			select {
+			case desc = <-tcp.sendQueue:
+			case <-tcp.done:
 				return
+			case s := <-tcp.rndvQueue:
+				// The send thread is the only one writing to the
+				// connection, the rendezvous data therefore
+				// cannot be interleaved with other messages
+				if s.err != nil {
+					s.complete(s.err)
+				} else {
+					s.complete(sendRndvData(tcp, s))
+				}
+				for _, desc := range tcp.releaseDeferred() {
+					err := tcp.writeTx(desc)
+					if err != nil {
+						tcp.log.Info("connection closed, send thread terminating", ErrorField(err))
+						return
+					}
+				}
+				continue
 			}
-			log.Printf("(%s) New TX to send...", addr.String())
-			n, err := tcp.Conn.Write(tx)
-			if n == 0 {
-				// Connection is closed, exiting
-				log.Println("[INFO:sendThread] Connection closed, terminating")
+			if desc.tx == nil {
 				return
 			}
-			if n != len(tx) {
-				log.Printf("[ERROR:sendThread] %d were sent instead of %d", n, len(tx))
-			}
-			// at the moment, even if send() failed, we return the TX
-			log.Printf("(%s) Send succeeded (%d bytes), returning TX...", addr.String(), n)
-			err = tcp.TxPool.Return(tx)
+			err := tcp.writeTx(desc)
 			if err != nil {
-				log.Println("[ERROR:sendThread] unable to return TX")
+				// Connection is closed, exiting
+				tcp.log.Info("connection closed, send thread terminating", ErrorField(err))
+				return
 			}
 		}
 	}
@@ -450,16 +936,18 @@ func sendThread(tcp *TCPTransport) {
 func doAccept(serverID string, tcp *TCPTransport) error {
 	err := tcp.Accept(serverID)
 	if err != nil {
-		log.Printf("[ERROR:tcp] unable to accept incoming connections: %s", err)
-		return nil
+		tcp.log.Error("unable to accept incoming connections", ErrorField(err))
+		return err
 	}
 	return nil
 }
 
-// Init creates a new TCP transport based on a configuration
-func (cfg *TCPTransportCfg) Init() *TCPTransport {
+// newTCPTransport creates a new TCP transport based on a configuration,
+// without accepting incoming connections
+func newTCPTransport(cfg *TCPTransportCfg) *TCPTransport {
 	var tcp TCPTransport
 	tcp.Cfg = cfg
+	tcp.log = NewComponentLogger(cfg.Logger, "tcp")
 	if tcp.Cfg.MaxRetry == 0 {
 		tcp.Cfg.MaxRetry = defaultTCPMaxRetry
 	}
@@ -485,28 +973,72 @@ func (cfg *TCPTransportCfg) Init() *TCPTransport {
 	tcp.TxPool.New()
 	tcp.RxPool.New()
 
-	tcp.sendQueue = make(chan []byte)
 	tcp.RecvQueue = make(chan []byte)
+	tcp.heapRX = newRxSet()
+	tcp.initConnState()
+	if cfg.acceptsMultipleConns() {
+		tcp.peers = make(map[*TCPTransport]net.Conn)
+		tcp.newChannels = make(chan Channel, defaultNumChannelNotifications)
+		tcp.connected = make(chan struct{})
+	}
+
+	return &tcp
+}
+
+// initConnState initializes the state associated to the connection of the transport
+func (tcp *TCPTransport) initConnState() {
+	tcp.sendQueue = make(chan txDesc)
+	tcp.channels = make(map[tcpChannel]bool)
+	tcp.pendingChannels = make(map[string]chan string)
+	tcp.fragments = newReassembler(tcp.Cfg.maxMsgSize(), tcp.Cfg.maxPendingBytes())
+	tcp.pendingRndv = make(map[uint64]*rndvSend)
+	tcp.postedRndv = make(map[fragKey][]byte)
+	tcp.rndvQueue = make(chan *rndvSend)
+	tcp.wire = newWireCodec()
+	tcp.done = make(chan struct{})
+}
+
+// Init creates a new TCP transport based on a configuration. When the
+// transport accepts connections without DoNotBlockOnAccept, the error of the
+// accept is returned.
+func (cfg *TCPTransportCfg) Init() (*TCPTransport, error) {
+	tcp := newTCPTransport(cfg)
+	err := tcp.initTLS()
+	if err != nil {
+		return nil, err
+	}
 
 	if cfg.Accept {
 		serverID := util.GenerateID()
-		tcp.receiverEPs = append(tcp.receiverEPs, serverID)
-		log.Printf("[INFO:tcp] Waiting for connection on %s...", tcp.Cfg.Interface)
+		tcp.log.Info("waiting for connection", Field{Key: "interface", Value: tcp.Cfg.Interface})
 		if !cfg.DoNotBlockOnAccept {
-			err := doAccept(serverID, &tcp)
+			err := tcp.Accept(serverID)
 			if err != nil {
-				return nil
+				return nil, fmt.Errorf("unable to accept incoming connections: %w", err)
 			}
 		} else {
-			go doAccept(serverID, &tcp)
+			go doAccept(serverID, tcp)
 		}
 	}
 
-	return &tcp
+	return tcp, nil
 }
 
-// Close closes the current connection associated to the transport
+// Close closes the current connection associated to the transport and stops
+// accepting, or redirecting, incoming connections
 func (tpt *TCPTransport) Close() error {
+	tpt.stop()
+	tpt.lock.Lock()
+	if tpt.listener != nil {
+		tpt.listener.Close()
+	}
+	for _, conn := range tpt.peers {
+		conn.Close()
+	}
+	tpt.lock.Unlock()
+	if tpt.Conn == nil {
+		return nil
+	}
 	err := tpt.Conn.Close()
 	if err != nil {
 		return fmt.Errorf("unable to close TCP connection: %w", err)
@@ -518,7 +1050,6 @@ func (tpt *TCPTransport) Close() error {
 // IsAcceptingConns checks the status of the transport and if incoming connections can be accepted
 func (tpt *TCPTransport) IsAcceptingConns() bool {
 	if tpt == nil {
-		log.Println("[ERROR:tcp] undefined transport")
 		return false
 	}
 
@@ -530,6 +1061,32 @@ func (tpt *TCPTransport) IsAcceptingConns() bool {
 
 // Accept accepts an incoming TCP connection using a given TCP transport
 func (tpt *TCPTransport) Accept(epID string) error {
+	return tpt.AcceptContext(context.Background(), epID)
+}
+
+// watchListener closes a listener once the context is done, which interrupts
+// the pending accepts. The returned function stops watching the listener.
+func watchListener(ctx context.Context, listener net.Listener) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// AcceptContext accepts an incoming TCP connection like Accept until the
+// context is done, in which case the transport stops listening and the error
+// of the context is returned
+func (tpt *TCPTransport) AcceptContext(ctx context.Context, epID string) error {
 	if tpt == nil || tpt.Cfg == nil {
 		return fmt.Errorf("corrupted transport object")
 	}
@@ -538,7 +1095,7 @@ func (tpt *TCPTransport) Accept(epID string) error {
 		return fmt.Errorf("attempting to accept connections on a transport not setup for it")
 	}
 	tpt.Status = tcpTransportStatusAccepting
-	tpt.receiverEPs = append(tpt.receiverEPs, epID)
+	tpt.AddEndpoint(epID)
 
 	port := tpt.Cfg.PortLow
 Retry:
@@ -552,89 +1109,220 @@ Retry:
 		}
 		return fmt.Errorf("listen failed while acception new TCP connection: %w", err)
 	}
+	// The transport may be closed while the listener is created
+	tpt.lock.Lock()
+	select {
+	case <-tpt.done:
+		tpt.lock.Unlock()
+		listener.Close()
+		return fmt.Errorf("transport closed while accepting connections")
+	default:
+	}
 	tpt.port = port
-	log.Printf("[INFO:tcp] Listening on port %d\n", tpt.port)
+	tpt.listener = listener
+	tpt.lock.Unlock()
+	tpt.log.Info("listening", Field{Key: "addr", Value: listener.Addr().String()})
+	stopWatching := watchListener(ctx, listener)
+	defer stopWatching()
+
+	setIdleAcceptor(tpt.Cfg.Interface, tpt.port, true)
+	if tpt.Cfg.acceptsMultipleConns() {
+		// Clients are accepted until the listener is closed; we only wait
+		// for the first one
+		errs := make(chan error, 1)
+		go func() {
+			errs <- tpt.acceptConns(listener)
+		}()
+		select {
+		case <-tpt.connected:
+			return nil
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+
+	// The TLS handshakes are performed in the background so that a client
+	// that does not complete it does not block the others
+	var claimed int32
+	secured := make(chan net.Conn, 1)
+	errs := make(chan error, 1)
+	go tpt.acceptFirstConn(listener, &claimed, secured, errs)
+	var conn net.Conn
+	select {
+	case conn = <-secured:
+	case err = <-errs:
+		setIdleAcceptor(tpt.Cfg.Interface, tpt.port, false)
+		if !atomic.CompareAndSwapInt32(&claimed, 0, 1) {
+			// A client completed its handshake in the meantime
+			(<-secured).Close()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("accept failed: %w", err)
+	}
+	setIdleAcceptor(tpt.Cfg.Interface, tpt.port, false)
 
+	return tpt.acceptConn(conn)
+}
+
+// acceptFirstConn accepts connections until the listener is closed and
+// secures them in the background. The first connection secured is handed
+// over through secured and claimed is set; the other clients, including the
+// ones connecting afterwards, are redirected.
+func (tpt *TCPTransport) acceptFirstConn(listener net.Listener, claimed *int32, secured chan<- net.Conn, errs chan<- error) {
 	for {
-		tpt.Conn, err = listener.Accept()
-		if err == nil {
-			// Connection established
-			break
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
 		}
+		if atomic.LoadInt32(claimed) == 1 {
+			// The transport is busy, new clients are redirected
+			go tpt.redirectConn(conn, tpt.redirectTarget(conn))
+			continue
+		}
+		if tpt.Cfg.SpreadConns {
+			addr := tpt.redirectTarget(conn)
+			if addr != "" {
+				go tpt.redirectConn(conn, addr)
+				continue
+			}
+		}
+		go func(conn net.Conn) {
+			peer := conn.RemoteAddr().String()
+			conn, err := tpt.secureConn(conn, true)
+			if err != nil {
+				tpt.log.Warn("connection rejected", PeerField(peer), ErrorField(err))
+				return
+			}
+			if atomic.CompareAndSwapInt32(claimed, 0, 1) {
+				secured <- conn
+				return
+			}
+			// Another client got the connection in the meantime
+			tpt.redirectSecuredConn(conn, tpt.redirectTarget(conn))
+		}(conn)
 	}
+}
 
-	// Start the send thread
-	go sendThread(tpt)
+// acceptConn completes the establishment of an incoming connection. The
+// connection is only used once the connection request is received so that
+// connections closed right away are simply dropped; the receive thread is
+// started once the connection request is handled.
+func (tpt *TCPTransport) acceptConn(conn net.Conn) error {
+	reader := newFrameReader(conn, int(tpt.RxPool.ObjSize))
 
 	// Make sure to establish the connection before we start the generic recv thread
 	rx := tpt.RxPool.Get()
 	if rx == nil {
-		return fmt.Errorf("[ERROR:tcp] unable to get RX buffer")
+		return fmt.Errorf("unable to get RX buffer: %w", ErrPoolExhausted)
 	}
-	_, err = recvMsg(tpt.Conn, rx)
+	_, err := tpt.recvMsg(reader, tpt.wire, rx)
 	if err != nil {
-		return fmt.Errorf("unable to receive data: %s", err)
+		tpt.RxPool.Return(rx)
+		return fmt.Errorf("unable to receive data: %w", err)
 	}
 	msgType := string(rx[msgTypeOffset : msgTypeOffset+msgTypeLen])
 	if msgType != CONNREQ {
+		tpt.RxPool.Return(rx)
 		return fmt.Errorf("receive a %s message instead of CONNREQ", msgType)
 	}
+	tpt.Conn = conn
+	tpt.reader = reader
+	tpt.peerIdentity = connPeerIdentity(conn)
+
+	// Start the send thread, required to send the connection ack
+	go sendThread(tpt)
+
 	handleConnReq(tpt, rx)
 	err = tpt.RxPool.Return(rx)
 	if err != nil {
-		log.Println("unable to return RX buffer")
+		tpt.log.Error("unable to return RX buffer", ErrorField(err))
 	}
 
 	// Start the receive thread
 	go recvThread(tpt)
 
-	log.Println("New connection accepted...")
+	tpt.log.Info("connection accepted", PeerField(conn.RemoteAddr().String()))
 
 	return nil
 }
 
-func (tpt *TCPTransport) initHandshake(epID string) (string, error) {
+// watchConn interrupts the pending reads and writes of a connection once the
+// context is done. The returned function stops watching the connection, which
+// can then be used without deadline.
+func watchConn(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+func (tpt *TCPTransport) initHandshake(epID string, dstID string) (string, error) {
 	// Get an TX
 	tx := tpt.TxPool.Get()
 	if tx == nil {
-		return "", fmt.Errorf("unable to get TX")
+		return "", fmt.Errorf("unable to get TX buffer: %w", ErrPoolExhausted)
 	}
 
 	// Set the TX
 	hdr := TCPHeader{
 		MsgType: CONNREQ,
 		Src:     epID,
+		Dst:     dstID,
 	}
 
-	// No payload
+	// The payload advertises the supported version of the wire header
 	setHeader(tx, hdr)
-	setPayload(tx, nil)
+	setPayload(tx, wireVersionPayload(tpt.supportedWireVersion()))
 	// Add the send queue
-	log.Println("Queuing TX for handshake...")
-	tpt.sendQueue <- tx
+	err := tpt.queueTx(txDesc{tx: tx})
+	if err != nil {
+		return "", err
+	}
 
 	// Wait for CONNACK
 	rx := tpt.RxPool.Get()
 	if rx == nil {
-		return "", fmt.Errorf("[ERROR:tcp] unable to get RX buffer")
+		return "", fmt.Errorf("unable to get RX buffer: %w", ErrPoolExhausted)
 	}
-	_, err := recvMsg(tpt.Conn, rx)
+	_, err = tpt.recvMsg(tpt.reader, tpt.wire, rx)
 	if err != nil {
-		return "", fmt.Errorf("unable to receive data: %s", err)
+		return "", fmt.Errorf("unable to receive data: %w", err)
 	}
 	msgType := string(rx[msgTypeOffset : msgTypeOffset+msgTypeLen])
+	if msgType == CONNRED {
+		err = handleConnRedirect(tpt, rx)
+		tpt.RxPool.Return(rx)
+		return "", err
+	}
 	if msgType != CONNACK {
 		return "", fmt.Errorf("receive a %s message instead of CONNREQ", msgType)
 	}
 
-	var serverID []byte
-	id := tpt.ExtractSrc(rx)
-	copy(serverID, id)
+	serverID := string(tpt.ExtractSrc(rx))
+	tpt.setWireVersion(rx)
 	tpt.RxPool.Return(rx)
+	tpt.addChannel(serverID, epID)
 
-	log.Println("Handshake completed")
+	tpt.log.Debug("handshake completed", EndpointField(serverID))
 
-	return string(serverID), nil
+	return serverID, nil
 }
 
 // Connect performs a connect using a given transport and include the endpoint
@@ -642,10 +1330,36 @@ func (tpt *TCPTransport) initHandshake(epID string) (string, error) {
 // knows the node and the endpoint from which the connection was initiated.
 // Remember that the transport is assumed to have been previously initialized
 // for a specific target (e.g., destination IP).
+// If the transport is already connected, a new channel between the endpoint
+// and the remote side is multiplexed over the existing connection.
 func (tpt *TCPTransport) Connect(epID string) (string, error) {
+	return tpt.ConnectEP(epID, "")
+}
+
+// ConnectContext connects like Connect until the context is done, in which
+// case the error of the context is returned
+func (tpt *TCPTransport) ConnectContext(ctx context.Context, epID string) (string, error) {
+	return tpt.ConnectEPContext(ctx, epID, "")
+}
+
+// ConnectEP connects a local endpoint to a specific remote endpoint. If the
+// remote endpoint ID is empty, the default endpoint of the remote side is
+// used. If the transport is already connected, the new endpoint-to-endpoint
+// channel is multiplexed over the existing connection.
+func (tpt *TCPTransport) ConnectEP(epID string, dstID string) (string, error) {
+	return tpt.ConnectEPContext(context.Background(), epID, dstID)
+}
+
+// ConnectEPContext connects a local endpoint to a specific remote endpoint
+// like ConnectEP until the context is done, in which case the error of the
+// context is returned
+func (tpt *TCPTransport) ConnectEPContext(ctx context.Context, epID string, dstID string) (string, error) {
 	if tpt == nil || tpt.Cfg == nil {
-		log.Println("[ERROR:tcp] corrupted transport object")
-		return "", nil
+		return "", fmt.Errorf("corrupted transport object")
+	}
+
+	if tpt.Conn != nil {
+		return tpt.openChannel(ctx, epID, dstID)
 	}
 
 	ip := tpt.Cfg.Interface
@@ -653,53 +1367,195 @@ func (tpt *TCPTransport) Connect(epID string) (string, error) {
 	if portMax == 0 {
 		portMax = tpt.Cfg.PortLow
 	}
-	log.Printf("Connecting to %s %d-%d\n", ip, tpt.Cfg.PortLow, portMax)
 
+	var lastErr error
 	for port := tpt.Cfg.PortLow; port <= portMax; port++ {
 		// Make sure we do not connect to ourselves
 		if port != tpt.port {
-			log.Printf("Trying to connect on port %d\n", port)
-			id, err := tpt.ConnectToPort(epID, ip, port)
+			addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+			id, err := tpt.connectToPort(ctx, epID, dstID, ip, port)
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
 			if err == nil {
-				log.Printf("Connection to endpoint succeeded on port: %d\n", port)
+				tpt.log.Info("connected", PeerField(addr), EndpointField(id))
 				return id, err
 			} else {
-				log.Printf("Connection on port failed: %s; checking for potential other ports to use.\n", err)
+				tpt.log.Debug("connection failed, trying the next port", PeerField(addr), ErrorField(err))
+				lastErr = err
 			}
 		}
 	}
-	return "", fmt.Errorf("unable to connect to remote endpoint")
+	if lastErr == nil {
+		return "", fmt.Errorf("unable to connect to remote endpoint")
+	}
+	return "", fmt.Errorf("unable to connect to remote endpoint: %w", lastErr)
 }
 
-// Connect creates a connection using a given transport
-func (tpt *TCPTransport) ConnectToPort(epID string, ip string, port uint16) (string, error) {
-	var err error
-	retry := 0
-Retry:
-	tpt.Conn, err = net.Dial("tcp", ip+":"+strconv.Itoa(int(port)))
+// openChannel opens a new channel between a local and a remote endpoint over
+// the existing connection
+func (tpt *TCPTransport) openChannel(ctx context.Context, epID string, dstID string) (string, error) {
+	ack := make(chan string, 1)
+	tpt.lock.Lock()
+	tpt.pendingChannels[epID] = ack
+	tpt.lock.Unlock()
+	defer func() {
+		tpt.lock.Lock()
+		delete(tpt.pendingChannels, epID)
+		tpt.lock.Unlock()
+	}()
+
+	hdr := TCPHeader{
+		MsgType: CONNREQ,
+		Src:     epID,
+		Dst:     dstID,
+	}
+	err := tpt.SendMsg(hdr, wireVersionPayload(tpt.supportedWireVersion()))
 	if err != nil {
-		if retry < tpt.Cfg.MaxRetry {
-			retry++
-			time.Sleep(time.Duration(retry) * time.Second)
-			goto Retry
+		return "", fmt.Errorf("unable to send connection request: %w", err)
+	}
+
+	select {
+	case remoteEPid := <-ack:
+		tpt.log.Debug("channel established over existing connection", EndpointField(remoteEPid))
+		return remoteEPid, nil
+	case <-time.After(time.Duration(tpt.Cfg.MaxRetry) * time.Second):
+		return "", fmt.Errorf("timeout while waiting for connection ack")
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// ConnectToPort creates a connection using a given transport
+func (tpt *TCPTransport) ConnectToPort(epID string, ip string, port uint16) (string, error) {
+	return tpt.connectToPort(context.Background(), epID, "", ip, port)
+}
+
+// ConnectToPortContext creates a connection like ConnectToPort until the
+// context is done, in which case the error of the context is returned
+func (tpt *TCPTransport) ConnectToPortContext(ctx context.Context, epID string, ip string, port uint16) (string, error) {
+	return tpt.connectToPort(ctx, epID, "", ip, port)
+}
+
+// waitRetry waits before a connection retry, using an exponential backoff,
+// unless the context is done first
+func waitRetry(ctx context.Context, retry int) error {
+	backoff := tcpConnectBackoff
+	for i := 0; i < retry && backoff < tcpMaxConnectBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > tcpMaxConnectBackoff {
+		backoff = tcpMaxConnectBackoff
+	}
+	select {
+	case <-time.After(backoff):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dial connects to a port, retrying up to MaxRetry times while the remote
+// side is not yet accepting connections
+func (tpt *TCPTransport) dial(ctx context.Context, ip string, port uint16) (net.Conn, error) {
+	var dialer net.Dialer
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	for retry := 0; ; retry++ {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if retry >= tpt.Cfg.MaxRetry {
+			return nil, netError("dial", addr, err)
+		}
+		err = waitRetry(ctx, retry)
+		if err != nil {
+			return nil, err
 		}
-		return "", nil
 	}
+}
+
+// connectToPort connects to a port, following the redirections of the remote
+// transport, if any
+func (tpt *TCPTransport) connectToPort(ctx context.Context, epID string, dstID string, ip string, port uint16) (string, error) {
+	redirects := 0
+	for {
+		conn, err := tpt.dial(ctx, ip, port)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil {
+			return "", err
+		}
+		stopWatching := watchConn(ctx, conn)
+		conn, err = tpt.secureConn(conn, false)
+		stopWatching()
+		if ctx.Err() != nil {
+			if err == nil {
+				conn.Close()
+			}
+			return "", ctx.Err()
+		}
+		if err != nil {
+			return "", err
+		}
+
+		id, err := tpt.connectConn(ctx, conn, epID, dstID)
+		var redirect *redirectError
+		if !errors.As(err, &redirect) || redirect.ip == "" {
+			return id, err
+		}
+		redirects++
+		if redirects > maxTCPRedirects {
+			return "", fmt.Errorf("too many redirections")
+		}
+		if redirect.port == tpt.port {
+			return "", fmt.Errorf("redirected to the local transport")
+		}
+		tpt.log.Info("following redirection", PeerField(net.JoinHostPort(redirect.ip, strconv.Itoa(int(redirect.port)))))
+		ip = redirect.ip
+		port = redirect.port
+	}
+}
+
+// connectConn performs the connection handshake over a newly established
+// connection and returns the ID of the remote endpoint
+func (tpt *TCPTransport) connectConn(ctx context.Context, conn net.Conn, epID string, dstID string) (string, error) {
+	tpt.Conn = conn
+	tpt.reader = newFrameReader(tpt.Conn, int(tpt.RxPool.ObjSize))
+	tpt.peerIdentity = connPeerIdentity(conn)
 
 	// Start the send thread
 	go sendThread(tpt)
 
-	log.Println("Connection succeeded, initiating handshake...")
-	serverID, err := tpt.initHandshake(epID)
+	stopWatching := watchConn(ctx, conn)
+	serverID, err := tpt.initHandshake(epID, dstID)
+	stopWatching()
+	var redirect *redirectError
+	if errors.As(err, &redirect) || ctx.Err() != nil {
+		// The connection request was sent, the send thread is therefore
+		// waiting for the next message and can be stopped
+		tpt.queueTx(txDesc{})
+		conn.Close()
+		tpt.Conn = nil
+		tpt.reader = nil
+		tpt.wire = newWireCodec()
+		tpt.peerIdentity = ""
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
 	if err != nil {
-		return "", fmt.Errorf("[ERROR] unable to initiate connection handshake: %w", err)
+		return "", fmt.Errorf("unable to initiate connection handshake: %w", err)
 	}
 
 	// Start receive thread
-	log.Println("Starting recv thread...")
 	go recvThread(tpt)
 
-	log.Println("Connect() completed")
 	return serverID, nil
 }
 
@@ -715,7 +1571,7 @@ func (tpt *TCPTransport) GetPayloadFromRX(rx []byte) []byte {
 	sizeOfSize := int(rx[sizeOfSizeOffset])
 	payloadSize, n := binary.Uvarint(rx[payloadSizeOffset : payloadSizeOffset+sizeOfSize])
 	if n != sizeOfSize {
-		log.Println("[ERROR] failed to read the payload size from TCP msg")
+		tpt.log.Error("failed to read the payload size from TCP msg")
 		return nil
 	}
 	if payloadSize == 0 {
@@ -724,9 +1580,39 @@ func (tpt *TCPTransport) GetPayloadFromRX(rx []byte) []byte {
 	return rx[msgTypeOffset : msgTypeOffset+payloadSize]
 }
 
-// Fini cleanly finalizes a TCP transport
+// ID returns the identifier of the TCP transport type
+func (tpt *TCPTransport) ID() string {
+	return TCPTransportID
+}
+
+// AcceptsConns specifies whether the transport is configured to accept incoming connections
+func (tpt *TCPTransport) AcceptsConns() bool {
+	return tpt.Cfg != nil && tpt.Cfg.Accept
+}
+
+// GetRecvQueue returns the queue where the RX buffers of received messages are made available
+func (tpt *TCPTransport) GetRecvQueue() chan []byte {
+	return tpt.RecvQueue
+}
+
+// ReturnRX gives a RX buffer back to the RX pool of the transport. Reassembled
+// and rendezvous messages are not allocated from the pool and are simply
+// released.
+func (tpt *TCPTransport) ReturnRX(rx []byte) error {
+	if tpt.heapRX.remove(rx) {
+		return nil
+	}
+	return tpt.RxPool.Return(rx)
+}
+
+// Fini cleanly finalizes a TCP transport: the listener and the connections,
+// including the ones of the clients, are closed, which stops the threads of
+// the transport
 func (tpt *TCPTransport) Fini() {
-	// todo: implementation here
+	err := tpt.Close()
+	if err != nil {
+		tpt.log.Error("unable to finalize transport", ErrorField(err))
+	}
 }
 
 // SendTermMsg is a helper function that sends a termination message,
@@ -739,7 +1625,7 @@ func (tpt *TCPTransport) SendTermMsg(src string, dst string) error {
 	}
 	err := tpt.SendMsg(hdr, nil)
 	if err != nil {
-		return fmt.Errorf("unable to send termination message: %s", err)
+		return fmt.Errorf("unable to send termination message: %w", err)
 	}
 
 	return nil
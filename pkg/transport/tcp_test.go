@@ -1,8 +1,17 @@
 package transport
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 const (
@@ -10,6 +19,34 @@ const (
 	msg1       = "message 1"
 	msg2       = "message 2"
 	allDoneMsg = "All done."
+
+	fragPort    = 44445
+	rndvPort    = 44446
+	fragMsgSize = 3 * 1024 * 1024
+
+	redirectPortLow = 44480
+	spreadPortLow   = 44484
+
+	multiClientsPort = 44490
+	numClients       = 3
+
+	completionFragPort = 44492
+	completionRndvPort = 44493
+
+	taggedFragPort = 44494
+	taggedRndvPort = 44495
+
+	ctxConnectPort   = 44496
+	ctxHandshakePort = 44497
+	ctxAcceptPort    = 44498
+	ctxTimeout       = 300 * time.Millisecond
+
+	refusedPort    = 44499
+	peerClosedPort = 44500
+
+	rndvOrderPort = 44502
+	mixedMTUPort  = 44503
+	rndvLimitPort = 44504
 )
 
 func doServer(t *testing.T) {
@@ -22,10 +59,11 @@ func doServer(t *testing.T) {
 		PortHigh:  44444,
 		Accept:    true,
 	}
-	tcp := cfg.Init()
-	if tcp == nil {
-		t.Fatalf("unable to instantiate TCP transport")
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
 	}
+	defer finiOnceClosed(tcp)
 
 	log.Println("Server test: Connection accepted")
 
@@ -77,10 +115,11 @@ func doClient(t *testing.T) {
 		PortLow:   44444,
 		Accept:    false,
 	}
-	tcp := cfg.Init()
-	if tcp == nil {
-		t.Fatalf("unable to instantiate TCP transport")
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
 	}
+	defer tcp.Close()
 
 	log.Printf("(%s) Connecting to server...", id)
 	serverID, err := tcp.Connect(clientID)
@@ -122,8 +161,13 @@ func doClient(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unable to send termination message: %s", err)
 	}
+}
 
-	tcp.Close()
+// finiOnceClosed waits until the remote side closes the connection of a
+// transport, so that the messages sent to it are received, and finalizes it
+func finiOnceClosed(tcp *TCPTransport) {
+	<-tcp.done
+	tcp.Fini()
 }
 
 func TestTCP(t *testing.T) {
@@ -131,3 +175,928 @@ func TestTCP(t *testing.T) {
 
 	doClient(t)
 }
+
+// largeMsg returns a message larger than the MTU
+func largeMsg() []byte {
+	msg := make([]byte, fragMsgSize)
+	for i := range msg {
+		msg[i] = byte(i % 251)
+	}
+	return msg
+}
+
+func doLargeMsgServer(t *testing.T, port uint16, done chan bool) {
+	defer close(done)
+
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   port,
+		PortHigh:  port,
+		Accept:    true,
+	}
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Errorf("unable to instantiate TCP transport: %s", err)
+		return
+	}
+	defer tcp.Fini()
+
+	// The large message must be reassembled and delivered before the small
+	// message sent right after it
+	expected := [][]byte{largeMsg(), []byte(msg1)}
+	for i := range expected {
+		rx := <-tcp.RecvQueue
+		data, err := tcp.ExtractPayload(rx)
+		if err != nil {
+			t.Errorf("unable to extract payload: %s", err)
+			return
+		}
+		if !bytes.Equal(data, expected[i]) {
+			t.Errorf("message %d corrupted or out of order (%d bytes)", i, len(data))
+			return
+		}
+		err = tcp.ReturnRX(rx)
+		if err != nil {
+			t.Errorf("unable to return RX: %s", err)
+			return
+		}
+	}
+}
+
+// sendLargeMsg connects to the server and sends a large message followed by
+// a small one
+func sendLargeMsg(t *testing.T, cfg TCPTransportCfg) *TCPTransport {
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	_, err = tcp.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	err = tcp.SendMsg(hdr, largeMsg())
+	if err != nil {
+		t.Fatalf("unable to send large message: %s", err)
+	}
+	err = tcp.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send small message: %s", err)
+	}
+	return tcp
+}
+
+func TestTCPFragmentation(t *testing.T) {
+	done := make(chan bool)
+	go doLargeMsgServer(t, fragPort, done)
+
+	// Disable the rendezvous protocol so the large message is fragmented
+	cfg := TCPTransportCfg{
+		Interface:      "127.0.0.1",
+		PortLow:        fragPort,
+		EagerThreshold: -1,
+	}
+	client := sendLargeMsg(t, cfg)
+	defer client.Close()
+
+	<-done
+}
+
+// fragRXs returns the RX buffers of the fragments of a payload
+func fragRXs(t *testing.T, payload []byte, seq uint64) [][]byte {
+	var rxs [][]byte
+	hdr := TCPHeader{
+		MsgType: FRAGMSG,
+		Src:     clientID,
+	}
+	chunkSize := defaultMTU - payloadOffset - fragHdrLen
+	err := fragment(payload, DATAMSG, chunkSize, seq, func(i int, frag []byte) error {
+		rx := make([]byte, defaultMTU)
+		setHeader(rx, hdr)
+		setPayload(rx, frag)
+		rxs = append(rxs, rx)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to fragment message: %s", err)
+	}
+	return rxs
+}
+
+func TestReassembler(t *testing.T) {
+	var tcp TCPTransport
+	payload := make([]byte, 3*defaultMTU)
+	peers := fragPeers(clientID, "")
+	r := newReassembler(int64(len(payload)), int64(len(payload)))
+
+	// Duplicate fragments are rejected
+	rxs := fragRXs(t, payload, 0)
+	for i, rx := range rxs {
+		frag, _ := tcp.ExtractPayload(rx)
+		_, msg, err := r.add(rx, peers, frag)
+		if err != nil {
+			t.Fatalf("unable to add fragment %d: %s", i, err)
+		}
+		if i == len(rxs)-1 && msg == nil {
+			t.Fatal("message not reassembled")
+		}
+		if i == 0 {
+			_, msg, err = r.add(rx, peers, frag)
+			if err == nil || msg != nil {
+				t.Fatal("duplicate fragment accepted")
+			}
+		}
+	}
+
+	// Messages above the maximum size are not allocated
+	rxs = fragRXs(t, make([]byte, len(payload)+1), 1)
+	frag, _ := tcp.ExtractPayload(rxs[0])
+	_, _, err := r.add(rxs[0], peers, frag)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("oversized message accepted: %v", err)
+	}
+
+	// The size of the message must match the number of fragments
+	rxs = fragRXs(t, payload, 2)
+	frag, _ = tcp.ExtractPayload(rxs[0])
+	binary.LittleEndian.PutUint32(frag[fragNumFragsOffset:], 1)
+	_, _, err = r.add(rxs[0], peers, frag)
+	if err == nil {
+		t.Fatal("message larger than its fragments accepted")
+	}
+
+	// Messages beyond the size available for reassembly are dropped
+	rxs = fragRXs(t, payload, 3)
+	frag, _ = tcp.ExtractPayload(rxs[0])
+	r.add(rxs[0], peers, frag)
+	small := fragRXs(t, []byte(msg1), 4)
+	frag, _ = tcp.ExtractPayload(small[0])
+	_, _, err = r.add(small[0], peers, frag)
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("message beyond the reassembly limit accepted: %v", err)
+	}
+
+	// Partial messages are freed once disconnected
+	r.drop(peers)
+	if len(r.msgs) != 0 || r.pending != 0 {
+		t.Fatal("partial message not freed")
+	}
+	_, msg, err := r.add(small[0], peers, frag)
+	if err != nil || msg == nil {
+		t.Fatalf("unable to reassemble message once partial messages are freed: %v", err)
+	}
+}
+
+func TestTCPRendezvous(t *testing.T) {
+	done := make(chan bool)
+	go doLargeMsgServer(t, rndvPort, done)
+
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   rndvPort,
+	}
+	client := sendLargeMsg(t, cfg)
+	defer client.Close()
+
+	<-done
+}
+
+// expectMsg checks the next message received by a transport
+func expectMsg(t *testing.T, tcp *TCPTransport, expected []byte) {
+	rx := <-tcp.RecvQueue
+	data, err := tcp.ExtractPayload(rx)
+	if err != nil {
+		t.Fatalf("unable to extract payload: %s", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("message corrupted or out of order (%d bytes instead of %d)", len(data), len(expected))
+	}
+	tcp.ReturnRX(rx)
+}
+
+func TestTCPRendezvousOrder(t *testing.T) {
+	serverCfg := TCPTransportCfg{
+		Interface:          "127.0.0.1",
+		PortLow:            rndvOrderPort,
+		PortHigh:           rndvOrderPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		MaxMsgSize:         fragMsgSize,
+	}
+	server, err := serverCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer server.Close()
+
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   rndvOrderPort,
+	}
+	client, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer client.Close()
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+
+	// The small message does not overtake the large message waiting for a CTS
+	sent := make(chan error, 1)
+	err = client.SendMsgNotify(hdr, largeMsg(), func(_ int, err error) {
+		sent <- err
+	})
+	if err != nil {
+		t.Fatalf("unable to send large message: %s", err)
+	}
+	err = client.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send small message: %s", err)
+	}
+	expectMsg(t, server, largeMsg())
+	expectMsg(t, server, []byte(msg1))
+	err = <-sent
+	if err != nil {
+		t.Fatalf("large message not sent: %s", err)
+	}
+
+	// Messages above the maximum size of the receiver are rejected without
+	// affecting the following messages
+	err = client.SendMsg(hdr, make([]byte, fragMsgSize+1))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("oversized message not rejected: %v", err)
+	}
+	err = client.SendMsg(hdr, []byte(msg2))
+	if err != nil {
+		t.Fatalf("unable to send small message: %s", err)
+	}
+	expectMsg(t, server, []byte(msg2))
+}
+
+func TestTCPRendezvousLimit(t *testing.T) {
+	serverCfg := TCPTransportCfg{
+		Interface:          "127.0.0.1",
+		PortLow:            rndvLimitPort,
+		PortHigh:           rndvLimitPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		MaxMsgSize:         fragMsgSize,
+		MaxPendingBytes:    fragMsgSize / 2,
+	}
+	server, err := serverCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer server.Close()
+
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   rndvLimitPort,
+	}
+	client, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer client.Close()
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+
+	// The receiver does not post buffers beyond its limit
+	err = client.SendMsg(hdr, largeMsg())
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("message beyond the posted buffers limit not rejected: %v", err)
+	}
+	msg := largeMsg()[:fragMsgSize/2]
+	err = client.SendMsg(hdr, msg)
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	expectMsg(t, server, msg)
+}
+
+func TestTCPMixedMTU(t *testing.T) {
+	serverCfg := TCPTransportCfg{
+		Interface:          "127.0.0.1",
+		PortLow:            mixedMTUPort,
+		PortHigh:           mixedMTUPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+	}
+	server, err := serverCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer server.Close()
+
+	// The messages of the client are reassembled, or received using the
+	// rendezvous protocol, in buffers smaller than the RX buffers of the server
+	cfg := TCPTransportCfg{
+		Interface:      "127.0.0.1",
+		PortLow:        mixedMTUPort,
+		MTU:            1024,
+		EagerThreshold: 2048,
+	}
+	client, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer client.Close()
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	for _, size := range []int{1500, 3000} {
+		msg := bytes.Repeat([]byte("x"), size)
+		err = client.SendMsg(hdr, msg)
+		if err != nil {
+			t.Fatalf("unable to send %d bytes message: %s", size, err)
+		}
+		expectMsg(t, server, msg)
+	}
+	err = client.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send small message: %s", err)
+	}
+	expectMsg(t, server, []byte(msg1))
+}
+
+// newAcceptor creates a transport accepting a connection in a range of ports
+// and waits until it is listening on the expected port
+func newAcceptor(t *testing.T, portLow uint16, portHigh uint16, spread bool, expectedPort uint16) *TCPTransport {
+	cfg := TCPTransportCfg{
+		Interface:          "127.0.0.1",
+		PortLow:            portLow,
+		PortHigh:           portHigh,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		SpreadConns:        spread,
+	}
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	waitAcceptor(t, expectedPort)
+	return tcp
+}
+
+// waitAcceptor waits until a transport is accepting connections on a port
+func waitAcceptor(t *testing.T, port uint16) {
+	for i := 0; i < 100; i++ {
+		idleAcceptors.Lock()
+		_, ok := idleAcceptors.ifaces[port]
+		idleAcceptors.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no transport accepting connections on port %d", port)
+}
+
+// connectRedirected connects to the first port of a range and checks the port
+// on which the connection is eventually established
+func connectRedirected(t *testing.T, port uint16, expectedPort uint16) *TCPTransport {
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   port,
+	}
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	_, err = tcp.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	_, remotePort, err := net.SplitHostPort(tcp.Conn.RemoteAddr().String())
+	if err != nil || remotePort != strconv.Itoa(int(expectedPort)) {
+		t.Fatalf("connected to port %s instead of %d", remotePort, expectedPort)
+	}
+	return tcp
+}
+
+func TestTCPRedirect(t *testing.T) {
+	t.Run("busy", func(t *testing.T) {
+		low := uint16(redirectPortLow)
+		busy := newAcceptor(t, low, low+1, false, low)
+		defer busy.Close()
+		busyClient := connectRedirected(t, low, low)
+		defer busyClient.Close()
+
+		// The first transport is busy and redirects to the second one
+		server := newAcceptor(t, low, low+1, false, low+1)
+		defer server.Close()
+		client := connectRedirected(t, low, low+1)
+		defer client.Close()
+		hdr := TCPHeader{
+			MsgType: DATAMSG,
+			Src:     clientID,
+		}
+		err := client.SendMsg(hdr, []byte(msg1))
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
+		rx := <-server.RecvQueue
+		data, err := server.ExtractPayload(rx)
+		if err != nil {
+			t.Fatalf("unable to extract payload: %s", err)
+		}
+		if string(data) != msg1 {
+			t.Fatalf("received %s instead of %s", string(data), msg1)
+		}
+		server.ReturnRX(rx)
+
+		// All the transports are busy, connecting fails instead of blocking
+		cfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   low,
+		}
+		_, err = newTCPTransport(&cfg).Connect(clientID)
+		if err == nil {
+			t.Fatalf("connection to a busy transport succeeded")
+		}
+	})
+
+	t.Run("spread", func(t *testing.T) {
+		low := uint16(spreadPortLow)
+		spread := newAcceptor(t, low, low+1, true, low)
+		defer spread.Close()
+		idle := newAcceptor(t, low, low+1, false, low+1)
+		defer idle.Close()
+
+		// The first transport redirects clients as long as the second one
+		// is not connected
+		first := connectRedirected(t, low, low+1)
+		defer first.Close()
+		second := connectRedirected(t, low, low)
+		defer second.Close()
+	})
+}
+
+func TestTCPMultipleClients(t *testing.T) {
+	serverCfg := TCPTransportCfg{
+		Interface:          "127.0.0.1",
+		PortLow:            multiClientsPort,
+		PortHigh:           multiClientsPort,
+		Accept:             true,
+		DoNotBlockOnAccept: true,
+		MaxConns:           numClients,
+	}
+	server, err := serverCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer server.Close()
+	waitAcceptor(t, multiClientsPort)
+
+	clients := make(map[string]*TCPTransport)
+	for i := 0; i < numClients; i++ {
+		id := clientID + " " + strconv.Itoa(i)
+		cfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   multiClientsPort,
+		}
+		client, err := cfg.Init()
+		if err != nil {
+			t.Fatalf("unable to instantiate TCP transport: %s", err)
+		}
+		defer client.Close()
+		_, err = client.Connect(id)
+		if err != nil {
+			t.Fatalf("connect failed: %s", err)
+		}
+		clients[id] = client
+
+		hdr := TCPHeader{
+			MsgType: DATAMSG,
+			Src:     id,
+		}
+		err = client.SendMsg(hdr, []byte(id))
+		if err != nil {
+			t.Fatalf("unable to send message: %s", err)
+		}
+	}
+
+	// Each client gets the notification of its channel and the reply to its
+	// own message
+	for i := 0; i < numClients; i++ {
+		select {
+		case c := <-server.AcceptedChannels():
+			if _, ok := clients[c.Remote]; !ok {
+				t.Fatalf("unexpected channel from %s", c.Remote)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("channel %d not notified", i)
+		}
+
+		rx := <-server.RecvQueue
+		src := string(server.ExtractSrc(rx))
+		data, err := server.ExtractPayload(rx)
+		if err != nil {
+			t.Fatalf("unable to extract payload: %s", err)
+		}
+		if string(data) != src {
+			t.Fatalf("received %s from %s", string(data), src)
+		}
+		server.ReturnRX(rx)
+
+		hdr := TCPHeader{
+			MsgType: DATAMSG,
+			Dst:     src,
+		}
+		err = server.SendMsg(hdr, []byte(allDoneMsg+" "+src))
+		if err != nil {
+			t.Fatalf("unable to reply to %s: %s", src, err)
+		}
+	}
+	if server.NumChannels() != numClients {
+		t.Fatalf("%d channels instead of %d", server.NumChannels(), numClients)
+	}
+	for id, client := range clients {
+		rx := <-client.RecvQueue
+		data, err := client.ExtractPayload(rx)
+		if err != nil {
+			t.Fatalf("unable to extract payload: %s", err)
+		}
+		if string(data) != allDoneMsg+" "+id {
+			t.Fatalf("%s received %s", id, string(data))
+		}
+		client.ReturnRX(rx)
+	}
+
+	// Once the maximum number of clients is reached, new clients are turned down
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   multiClientsPort,
+	}
+	_, err = newTCPTransport(&cfg).Connect(clientID)
+	if err == nil {
+		t.Fatalf("connection to a full transport succeeded")
+	}
+
+	// A disconnected client makes room for a new one
+	for id := range clients {
+		err = server.ClosePeer(id)
+		if err != nil {
+			t.Fatalf("unable to close connection of %s: %s", id, err)
+		}
+		break
+	}
+	waitAcceptor(t, multiClientsPort)
+	client := newTCPTransport(&cfg)
+	defer client.Close()
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed after a client disconnected: %s", err)
+	}
+}
+
+func TestTCPSendCompletion(t *testing.T) {
+	tests := []struct {
+		name           string
+		port           uint16
+		eagerThreshold int64
+	}{
+		{
+			name:           "fragmented",
+			port:           completionFragPort,
+			eagerThreshold: -1,
+		},
+		{
+			name: "rendezvous",
+			port: completionRndvPort,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan bool)
+			go doLargeMsgServer(t, tt.port, done)
+
+			cfg := TCPTransportCfg{
+				Interface:      "127.0.0.1",
+				PortLow:        tt.port,
+				EagerThreshold: tt.eagerThreshold,
+			}
+			tcp, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate TCP transport: %s", err)
+			}
+			defer tcp.Close()
+			_, err = tcp.Connect(clientID)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+
+			type completion struct {
+				size int
+				err  error
+			}
+			completions := make(chan completion, 2)
+			notify := func(size int, err error) {
+				completions <- completion{size: size, err: err}
+			}
+			hdr := TCPHeader{
+				MsgType: DATAMSG,
+				Src:     clientID,
+			}
+			// Each message is notified once, with the size of its payload
+			for _, m := range [][]byte{largeMsg(), []byte(msg1)} {
+				err = tcp.SendMsgNotify(hdr, m, notify)
+				if err != nil {
+					t.Fatalf("unable to send message: %s", err)
+				}
+				c := <-completions
+				if c.err != nil {
+					t.Fatalf("send failed: %s", c.err)
+				}
+				if c.size != len(m) {
+					t.Fatalf("%d bytes sent instead of %d", c.size, len(m))
+				}
+			}
+
+			<-done
+			select {
+			case c := <-completions:
+				t.Fatalf("unexpected completion of %d bytes", c.size)
+			default:
+			}
+		})
+	}
+}
+
+func TestTCPTagged(t *testing.T) {
+	tests := []struct {
+		name           string
+		port           uint16
+		eagerThreshold int64
+	}{
+		{
+			name:           "fragmented",
+			port:           taggedFragPort,
+			eagerThreshold: -1,
+		},
+		{
+			name: "rendezvous",
+			port: taggedRndvPort,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCfg := TCPTransportCfg{
+				Interface:          "127.0.0.1",
+				PortLow:            tt.port,
+				PortHigh:           tt.port,
+				Accept:             true,
+				DoNotBlockOnAccept: true,
+			}
+			server, err := serverCfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate TCP transport: %s", err)
+			}
+			defer server.Close()
+			waitAcceptor(t, tt.port)
+
+			cfg := TCPTransportCfg{
+				Interface:      "127.0.0.1",
+				PortLow:        tt.port,
+				EagerThreshold: tt.eagerThreshold,
+			}
+			client, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate TCP transport: %s", err)
+			}
+			defer client.Close()
+			_, err = client.Connect(clientID)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+
+			// The type of the message is preserved whether it fits in a
+			// single frame or not
+			hdr := TCPHeader{
+				MsgType: TAGMSG,
+				Src:     clientID,
+			}
+			msgs := [][]byte{largeMsg(), []byte(msg1)}
+			for i, m := range msgs {
+				err = client.SendMsg(hdr, TaggedPayload(uint64(i), m))
+				if err != nil {
+					t.Fatalf("unable to send tagged message: %s", err)
+				}
+
+				rx := <-server.RecvQueue
+				if ExtractMsgType(rx) != TAGMSG {
+					t.Fatalf("%s message received instead of %s", ExtractMsgType(rx), TAGMSG)
+				}
+				payload, err := server.ExtractPayload(rx)
+				if err != nil {
+					t.Fatalf("unable to extract payload: %s", err)
+				}
+				tag, data, err := SplitTaggedPayload(payload)
+				if err != nil {
+					t.Fatalf("unable to extract tag: %s", err)
+				}
+				if tag != uint64(i) || !bytes.Equal(data, m) {
+					t.Fatalf("message %d corrupted (tag %d, %d bytes)", i, tag, len(data))
+				}
+				server.ReturnRX(rx)
+			}
+		})
+	}
+}
+
+func TestTCPContext(t *testing.T) {
+	t.Run("connect", func(t *testing.T) {
+		// Nothing listens on the port, the retries must stop with the context
+		clientCfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   ctxConnectPort,
+			MaxRetry:  100,
+		}
+		client := newTCPTransport(&clientCfg)
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+		defer cancel()
+		start := time.Now()
+		_, err := client.ConnectContext(ctx, clientID)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("connect returned %v instead of %s", err, context.DeadlineExceeded)
+		}
+		if time.Since(start) > 4*ctxTimeout {
+			t.Fatalf("connect returned after %s", time.Since(start))
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		// The remote side accepts the connection but never completes the handshake
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(ctxHandshakePort)))
+		if err != nil {
+			t.Fatalf("unable to listen: %s", err)
+		}
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+			}
+		}()
+
+		clientCfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   ctxHandshakePort,
+		}
+		client := newTCPTransport(&clientCfg)
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+		defer cancel()
+		_, err = client.ConnectContext(ctx, clientID)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("connect returned %v instead of %s", err, context.DeadlineExceeded)
+		}
+		if client.Conn != nil {
+			t.Fatal("connection still in use after the handshake was abandoned")
+		}
+	})
+
+	t.Run("accept", func(t *testing.T) {
+		serverCfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   ctxAcceptPort,
+			PortHigh:  ctxAcceptPort,
+			Accept:    true,
+		}
+		server := newTCPTransport(&serverCfg)
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+		defer cancel()
+		err := server.AcceptContext(ctx, clientID)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("accept returned %v instead of %s", err, context.DeadlineExceeded)
+		}
+
+		// The transport stopped listening
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(ctxAcceptPort)))
+		if err != nil {
+			t.Fatalf("port still in use after the accept was abandoned: %s", err)
+		}
+		listener.Close()
+	})
+
+	t.Run("send", func(t *testing.T) {
+		// Without send thread, the message is never taken from the send queue
+		cfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+		}
+		tpt := newTCPTransport(&cfg)
+		hdr := TCPHeader{
+			MsgType: DATAMSG,
+			Src:     clientID,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+		defer cancel()
+		err := tpt.SendMsgContext(ctx, hdr, []byte(msg1))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("send returned %v instead of %s", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestTCPErrors(t *testing.T) {
+	t.Run("refused", func(t *testing.T) {
+		clientCfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   refusedPort,
+			MaxRetry:  1,
+		}
+		client := newTCPTransport(&clientCfg)
+		_, err := client.Connect(clientID)
+		if !errors.Is(err, ErrConnectionRefused) {
+			t.Fatalf("connect returned %v instead of %s", err, ErrConnectionRefused)
+		}
+		var netErr *NetError
+		if !errors.As(err, &netErr) || netErr.Op != "dial" {
+			t.Fatalf("connect returned %v instead of a dial error", err)
+		}
+	})
+
+	t.Run("pending rendezvous", func(t *testing.T) {
+		// The remote side reads the RTS but closes the connection instead
+		// of answering with a CTS
+		cfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+		}
+		tpt := newTCPTransport(&cfg)
+		conn, remote := net.Pipe()
+		tpt.Conn = conn
+		tpt.reader = newFrameReader(conn, int(tpt.RxPool.ObjSize))
+		go sendThread(tpt)
+		go recvThread(tpt)
+		go io.Copy(ioutil.Discard, remote)
+
+		hdr := TCPHeader{
+			MsgType: DATAMSG,
+			Src:     clientID,
+		}
+		sent := make(chan error, 1)
+		err := tpt.SendMsgNotify(hdr, largeMsg(), func(_ int, err error) {
+			sent <- err
+		})
+		if err != nil {
+			t.Fatalf("unable to send large message: %s", err)
+		}
+		remote.Close()
+		select {
+		case err = <-sent:
+			if !errors.Is(err, ErrPeerClosed) {
+				t.Fatalf("send completed with %v instead of %s", err, ErrPeerClosed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("send not completed once the connection is closed")
+		}
+	})
+
+	t.Run("peer closed", func(t *testing.T) {
+		// The remote side closes the connection without completing the handshake
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(peerClosedPort)))
+		if err != nil {
+			t.Fatalf("unable to listen: %s", err)
+		}
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				conn.Close()
+			}
+		}()
+
+		clientCfg := TCPTransportCfg{
+			Interface: "127.0.0.1",
+			PortLow:   peerClosedPort,
+		}
+		client := newTCPTransport(&clientCfg)
+		_, err = client.Connect(clientID)
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Fatalf("connect returned %v instead of %s", err, ErrPeerClosed)
+		}
+	})
+}
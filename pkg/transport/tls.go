@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// tlsConfig creates the TLS configuration of one side of a connection based
+// on the certificate, key and CA of the transport's configuration
+func (cfg *TCPTransportCfg) tlsConfig(server bool) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	} else if server {
+		return nil, fmt.Errorf("a certificate and a key are required to accept TLS connections")
+	}
+
+	var cas *x509.CertPool
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA certificates: %w", err)
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid CA certificate in %s", cfg.CAFile)
+		}
+	}
+
+	if server {
+		// Clients are authenticated with the CA, if any; with mutual
+		// authentication, clients without a valid certificate are rejected
+		tlsCfg.ClientCAs = cas
+		switch {
+		case cfg.RequireClientCert:
+			if cas == nil {
+				return nil, fmt.Errorf("a CA is required to authenticate clients")
+			}
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case cas != nil:
+			tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			tlsCfg.ClientAuth = tls.NoClientCert
+		}
+		return tlsCfg, nil
+	}
+
+	// The server is authenticated using the CA, or the system's CAs if none
+	// is specified
+	tlsCfg.RootCAs = cas
+	tlsCfg.ServerName = cfg.ServerName
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = cfg.Interface
+	}
+	return tlsCfg, nil
+}
+
+// initTLS loads the certificate, key and CA of the configuration when TLS is
+// enabled, once for all the connections of the transport
+func (tpt *TCPTransport) initTLS() error {
+	if !tpt.Cfg.TLS {
+		return nil
+	}
+	var err error
+	tpt.tlsClient, err = tpt.Cfg.tlsConfig(false)
+	if err != nil {
+		return fmt.Errorf("unable to initialize TLS: %w", err)
+	}
+	if tpt.Cfg.Accept {
+		tpt.tlsServer, err = tpt.Cfg.tlsConfig(true)
+		if err != nil {
+			return fmt.Errorf("unable to initialize TLS: %w", err)
+		}
+	}
+	return nil
+}
+
+// peerIdentity returns the identity of an authenticated peer, i.e., the
+// common name of its certificate or its first DNS name if the common name is
+// not set. It is empty if the certificate of the peer was not verified.
+func peerIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// secureConn performs the TLS handshake over a new connection when TLS is
+// enabled. The connection is closed if the handshake fails.
+func (tpt *TCPTransport) secureConn(conn net.Conn, server bool) (net.Conn, error) {
+	if !tpt.Cfg.TLS {
+		return conn, nil
+	}
+
+	tlsCfg := tpt.tlsClient
+	if server {
+		tlsCfg = tpt.tlsServer
+	}
+	if tlsCfg == nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS is not initialized")
+	}
+	var tlsConn *tls.Conn
+	if server {
+		tlsConn = tls.Server(conn, tlsCfg)
+	} else {
+		tlsConn = tls.Client(conn, tlsCfg)
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	tpt.log.Info("TLS connection established", PeerField(conn.RemoteAddr().String()),
+		Field{Key: "identity", Value: peerIdentity(tlsConn.ConnectionState())})
+	return tlsConn, nil
+}
+
+// connPeerIdentity returns the verified identity of the peer of a connection,
+// which is empty if the connection is not secured using TLS
+func connPeerIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	return peerIdentity(tlsConn.ConnectionState())
+}
+
+// PeerIdentity returns the identity of the peer hosting a remote endpoint, as
+// verified during the TLS handshake, e.g., the common name of its certificate.
+// It is empty if the remote endpoint is unknown or if the peer was not
+// authenticated.
+func (tpt *TCPTransport) PeerIdentity(remoteEPid string) string {
+	conn, err := tpt.connTo(remoteEPid)
+	if err != nil || !conn.hasRemote(remoteEPid) {
+		return ""
+	}
+	return conn.peerIdentity
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	tlsPortLow        = 44470
+	tlsSlowClientPort = 44475
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// createCert creates a certificate signed by a CA, or a self-signed CA
+// certificate if ca is nil, and saves it in a directory
+func createCert(t *testing.T, dir string, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unable to parse certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %s", err)
+	}
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	err = ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("unable to save certificate: %s", err)
+	}
+	err = ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatalf("unable to save key: %s", err)
+	}
+	return c
+}
+
+func doTLSServer(t *testing.T, cfg TCPTransportCfg, expectedIdentity string, done chan bool) {
+	defer close(done)
+
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Errorf("unable to instantiate TCP transport: %s", err)
+		return
+	}
+	defer finiOnceClosed(tcp)
+	if tcp.PeerIdentity(clientID) != expectedIdentity {
+		t.Errorf("client identity is '%s' instead of '%s'", tcp.PeerIdentity(clientID), expectedIdentity)
+		return
+	}
+
+	rx := <-tcp.RecvQueue
+	data, err := tcp.ExtractPayload(rx)
+	if err != nil {
+		t.Errorf("unable to extract payload: %s", err)
+		return
+	}
+	if string(data) != msg1 {
+		t.Errorf("received %s instead of %s", string(data), msg1)
+		return
+	}
+	tcp.ReturnRX(rx)
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Dst:     clientID,
+	}
+	err = tcp.SendMsg(hdr, []byte(allDoneMsg))
+	if err != nil {
+		t.Errorf("unable to send message: %s", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comm-tls-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createCert(t, dir, "ca", nil)
+	server := createCert(t, dir, "server", ca)
+	client := createCert(t, dir, "client", ca)
+
+	tests := []struct {
+		name              string
+		requireClientCert bool
+		clientCert        *testCert
+		successExpected   bool
+		clientIdentity    string
+	}{
+		{
+			name:            "server authentication",
+			successExpected: true,
+		},
+		{
+			name:              "mutual authentication",
+			requireClientCert: true,
+			clientCert:        client,
+			successExpected:   true,
+			clientIdentity:    "client",
+		},
+		{
+			name:              "missing client certificate",
+			requireClientCert: true,
+			successExpected:   false,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := uint16(tlsPortLow + i)
+			serverCfg := TCPTransportCfg{
+				Interface:         "127.0.0.1",
+				PortLow:           port,
+				PortHigh:          port,
+				Accept:            true,
+				TLS:               true,
+				CertFile:          server.certFile,
+				KeyFile:           server.keyFile,
+				CAFile:            ca.certFile,
+				RequireClientCert: tt.requireClientCert,
+			}
+			done := make(chan bool)
+			if tt.successExpected {
+				go doTLSServer(t, serverCfg, tt.clientIdentity, done)
+			} else {
+				// The server keeps waiting for a valid connection
+				serverCfg.DoNotBlockOnAccept = true
+				server, err := serverCfg.Init()
+				if err != nil {
+					t.Fatalf("unable to instantiate TCP transport: %s", err)
+				}
+				defer server.Fini()
+				close(done)
+			}
+
+			cfg := TCPTransportCfg{
+				Interface: "127.0.0.1",
+				PortLow:   port,
+				MaxRetry:  3,
+				TLS:       true,
+				CAFile:    ca.certFile,
+			}
+			if tt.clientCert != nil {
+				cfg.CertFile = tt.clientCert.certFile
+				cfg.KeyFile = tt.clientCert.keyFile
+			}
+			tcp, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate TCP transport: %s", err)
+			}
+			defer tcp.Close()
+			serverID, err := tcp.Connect(clientID)
+			if !tt.successExpected {
+				if err == nil {
+					t.Fatalf("connection succeeded without client certificate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+			if tcp.PeerIdentity(serverID) != "server" {
+				t.Fatalf("server identity is '%s' instead of 'server'", tcp.PeerIdentity(serverID))
+			}
+
+			hdr := TCPHeader{
+				MsgType: DATAMSG,
+				Src:     clientID,
+			}
+			err = tcp.SendMsg(hdr, []byte(msg1))
+			if err != nil {
+				t.Fatalf("unable to send message: %s", err)
+			}
+			rx := <-tcp.RecvQueue
+			data, err := tcp.ExtractPayload(rx)
+			if err != nil {
+				t.Fatalf("unable to extract payload: %s", err)
+			}
+			if string(data) != allDoneMsg {
+				t.Fatalf("received %s instead of %s", string(data), allDoneMsg)
+			}
+			tcp.ReturnRX(rx)
+
+			// The server is finalized once the connection is closed
+			tcp.Close()
+			<-done
+		})
+	}
+}
+
+func TestTLSSlowClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comm-tls-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := createCert(t, dir, "ca", nil)
+	server := createCert(t, dir, "server", ca)
+
+	// The certificate is loaded when the transport is created
+	serverCfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   tlsSlowClientPort,
+		PortHigh:  tlsSlowClientPort,
+		Accept:    true,
+		TLS:       true,
+		CertFile:  filepath.Join(dir, "unknown.crt"),
+		KeyFile:   server.keyFile,
+	}
+	_, err = serverCfg.Init()
+	if err == nil {
+		t.Fatal("transport created with an invalid certificate")
+	}
+	serverCfg.CertFile = server.certFile
+
+	// A client connects but never starts the TLS handshake, which must not
+	// prevent other clients to connect
+	done := make(chan bool)
+	go doTLSServer(t, serverCfg, "", done)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(tlsSlowClientPort))
+	var slow net.Conn
+	for retry := 0; retry < 10; retry++ {
+		slow, err = net.Dial("tcp", addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	defer slow.Close()
+
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   tlsSlowClientPort,
+		TLS:       true,
+		CAFile:    ca.certFile,
+	}
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate TCP transport: %s", err)
+	}
+	defer tcp.Close()
+	start := time.Now()
+	_, err = tcp.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	if time.Since(start) >= tlsHandshakeTimeout {
+		t.Fatalf("connection blocked by the pending handshake for %s", time.Since(start))
+	}
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	err = tcp.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	rx := <-tcp.RecvQueue
+	tcp.ReturnRX(rx)
+	tcp.Close()
+	<-done
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"context"
+)
+
+// Concrete is the interface a concrete transport (e.g., TCP) implements so it
+// can be used by the comm package. All concrete transports exchange messages
+// made of a TCPHeader and a payload; received messages are stored in RX
+// buffers that are made available through the receive queue and must be
+// returned to the transport once consumed.
+type Concrete interface {
+	// ID returns the identifier of the type of concrete transport, e.g., TCPTransportID
+	ID() string
+
+	// Connect connects to a remote endpoint, including the local endpoint ID
+	// in the handshake, and returns the ID of the remote endpoint
+	Connect(epID string) (string, error)
+
+	// Accept accepts an incoming connection on behalf of a local endpoint
+	Accept(epID string) error
+
+	// AcceptsConns specifies whether the transport is configured to accept
+	// incoming connections
+	AcceptsConns() bool
+
+	// IsAcceptingConns checks whether the transport is currently accepting
+	// incoming connections
+	IsAcceptingConns() bool
+
+	// SendMsg sends a message, i.e., a header and a payload
+	SendMsg(hdr TCPHeader, payload []byte) error
+
+	// GetRecvQueue returns the queue where RX buffers of received messages are made available
+	GetRecvQueue() chan []byte
+
+	// ReturnRX gives a RX buffer from the receive queue back to the transport
+	ReturnRX(rx []byte) error
+
+	// ExtractPayload returns the payload from a RX buffer
+	ExtractPayload(rx []byte) ([]byte, error)
+
+	// ExtractSrc returns the ID of the message's source from a RX buffer
+	ExtractSrc(rx []byte) []byte
+
+	// ExtractDest returns the ID of the message's destination from a RX buffer
+	ExtractDest(rx []byte) string
+
+	// Close closes the current connection associated to the transport
+	Close() error
+
+	// Fini cleanly finalizes the transport
+	Fini()
+}
+
+// Multiplexer is the interface implemented by concrete transports able to
+// multiplex many endpoint-to-endpoint channels over a single connection
+type Multiplexer interface {
+	// AddEndpoint makes a local endpoint reachable through the transport
+	AddEndpoint(epID string)
+
+	// ConnectEP opens a channel between a local endpoint and a remote
+	// endpoint, reusing the existing connection when there is one, and
+	// returns the ID of the remote endpoint
+	ConnectEP(epID string, dstID string) (string, error)
+
+	// NumChannels returns the number of channels currently multiplexed
+	NumChannels() int
+}
+
+// PayloadOwner is the interface implemented by concrete transports able to
+// hand over the payload of received messages, which then remains valid once
+// the RX buffer is returned and does not need to be copied
+type PayloadOwner interface {
+	// TakePayload returns the payload of a RX buffer; the caller becomes
+	// the owner of the returned data
+	TakePayload(rx []byte) ([]byte, error)
+}
+
+// PeerIdentifier is the interface implemented by concrete transports able to
+// authenticate the peers they are connected to, e.g., using TLS certificates
+type PeerIdentifier interface {
+	// PeerIdentity returns the verified identity of the peer hosting a
+	// remote endpoint, empty if the peer is not authenticated
+	PeerIdentity(remoteEPid string) string
+}
+
+// Channel is a channel between a local and a remote endpoint
+type Channel struct {
+	// Local is the ID of the local endpoint
+	Local string
+	// Remote is the ID of the remote endpoint
+	Remote string
+}
+
+// PeerAcceptor is the interface implemented by concrete transports able to
+// accept connections from several clients at the same time
+type PeerAcceptor interface {
+	// AcceptedChannels returns the queue where the channels opened by
+	// remote endpoints are notified, nil if the transport does not accept
+	// more than one client
+	AcceptedChannels() <-chan Channel
+
+	// ClosePeer closes the connection of the client hosting a remote endpoint
+	ClosePeer(remoteEPid string) error
+}
+
+// ContextConnector is the interface implemented by concrete transports whose
+// connections can be bounded or cancelled using a context. Once the context
+// is done, the connection is abandoned and the error of the context is
+// returned, e.g., context.DeadlineExceeded.
+type ContextConnector interface {
+	// ConnectContext connects like Connect until the context is done
+	ConnectContext(ctx context.Context, epID string) (string, error)
+
+	// ConnectEPContext connects to a specific remote endpoint like
+	// Multiplexer.ConnectEP until the context is done
+	ConnectEPContext(ctx context.Context, epID string, dstID string) (string, error)
+}
+
+// ContextSender is the interface implemented by concrete transports whose
+// sends can be bounded or cancelled using a context, e.g., while waiting for
+// room in a send queue. Once the context is done, the error of the context
+// is returned, e.g., context.DeadlineExceeded.
+type ContextSender interface {
+	// SendMsgContext sends a message like SendMsg until the context is done
+	SendMsgContext(ctx context.Context, hdr TCPHeader, payload []byte) error
+}
+
+// SendCompletionFunc is invoked once a message is written to the wire, with
+// the number of bytes of payload sent, or with the error that prevented it
+type SendCompletionFunc func(size int, err error)
+
+// CompletionSender is the interface implemented by concrete transports able
+// to notify when a message has actually been sent, rather than only queued
+type CompletionSender interface {
+	// SendMsgNotify sends a message like SendMsg and invokes done once the
+	// message is sent. done is not invoked if an error is returned. The
+	// payload must not be modified until done is invoked.
+	SendMsgNotify(hdr TCPHeader, payload []byte, done SendCompletionFunc) error
+}
@@ -0,0 +1,690 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gvallee/comm/internal/pkg/util"
+	"github.com/gvallee/memory_pool/pkg/pool"
+)
+
+const (
+	// UDPTransportID identifies the UDP transport
+	UDPTransportID = "UDP"
+
+	defaultUDPMaxRetry          = 5
+	defaultUDPMTU               = 1472 - udpHdrLen
+	defaultUDPRetransmitTimeout = 100 * time.Millisecond
+	defaultUDPMaxRetransmits    = 50
+	defaultUDPWindow            = 256
+	udpHandshakeTimeout         = time.Second
+
+	/* Predefined statuses of the UDP transport */
+	udpTransportStatusAccepting = "transport:udp:status:accepting"
+
+	/* Header of the datagrams, followed by the message */
+	udpKindOffset = 0
+	udpSeqOffset  = 8
+	udpHdrLen     = 16
+
+	/* Kinds of datagrams */
+	udpUnreliable = 1
+	udpReliable   = 2
+	udpAck        = 3
+)
+
+// UDPTransportCfg is the structure capturing the configuration of a
+// UDP transport
+type UDPTransportCfg struct {
+	// Interface is the address used to receive datagrams, e.g., '127.0.0.1'
+	Interface string
+
+	// PortLow is the lowest port number that can be used
+	PortLow uint16
+
+	// PortHigh is the high port number that can be used
+	PortHigh uint16
+
+	// Accept specifies whether the UDP transport accepts incoming connections
+	Accept bool
+
+	// DoNotBlockOnAccept specifies if the accept call should be performed
+	// in a separate routine or not, i.e., to avoid the caller to block. If
+	// 'Accept' is not set to true, this will be ignored
+	DoNotBlockOnAccept bool
+
+	// MaxRetry is the maximum of retries when trying to connect
+	MaxRetry int
+
+	// MTU is the requested MTU size, i.e., the maximum size of a message
+	// including its header. Messages are never fragmented. By default,
+	// datagrams fit in a single Ethernet frame.
+	MTU int64
+
+	// Reliable specifies whether messages are acknowledged, retransmitted
+	// when lost and delivered in order. Otherwise, messages may be lost,
+	// duplicated or delivered out of order.
+	Reliable bool
+
+	// RetransmitTimeout is the time after which a message that has not been
+	// acknowledged is sent again
+	RetransmitTimeout time.Duration
+
+	// Logger is the logger of the transport, nothing is logged if not set
+	Logger Logger
+}
+
+// udpPending is a reliable message waiting for an acknowledgement
+type udpPending struct {
+	datagram []byte
+	sent     time.Time
+	retries  int
+}
+
+// UDPTransport is the structure representing a given instantiation of a UDP transport
+type UDPTransport struct {
+	// Cfg is the configuration of the UDP transport
+	Cfg *UDPTransportCfg
+
+	// Status is the current status of the transport
+	Status string
+
+	// log logs the messages of the transport through the logger of the configuration
+	log ComponentLogger
+
+	// Conn is the underlying UDP socket
+	Conn *net.UDPConn
+	// peer is the address of the remote peer when the socket is not connected
+	peer *net.UDPAddr
+	port uint16
+
+	// receiverEPs are the local endpoints reachable through the transport,
+	// the first one being the default target of incoming connection requests
+	receiverEPs []string
+	lock        sync.Mutex
+
+	// sendSeq is the sequence number of the last reliable message sent
+	sendSeq uint64
+	// unacked are the reliable messages waiting for an acknowledgement
+	unacked map[uint64]*udpPending
+	// window limits the number of reliable messages waiting for an acknowledgement
+	window chan struct{}
+	// recvSeq is the sequence number of the last reliable message delivered
+	recvSeq uint64
+	// outOfOrder are the reliable messages received ahead of the next expected one
+	outOfOrder map[uint64][]byte
+	// dropDatagram, if set, is used to simulate the loss of datagrams
+	dropDatagram func() bool
+
+	// err is the error returned to the senders once the transport failed,
+	// e.g., when the remote peer does not acknowledge messages anymore
+	err error
+
+	done      chan bool
+	closeOnce sync.Once
+
+	// RX pool
+	RxPool pool.Pool
+	// RecvQueue is the receive queue, accessed by the endpoint to generate RX events
+	RecvQueue chan []byte
+}
+
+// Init creates a new UDP transport based on a configuration
+func (cfg *UDPTransportCfg) Init() (*UDPTransport, error) {
+	var udp UDPTransport
+	udp.Cfg = cfg
+	if udp.Cfg.MaxRetry == 0 {
+		udp.Cfg.MaxRetry = defaultUDPMaxRetry
+	}
+	if udp.Cfg.MTU == 0 {
+		udp.Cfg.MTU = defaultUDPMTU
+	}
+	if udp.Cfg.RetransmitTimeout == 0 {
+		udp.Cfg.RetransmitTimeout = defaultUDPRetransmitTimeout
+	}
+
+	udp.RxPool = pool.Pool{
+		ObjSize:    cfg.MTU,
+		NObj:       defaultNumRX,
+		GrowFactor: 0,
+		Erase:      true,
+	}
+	udp.RxPool.New()
+
+	udp.log = NewComponentLogger(cfg.Logger, "udp")
+	udp.unacked = make(map[uint64]*udpPending)
+	udp.window = make(chan struct{}, defaultUDPWindow)
+	udp.outOfOrder = make(map[uint64][]byte)
+	udp.done = make(chan bool)
+	udp.RecvQueue = make(chan []byte)
+
+	if cfg.Accept {
+		serverID := util.GenerateID()
+		udp.log.Info("waiting for connection", Field{Key: "interface", Value: cfg.Interface})
+		if !cfg.DoNotBlockOnAccept {
+			err := udp.Accept(serverID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to accept incoming connections: %w", err)
+			}
+		} else {
+			go udp.Accept(serverID)
+		}
+	}
+
+	return &udp, nil
+}
+
+func (tpt *UDPTransport) sendDatagram(datagram []byte) error {
+	if tpt.dropDatagram != nil && tpt.dropDatagram() {
+		return nil
+	}
+
+	var err error
+	if tpt.peer != nil {
+		_, err = tpt.Conn.WriteToUDP(datagram, tpt.peer)
+	} else {
+		_, err = tpt.Conn.Write(datagram)
+	}
+	return err
+}
+
+// newDatagram creates a datagram for a message, the reliability header being
+// set by the caller
+func newDatagram(kind uint8, hdr TCPHeader, payload []byte) []byte {
+	datagram := make([]byte, udpHdrLen+payloadOffset+len(payload))
+	datagram[udpKindOffset] = kind
+	setHeader(datagram[udpHdrLen:], hdr)
+	setPayload(datagram[udpHdrLen:], payload)
+	return datagram
+}
+
+// SendMsg sends a message, i.e., a header and payload, in a single datagram.
+// With the reliable mode, the message is kept until it is acknowledged by the
+// remote peer and the call blocks if too many messages are not acknowledged.
+func (tpt *UDPTransport) SendMsg(hdr TCPHeader, payload []byte) error {
+	if tpt == nil || tpt.Conn == nil {
+		return fmt.Errorf("transport not connected")
+	}
+	err := tpt.failure()
+	if err != nil {
+		return err
+	}
+	if int64(payloadOffset+len(payload)) > tpt.Cfg.MTU {
+		return fmt.Errorf("message of %d bytes exceeds the MTU: %w", len(payload), ErrMessageTooLarge)
+	}
+
+	// Connection requests are retried during the handshake
+	if !tpt.Cfg.Reliable || isHandshakeMsg(hdr.MsgType) {
+		return tpt.sendDatagram(newDatagram(udpUnreliable, hdr, payload))
+	}
+
+	select {
+	case tpt.window <- struct{}{}:
+	case <-tpt.done:
+		err = tpt.failure()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("transport closed")
+	}
+	datagram := newDatagram(udpReliable, hdr, payload)
+	tpt.lock.Lock()
+	tpt.sendSeq++
+	seq := tpt.sendSeq
+	binary.LittleEndian.PutUint64(datagram[udpSeqOffset:], seq)
+	tpt.unacked[seq] = &udpPending{
+		datagram: datagram,
+		sent:     time.Now(),
+	}
+	tpt.lock.Unlock()
+
+	return tpt.sendDatagram(datagram)
+}
+
+func (tpt *UDPTransport) sendAck(seq uint64) {
+	ack := make([]byte, udpHdrLen)
+	ack[udpKindOffset] = udpAck
+	binary.LittleEndian.PutUint64(ack[udpSeqOffset:], seq)
+	err := tpt.sendDatagram(ack)
+	if err != nil {
+		tpt.log.Error("unable to send ack", ErrorField(err))
+	}
+}
+
+func (tpt *UDPTransport) handleAck(seq uint64) {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	if _, ok := tpt.unacked[seq]; ok {
+		delete(tpt.unacked, seq)
+		<-tpt.window
+	}
+}
+
+// failure returns the error of the transport if it failed, nil otherwise
+func (tpt *UDPTransport) failure() error {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	return tpt.err
+}
+
+// fail closes the transport after a failure; the error is returned to the
+// senders waiting for the acknowledgement of previous messages and to later
+// sends
+func (tpt *UDPTransport) fail(err error) {
+	tpt.log.Error("transport failed", ErrorField(err))
+	tpt.lock.Lock()
+	if tpt.err == nil {
+		tpt.err = err
+	}
+	tpt.unacked = make(map[uint64]*udpPending)
+	tpt.lock.Unlock()
+	tpt.Close()
+}
+
+func retransmitThread(tpt *UDPTransport) {
+	ticker := time.NewTicker(tpt.Cfg.RetransmitTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tpt.done:
+			return
+		case now := <-ticker.C:
+			var lost error
+			tpt.lock.Lock()
+			for seq, p := range tpt.unacked {
+				if now.Sub(p.sent) < tpt.Cfg.RetransmitTimeout {
+					continue
+				}
+				if p.retries >= defaultUDPMaxRetransmits {
+					// Messages are delivered in order so the
+					// following ones cannot be delivered either
+					lost = fmt.Errorf("message %d lost after %d retransmissions: %w", seq, p.retries, ErrPeerUnreachable)
+					break
+				}
+				p.retries++
+				p.sent = now
+				err := tpt.sendDatagram(p.datagram)
+				if err != nil {
+					tpt.log.Error(fmt.Sprintf("unable to retransmit message %d", seq), ErrorField(err))
+				}
+			}
+			tpt.lock.Unlock()
+			if lost != nil {
+				tpt.fail(lost)
+				return
+			}
+		}
+	}
+}
+
+// AddEndpoint makes a local endpoint reachable through the transport
+func (tpt *UDPTransport) AddEndpoint(epID string) {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for _, id := range tpt.receiverEPs {
+		if id == epID {
+			return
+		}
+	}
+	tpt.receiverEPs = append(tpt.receiverEPs, epID)
+}
+
+// lookupReceiver returns the local endpoint targeted by a connection request;
+// if the target is not specified or unknown, the default endpoint is used
+func (tpt *UDPTransport) lookupReceiver(epID string) string {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	for _, id := range tpt.receiverEPs {
+		if id == epID {
+			return id
+		}
+	}
+	if len(tpt.receiverEPs) == 0 {
+		return ""
+	}
+	return tpt.receiverEPs[0]
+}
+
+func handleUDPConnReq(tpt *UDPTransport, msg []byte) error {
+	remoteEPid := string(tpt.ExtractSrc(msg))
+	localEPid := tpt.lookupReceiver(tpt.ExtractDest(msg))
+	tpt.log.Debug("connection request received", EndpointField(remoteEPid))
+	hdr := TCPHeader{
+		MsgType: CONNACK,
+		Src:     localEPid,
+		Dst:     remoteEPid,
+	}
+	return tpt.SendMsg(hdr, nil)
+}
+
+// deliver handles a message received from the remote peer and returns
+// whether it was handled, i.e., queued to the receive queue for a data message
+func (tpt *UDPTransport) deliver(msg []byte) bool {
+	size, err := msgLen(msg)
+	if err != nil || size > len(msg) || int64(size) > tpt.RxPool.ObjSize {
+		tpt.log.Error("invalid message received")
+		return false
+	}
+
+	msgType := string(msg[msgTypeOffset : msgTypeOffset+msgTypeLen])
+	switch msgType {
+	case DATAMSG, TAGMSG:
+		rx := tpt.RxPool.Get()
+		if rx == nil {
+			tpt.log.Warn("unable to get RX buffer, message dropped")
+			return false
+		}
+		copy(rx, msg[:size])
+		select {
+		case tpt.RecvQueue <- rx:
+		case <-tpt.done:
+			tpt.RxPool.Return(rx)
+			return false
+		}
+	case CONNREQ:
+		err := handleUDPConnReq(tpt, msg)
+		if err != nil {
+			tpt.log.Error("unable to send connection ack", ErrorField(err))
+		}
+	case CONNACK:
+		// Ack of a connection request that was retried during the handshake
+	case TERMMSG:
+		tpt.log.Debug("termination message received", EndpointField(string(tpt.ExtractSrc(msg))))
+	default:
+		tpt.log.Error("unsupported message", MsgTypeField(msgType))
+	}
+	return true
+}
+
+// handleReliable delivers a reliable message, as well as the messages received
+// out of order that can now be delivered in order. Messages are only
+// acknowledged once delivered so that the messages that cannot be delivered,
+// e.g., when no RX buffer is available, are retransmitted.
+func (tpt *UDPTransport) handleReliable(seq uint64, msg []byte) {
+	if seq <= tpt.recvSeq {
+		// Duplicate, the ack was lost
+		tpt.sendAck(seq)
+		return
+	}
+	if seq > tpt.recvSeq+1 {
+		if len(tpt.outOfOrder) < defaultUDPWindow {
+			tpt.outOfOrder[seq] = append([]byte(nil), msg...)
+		}
+		return
+	}
+
+	for tpt.deliver(msg) {
+		tpt.recvSeq++
+		tpt.sendAck(tpt.recvSeq)
+		next, ok := tpt.outOfOrder[tpt.recvSeq+1]
+		if !ok {
+			break
+		}
+		delete(tpt.outOfOrder, tpt.recvSeq+1)
+		msg = next
+	}
+}
+
+func udpRecvThread(tpt *UDPTransport) {
+	buf := make([]byte, udpHdrLen+int(tpt.Cfg.MTU))
+	for {
+		n, addr, err := tpt.Conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-tpt.done:
+				tpt.log.Debug("receive thread terminating")
+				return
+			default:
+				tpt.log.Error("unable to receive datagram", ErrorField(err))
+				continue
+			}
+		}
+		if tpt.peer != nil && (!addr.IP.Equal(tpt.peer.IP) || addr.Port != tpt.peer.Port) {
+			tpt.log.Warn("datagram from unknown peer dropped", PeerField(addr.String()))
+			continue
+		}
+		if n < udpHdrLen {
+			tpt.log.Warn("invalid datagram dropped", PeerField(addr.String()))
+			continue
+		}
+
+		seq := binary.LittleEndian.Uint64(buf[udpSeqOffset:])
+		switch buf[udpKindOffset] {
+		case udpAck:
+			tpt.handleAck(seq)
+		case udpReliable:
+			tpt.handleReliable(seq, buf[udpHdrLen:n])
+		case udpUnreliable:
+			tpt.deliver(buf[udpHdrLen:n])
+		default:
+			tpt.log.Warn(fmt.Sprintf("unknown datagram of kind %d dropped", buf[udpKindOffset]), PeerField(addr.String()))
+		}
+	}
+}
+
+func (tpt *UDPTransport) startThreads() {
+	go udpRecvThread(tpt)
+	go retransmitThread(tpt)
+}
+
+// Accept waits for a connection request on behalf of a local endpoint. The
+// remote peer is then the only one the transport exchanges datagrams with.
+func (tpt *UDPTransport) Accept(epID string) error {
+	if tpt == nil || tpt.Cfg == nil {
+		return fmt.Errorf("corrupted transport object")
+	}
+	if !tpt.Cfg.Accept {
+		return fmt.Errorf("attempting to accept connections on a transport not setup for it")
+	}
+	tpt.Status = udpTransportStatusAccepting
+	tpt.AddEndpoint(epID)
+
+	port := tpt.Cfg.PortLow
+Retry:
+	addr, err := net.ResolveUDPAddr("udp", tpt.Cfg.Interface+":"+strconv.Itoa(int(port)))
+	if err == nil {
+		tpt.Conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		if port < tpt.Cfg.PortHigh {
+			port++
+			goto Retry
+		}
+		return fmt.Errorf("unable to listen for UDP datagrams: %w", err)
+	}
+	tpt.port = port
+	tpt.log.Info("listening", Field{Key: "addr", Value: tpt.Conn.LocalAddr().String()})
+
+	// Wait for the connection request that defines the remote peer
+	buf := make([]byte, udpHdrLen+int(tpt.Cfg.MTU))
+	for {
+		n, addr, err := tpt.Conn.ReadFromUDP(buf)
+		if err != nil {
+			return fmt.Errorf("unable to receive datagram: %w", err)
+		}
+		if n < udpHdrLen+payloadOffset || string(buf[udpHdrLen:udpHdrLen+msgTypeLen]) != CONNREQ {
+			continue
+		}
+		tpt.peer = addr
+		err = handleUDPConnReq(tpt, buf[udpHdrLen:n])
+		if err != nil {
+			return fmt.Errorf("unable to send connection ack: %w", err)
+		}
+		break
+	}
+
+	tpt.startThreads()
+	tpt.log.Info("connection accepted", PeerField(tpt.peer.String()))
+
+	return nil
+}
+
+// Connect sends a connection request to the remote peer, including the ID of
+// the local endpoint, and returns the ID of the remote endpoint
+func (tpt *UDPTransport) Connect(epID string) (string, error) {
+	if tpt == nil || tpt.Cfg == nil {
+		return "", fmt.Errorf("corrupted transport object")
+	}
+
+	portMax := tpt.Cfg.PortHigh
+	if portMax == 0 {
+		portMax = tpt.Cfg.PortLow
+	}
+	for port := tpt.Cfg.PortLow; port <= portMax; port++ {
+		if port == tpt.port {
+			continue
+		}
+		id, err := tpt.connectToPort(epID, port)
+		if err == nil {
+			tpt.log.Info("connected", PeerField(tpt.Conn.RemoteAddr().String()), EndpointField(id))
+			return id, nil
+		}
+		tpt.log.Debug(fmt.Sprintf("connection on port %d failed, trying the next port", port), ErrorField(err))
+	}
+	return "", fmt.Errorf("unable to connect to remote endpoint")
+}
+
+func (tpt *UDPTransport) connectToPort(epID string, port uint16) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp", tpt.Cfg.Interface+":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return "", err
+	}
+	tpt.Conn, err = net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return "", err
+	}
+
+	// Connection requests may be lost so they are retried until a
+	// connection ack is received
+	hdr := TCPHeader{
+		MsgType: CONNREQ,
+		Src:     epID,
+	}
+	buf := make([]byte, udpHdrLen+int(tpt.Cfg.MTU))
+	for retry := 0; retry <= tpt.Cfg.MaxRetry; retry++ {
+		err = tpt.SendMsg(hdr, nil)
+		if err != nil {
+			continue
+		}
+		tpt.Conn.SetReadDeadline(time.Now().Add(udpHandshakeTimeout))
+		n, err := tpt.Conn.Read(buf)
+		if err != nil {
+			// The remote peer may not be ready yet
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				time.Sleep(udpHandshakeTimeout)
+			}
+			continue
+		}
+		if n < udpHdrLen+payloadOffset {
+			continue
+		}
+		msg := buf[udpHdrLen:n]
+		if string(msg[msgTypeOffset:msgTypeOffset+msgTypeLen]) != CONNACK {
+			continue
+		}
+		tpt.Conn.SetReadDeadline(time.Time{})
+		serverID := string(tpt.ExtractSrc(msg))
+		tpt.startThreads()
+		return serverID, nil
+	}
+
+	tpt.Conn.Close()
+	tpt.Conn = nil
+	return "", fmt.Errorf("no connection ack received")
+}
+
+// ID returns the identifier of the UDP transport type
+func (tpt *UDPTransport) ID() string {
+	return UDPTransportID
+}
+
+// AcceptsConns specifies whether the transport is configured to accept incoming connections
+func (tpt *UDPTransport) AcceptsConns() bool {
+	return tpt.Cfg != nil && tpt.Cfg.Accept
+}
+
+// IsAcceptingConns checks the status of the transport and if incoming connections can be accepted
+func (tpt *UDPTransport) IsAcceptingConns() bool {
+	if tpt == nil {
+		return false
+	}
+	return tpt.Status == udpTransportStatusAccepting
+}
+
+// GetRecvQueue returns the queue where the RX buffers of received messages are made available
+func (tpt *UDPTransport) GetRecvQueue() chan []byte {
+	return tpt.RecvQueue
+}
+
+// ReturnRX gives a RX buffer back to the RX pool of the transport
+func (tpt *UDPTransport) ReturnRX(rx []byte) error {
+	return tpt.RxPool.Return(rx)
+}
+
+// ExtractPayload returns the payload from a RX buffer. The caller is in charge
+// of copying the data as required since the data returned by this function is
+// not guaranteed once the RX buffer is returned.
+func (tpt *UDPTransport) ExtractPayload(rx []byte) ([]byte, error) {
+	size, err := msgLen(rx)
+	if err != nil {
+		return nil, err
+	}
+	return rx[payloadOffset:size], nil
+}
+
+// ExtractSrc returns the ID of the message's source from a RX buffer
+func (tpt *UDPTransport) ExtractSrc(rx []byte) []byte {
+	return bytes.TrimRight(rx[srcOffset:srcOffset+srcLen], "\x00")
+}
+
+// ExtractDest returns the ID of the message's destination from a RX buffer
+func (tpt *UDPTransport) ExtractDest(rx []byte) string {
+	return strings.TrimRight(string(rx[dstOffset:dstOffset+dstLen]), "\x00")
+}
+
+// SendTermMsg is a helper function that sends a termination message
+func (tpt *UDPTransport) SendTermMsg(src string, dst string) error {
+	hdr := TCPHeader{
+		MsgType: TERMMSG,
+		Src:     src,
+		Dst:     dst,
+	}
+	err := tpt.SendMsg(hdr, nil)
+	if err != nil {
+		return fmt.Errorf("unable to send termination message: %w", err)
+	}
+	return nil
+}
+
+// Close closes the UDP socket and stops the threads of the transport
+func (tpt *UDPTransport) Close() error {
+	var err error
+	tpt.closeOnce.Do(func() {
+		close(tpt.done)
+		if tpt.Conn != nil {
+			err = tpt.Conn.Close()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("unable to close UDP socket: %w", err)
+	}
+	return nil
+}
+
+// Fini cleanly finalizes a UDP transport
+func (tpt *UDPTransport) Fini() {
+	tpt.Close()
+}
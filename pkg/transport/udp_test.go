@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	udpPortLow         = 44460
+	udpUnreachablePort = 44470
+	udpNoRXPort        = 44471
+)
+
+func udpMsg(i int) string {
+	return fmt.Sprintf("message %d", i)
+}
+
+func doUDPServer(t *testing.T, port uint16, reliable bool, numMsgs int, done chan bool) {
+	defer close(done)
+
+	cfg := UDPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   port,
+		PortHigh:  port,
+		Accept:    true,
+		Reliable:  reliable,
+	}
+	udp, err := cfg.Init()
+	if err != nil {
+		t.Errorf("unable to instantiate UDP transport: %s", err)
+		return
+	}
+	defer udp.Close()
+
+	// With the reliable mode, messages must all be received in order
+	for i := 0; i < numMsgs; i++ {
+		rx := <-udp.RecvQueue
+		data, err := udp.ExtractPayload(rx)
+		if err != nil {
+			t.Errorf("unable to extract payload: %s", err)
+			return
+		}
+		if string(data) != udpMsg(i) {
+			t.Errorf("received %s instead of %s", string(data), udpMsg(i))
+			return
+		}
+		udp.ReturnRX(rx)
+	}
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Dst:     clientID,
+	}
+	err = udp.SendMsg(hdr, []byte(allDoneMsg))
+	if err != nil {
+		t.Errorf("unable to send message: %s", err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	tests := []struct {
+		name     string
+		reliable bool
+		numMsgs  int
+		lossy    bool
+	}{
+		{
+			name:     "unreliable",
+			reliable: false,
+			numMsgs:  1,
+		},
+		{
+			name:     "reliable",
+			reliable: true,
+			numMsgs:  20,
+		},
+		{
+			name:     "reliable with losses",
+			reliable: true,
+			numMsgs:  20,
+			lossy:    true,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := uint16(udpPortLow + i)
+			done := make(chan bool)
+			go doUDPServer(t, port, tt.reliable, tt.numMsgs, done)
+
+			cfg := UDPTransportCfg{
+				Interface: "127.0.0.1",
+				PortLow:   port,
+				Reliable:  tt.reliable,
+			}
+			udp, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate UDP transport: %s", err)
+			}
+			defer udp.Close()
+			if tt.lossy {
+				// Every fourth datagram sent by the client is lost
+				var count uint64
+				udp.dropDatagram = func() bool {
+					return atomic.AddUint64(&count, 1)%4 == 0
+				}
+			}
+
+			_, err = udp.Connect(clientID)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+
+			hdr := TCPHeader{
+				MsgType: DATAMSG,
+				Src:     clientID,
+			}
+			for i := 0; i < tt.numMsgs; i++ {
+				err = udp.SendMsg(hdr, []byte(udpMsg(i)))
+				if err != nil {
+					t.Fatalf("unable to send message %d: %s", i, err)
+				}
+			}
+
+			rx := <-udp.RecvQueue
+			data, err := udp.ExtractPayload(rx)
+			if err != nil {
+				t.Fatalf("unable to extract payload: %s", err)
+			}
+			if string(data) != allDoneMsg {
+				t.Fatalf("received %s instead of %s", string(data), allDoneMsg)
+			}
+			udp.ReturnRX(rx)
+
+			<-done
+		})
+	}
+}
+
+// connectUDP connects a client to a server accepting a connection on a port
+func connectUDP(t *testing.T, port uint16, reliable bool) (*UDPTransport, *UDPTransport) {
+	serverCfg := UDPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   port,
+		PortHigh:  port,
+		Accept:    true,
+		Reliable:  reliable,
+	}
+	servers := make(chan *UDPTransport, 1)
+	go func() {
+		server, err := serverCfg.Init()
+		if err != nil {
+			t.Errorf("unable to instantiate UDP transport: %s", err)
+			close(servers)
+			return
+		}
+		servers <- server
+	}()
+
+	clientCfg := UDPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   port,
+		Reliable:  reliable,
+	}
+	client, err := clientCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate UDP transport: %s", err)
+	}
+	_, err = client.Connect(clientID)
+	if err != nil {
+		client.Close()
+		t.Fatalf("connect failed: %s", err)
+	}
+	server, ok := <-servers
+	if !ok {
+		client.Close()
+		t.FailNow()
+	}
+	return client, server
+}
+
+func TestUDPNoRXBuffer(t *testing.T) {
+	client, server := connectUDP(t, udpNoRXPort, true)
+	defer client.Close()
+	defer server.Close()
+
+	// The message received while no RX buffer is available is not
+	// acknowledged and is therefore delivered once retransmitted
+	var rxs [][]byte
+	for rx := server.RxPool.Get(); rx != nil; rx = server.RxPool.Get() {
+		rxs = append(rxs, rx)
+	}
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	err := client.SendMsg(hdr, []byte(msg1))
+	if err != nil {
+		t.Fatalf("unable to send message: %s", err)
+	}
+	time.Sleep(2 * defaultUDPRetransmitTimeout)
+	for _, rx := range rxs {
+		server.RxPool.Return(rx)
+	}
+
+	select {
+	case rx := <-server.RecvQueue:
+		data, err := server.ExtractPayload(rx)
+		if err != nil {
+			t.Fatalf("unable to extract payload: %s", err)
+		}
+		if string(data) != msg1 {
+			t.Fatalf("received %s instead of %s", string(data), msg1)
+		}
+		server.ReturnRX(rx)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message acknowledged without being delivered")
+	}
+}
+
+func TestUDPPeerUnreachable(t *testing.T) {
+	serverCfg := UDPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   udpUnreachablePort,
+		PortHigh:  udpUnreachablePort,
+		Accept:    true,
+		Reliable:  true,
+	}
+	servers := make(chan *UDPTransport, 1)
+	go func() {
+		server, err := serverCfg.Init()
+		if err != nil {
+			t.Errorf("unable to instantiate UDP transport: %s", err)
+			close(servers)
+			return
+		}
+		servers <- server
+	}()
+
+	clientCfg := UDPTransportCfg{
+		Interface:         "127.0.0.1",
+		PortLow:           udpUnreachablePort,
+		Reliable:          true,
+		RetransmitTimeout: time.Millisecond,
+	}
+	client, err := clientCfg.Init()
+	if err != nil {
+		t.Fatalf("unable to instantiate UDP transport: %s", err)
+	}
+	defer client.Close()
+	// All the datagrams sent by the client once connected are lost
+	var lost int32
+	client.dropDatagram = func() bool {
+		return atomic.LoadInt32(&lost) == 1
+	}
+	_, err = client.Connect(clientID)
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	server, ok := <-servers
+	if !ok {
+		t.FailNow()
+	}
+	defer server.Close()
+	atomic.StoreInt32(&lost, 1)
+
+	// The transport fails once the message is not acknowledged despite the
+	// retransmissions, including for the senders blocked on the window
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     clientID,
+	}
+	for i := 0; i <= defaultUDPWindow; i++ {
+		err = client.SendMsg(hdr, []byte(udpMsg(i)))
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrPeerUnreachable) {
+		t.Fatalf("send returned %v instead of %s", err, ErrPeerUnreachable)
+	}
+	err = client.SendMsg(hdr, []byte(msg1))
+	if !errors.Is(err, ErrPeerUnreachable) {
+		t.Fatalf("send after failure returned %v instead of %s", err, ErrPeerUnreachable)
+	}
+}
@@ -0,0 +1,369 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gvallee/comm/internal/pkg/util"
+)
+
+const (
+	// UnixTransportID identifies the Unix domain socket transport
+	UnixTransportID = "UNIX"
+)
+
+// UnixTransportCfg is the structure capturing the configuration of a
+// Unix domain socket transport
+type UnixTransportCfg struct {
+	// Path is the path of the socket; both sides must use the same path.
+	// A path starting with '@' refers to the abstract namespace (Linux
+	// only), in which case no file is created.
+	Path string
+
+	// PathRange is the number of paths that can be used to establish
+	// connections, similarly to a range of ports with TCP: the socket is
+	// bound to the first path not already in use among Path, Path.1, ...,
+	// Path.<PathRange-1>, and connecting tries all of them
+	PathRange int
+
+	// Accept specifies whether the transport accepts incoming connections
+	Accept bool
+
+	// DoNotBlockOnAccept specifies if the accept call should be performed
+	// in a separate routine or not, i.e., to avoid the caller to block. If
+	// 'Accept' is not set to true, this will be ignored
+	DoNotBlockOnAccept bool
+
+	// MaxRetry is the maximum of retries when trying to connect
+	MaxRetry int
+
+	// MTU is the requested MTU size
+	MTU int64
+
+	// EagerThreshold is the size, in bytes, above which data messages are
+	// sent using the rendezvous protocol (see TCPTransportCfg)
+	EagerThreshold int64
+
+	// MaxMsgSize is the maximum size of the messages received as fragments
+	// or using the rendezvous protocol (see TCPTransportCfg)
+	MaxMsgSize int64
+
+	// LegacyWireHeader forces the use of the legacy wire header (see TCPTransportCfg)
+	LegacyWireHeader bool
+
+	// SameUserOnly rejects peers that are not running as the same user than
+	// the local process, based on the credentials of the peer
+	SameUserOnly bool
+
+	// Logger is the logger of the transport, nothing is logged if not set
+	Logger Logger
+}
+
+// PeerCred gathers the credentials of the process on the other side of a
+// Unix domain socket, as reported by the kernel (SO_PEERCRED)
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// UnixTransport is the structure representing a given instantiation of a Unix
+// domain socket transport. Messages are exchanged exactly like with the TCP
+// transport, i.e., same framing, handshake and buffers, only the underlying
+// connection differs.
+type UnixTransport struct {
+	*TCPTransport
+
+	// Cfg is the configuration of the Unix domain socket transport
+	Cfg *UnixTransportCfg
+
+	listener net.Listener
+	// path is the path the transport is listening on, if any
+	path string
+	// peerCred are the credentials of the remote peer, when supported by the platform
+	peerCred *PeerCred
+}
+
+// paths returns all the paths that can be used to establish connections
+func (cfg *UnixTransportCfg) paths() []string {
+	paths := []string{cfg.Path}
+	for i := 1; i < cfg.PathRange; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", cfg.Path, i))
+	}
+	return paths
+}
+
+// isStaleSocket checks whether a path is a socket file left behind by a
+// process that is not listening anymore
+func isStaleSocket(path string) bool {
+	if strings.HasPrefix(path, "@") {
+		// Abstract sockets disappear with the process
+		return false
+	}
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+// listen binds the socket to the first path available
+func (tpt *UnixTransport) listen() error {
+	var err error
+	for _, path := range tpt.Cfg.paths() {
+		tpt.listener, err = net.Listen("unix", path)
+		if err != nil && isStaleSocket(path) {
+			// The socket file was left behind by a process that terminated
+			os.Remove(path)
+			tpt.listener, err = net.Listen("unix", path)
+		}
+		if err == nil {
+			tpt.path = path
+			tpt.log.Info("listening", Field{Key: "addr", Value: tpt.path})
+			return nil
+		}
+	}
+	return fmt.Errorf("listen failed while accepting new Unix connections: %w", err)
+}
+
+// checkPeer gets the credentials of the remote peer and, if requested,
+// makes sure it runs as the same user
+func (tpt *UnixTransport) checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("not a Unix domain socket")
+	}
+	cred, err := getPeerCred(unixConn)
+	if err != nil {
+		if tpt.Cfg.SameUserOnly {
+			return fmt.Errorf("unable to identify peer: %w", err)
+		}
+		tpt.log.Warn("unable to identify peer", ErrorField(err))
+		return nil
+	}
+	if tpt.Cfg.SameUserOnly && cred.UID != uint32(os.Getuid()) {
+		return fmt.Errorf("peer (PID %d) is running as user %d", cred.PID, cred.UID)
+	}
+	tpt.log.Info("peer identified", Field{Key: "pid", Value: cred.PID},
+		Field{Key: "uid", Value: cred.UID}, Field{Key: "gid", Value: cred.GID})
+	tpt.lock.Lock()
+	tpt.peerCred = cred
+	tpt.lock.Unlock()
+	return nil
+}
+
+func doUnixAccept(serverID string, tpt *UnixTransport) error {
+	err := tpt.Accept(serverID)
+	if err != nil {
+		tpt.log.Error("unable to accept incoming connections", ErrorField(err))
+		return err
+	}
+	return nil
+}
+
+// Init creates a new Unix domain socket transport based on a configuration
+func (cfg *UnixTransportCfg) Init() (*UnixTransport, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("undefined socket path")
+	}
+
+	var tpt UnixTransport
+	tpt.Cfg = cfg
+	tpt.TCPTransport = newTCPTransport(&TCPTransportCfg{
+		Accept:             cfg.Accept,
+		DoNotBlockOnAccept: cfg.DoNotBlockOnAccept,
+		MaxRetry:           cfg.MaxRetry,
+		MTU:                cfg.MTU,
+		EagerThreshold:     cfg.EagerThreshold,
+		MaxMsgSize:         cfg.MaxMsgSize,
+		LegacyWireHeader:   cfg.LegacyWireHeader,
+	})
+	tpt.log = NewComponentLogger(cfg.Logger, "unix")
+
+	if cfg.Accept {
+		// The socket is bound right away so that the path is known, and
+		// skipped when connecting, even if the accept is not blocking
+		err := tpt.listen()
+		if err != nil {
+			return nil, err
+		}
+		serverID := util.GenerateID()
+		tpt.log.Info("waiting for connection", Field{Key: "addr", Value: tpt.path})
+		if !cfg.DoNotBlockOnAccept {
+			err := tpt.Accept(serverID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to accept incoming connections: %w", err)
+			}
+		} else {
+			go doUnixAccept(serverID, &tpt)
+		}
+	}
+
+	return &tpt, nil
+}
+
+// ID returns the identifier of the Unix domain socket transport type
+func (tpt *UnixTransport) ID() string {
+	return UnixTransportID
+}
+
+// PeerCred returns the credentials of the remote peer, nil if they are unknown
+func (tpt *UnixTransport) PeerCred() *PeerCred {
+	tpt.lock.Lock()
+	defer tpt.lock.Unlock()
+	return tpt.peerCred
+}
+
+// Accept accepts an incoming connection on the socket of the transport
+func (tpt *UnixTransport) Accept(epID string) error {
+	return tpt.AcceptContext(context.Background(), epID)
+}
+
+// AcceptContext accepts an incoming connection like Accept until the context
+// is done, in which case the transport stops listening and the error of the
+// context is returned
+func (tpt *UnixTransport) AcceptContext(ctx context.Context, epID string) error {
+	if tpt == nil || tpt.Cfg == nil {
+		return fmt.Errorf("corrupted transport object")
+	}
+
+	if !tpt.Cfg.Accept {
+		return fmt.Errorf("attempting to accept connections on a transport not setup for it")
+	}
+	tpt.Status = tcpTransportStatusAccepting
+	tpt.AddEndpoint(epID)
+
+	if tpt.listener == nil {
+		err := tpt.listen()
+		if err != nil {
+			return err
+		}
+	}
+
+	stopWatching := watchListener(ctx, tpt.listener)
+	defer stopWatching()
+	for {
+		conn, err := tpt.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("accept failed: %w", err)
+		}
+		err = tpt.checkPeer(conn)
+		if err == nil {
+			err = tpt.acceptConn(conn)
+			if err == nil {
+				return nil
+			}
+		}
+		// The connection is rejected or closed before the end of the
+		// handshake, e.g., when checking if the socket is stale; we wait
+		// for the next one
+		tpt.log.Warn("connection rejected", ErrorField(err))
+		conn.Close()
+	}
+}
+
+// Connect connects to the socket of a remote transport, including the
+// endpoint ID of the caller in the connection handshake
+func (tpt *UnixTransport) Connect(epID string) (string, error) {
+	return tpt.ConnectEP(epID, "")
+}
+
+// ConnectContext connects like Connect until the context is done, in which
+// case the error of the context is returned
+func (tpt *UnixTransport) ConnectContext(ctx context.Context, epID string) (string, error) {
+	return tpt.ConnectEPContext(ctx, epID, "")
+}
+
+// ConnectEP connects a local endpoint to a specific remote endpoint; if the
+// transport is already connected, the new channel is multiplexed over the
+// existing connection
+func (tpt *UnixTransport) ConnectEP(epID string, dstID string) (string, error) {
+	return tpt.ConnectEPContext(context.Background(), epID, dstID)
+}
+
+// ConnectEPContext connects a local endpoint to a specific remote endpoint
+// like ConnectEP until the context is done, in which case the error of the
+// context is returned
+func (tpt *UnixTransport) ConnectEPContext(ctx context.Context, epID string, dstID string) (string, error) {
+	if tpt == nil || tpt.Cfg == nil {
+		return "", fmt.Errorf("corrupted transport object")
+	}
+
+	if tpt.Conn != nil {
+		return tpt.openChannel(ctx, epID, dstID)
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for retry := 0; ; retry++ {
+		for _, path := range tpt.Cfg.paths() {
+			// Make sure we do not connect to ourselves
+			if path == tpt.path {
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, "unix", path)
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if err != nil {
+				lastErr = netError("dial", path, err)
+				continue
+			}
+			err = tpt.checkPeer(conn)
+			if err != nil {
+				tpt.log.Warn("connection rejected", PeerField(path), ErrorField(err))
+				conn.Close()
+				lastErr = err
+				continue
+			}
+			return tpt.connectConn(ctx, conn, epID, dstID)
+		}
+		if retry >= tpt.TCPTransport.Cfg.MaxRetry {
+			if lastErr == nil {
+				return "", fmt.Errorf("unable to connect to %s", tpt.Cfg.Path)
+			}
+			return "", fmt.Errorf("unable to connect to %s: %w", tpt.Cfg.Path, lastErr)
+		}
+		err := waitRetry(ctx, retry)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Close closes the current connection associated to the transport and stops
+// listening for incoming connections
+func (tpt *UnixTransport) Close() error {
+	if tpt.listener != nil {
+		// The socket file, if any, is removed when closing the listener
+		tpt.listener.Close()
+	}
+	if tpt.Conn == nil {
+		return nil
+	}
+	err := tpt.Conn.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close Unix connection: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func checkPeerCred(t *testing.T, unix *UnixTransport) bool {
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	cred := unix.PeerCred()
+	if cred == nil {
+		t.Errorf("credentials of the peer are unknown")
+		return false
+	}
+	// Both sides of the connection are in the same process
+	if cred.PID != int32(os.Getpid()) || cred.UID != uint32(os.Getuid()) {
+		t.Errorf("invalid peer credentials: PID %d, UID %d", cred.PID, cred.UID)
+		return false
+	}
+	return true
+}
+
+func doUnixServer(t *testing.T, path string, done chan bool) {
+	defer close(done)
+
+	cfg := UnixTransportCfg{
+		Path:         path,
+		Accept:       true,
+		SameUserOnly: true,
+	}
+	unix, err := cfg.Init()
+	if err != nil {
+		t.Errorf("unable to instantiate Unix transport: %s", err)
+		return
+	}
+	if !checkPeerCred(t, unix) {
+		return
+	}
+
+	rx := <-unix.RecvQueue
+	data, err := unix.ExtractPayload(rx)
+	if err != nil {
+		t.Errorf("unable to extract payload: %s", err)
+		return
+	}
+	if string(data) != msg1 {
+		t.Errorf("received %s instead of %s", string(data), msg1)
+		return
+	}
+	unix.ReturnRX(rx)
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Dst:     clientID,
+	}
+	err = unix.SendMsg(hdr, []byte(allDoneMsg))
+	if err != nil {
+		t.Errorf("unable to send message: %s", err)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "comm-unix-test")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name      string
+		path      string
+		linuxOnly bool
+	}{
+		{
+			name: "filesystem socket",
+			path: filepath.Join(dir, "comm.sock"),
+		},
+		{
+			name:      "abstract socket",
+			path:      "@comm-unix-test",
+			linuxOnly: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && runtime.GOOS != "linux" {
+				t.Skip("abstract sockets are only supported on Linux")
+			}
+			done := make(chan bool)
+			go doUnixServer(t, tt.path, done)
+
+			cfg := UnixTransportCfg{
+				Path: tt.path,
+			}
+			unix, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate Unix transport: %s", err)
+			}
+			defer unix.Close()
+			serverID, err := unix.Connect(clientID)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+			if len(serverID) == 0 {
+				t.Fatalf("connect did not return the server's endpoint ID")
+			}
+			if !checkPeerCred(t, unix) {
+				return
+			}
+
+			hdr := TCPHeader{
+				MsgType: DATAMSG,
+				Src:     clientID,
+			}
+			err = unix.SendMsg(hdr, []byte(msg1))
+			if err != nil {
+				t.Fatalf("unable to send message: %s", err)
+			}
+
+			rx := <-unix.RecvQueue
+			data, err := unix.ExtractPayload(rx)
+			if err != nil {
+				t.Fatalf("unable to extract payload: %s", err)
+			}
+			if string(data) != allDoneMsg {
+				t.Fatalf("received %s instead of %s", string(data), allDoneMsg)
+			}
+			unix.ReturnRX(rx)
+
+			<-done
+		})
+	}
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gvallee/comm/internal/pkg/util"
+)
+
+const (
+	// WebSocketTransportID identifies the WebSocket transport
+	WebSocketTransportID = "WEBSOCKET"
+
+	// webSocketProtocol is the subprotocol negotiated during the opening handshake
+	webSocketProtocol = "comm"
+
+	wsHandshakeTimeout = 10 * time.Second
+)
+
+// WebSocketTransportCfg is the structure capturing the configuration of a
+// WebSocket transport
+type WebSocketTransportCfg struct {
+	// URL is the URL of the remote WebSocket endpoint, e.g.,
+	// 'ws://host:8080/comm' or 'wss://host/comm'
+	URL string
+
+	// Address is the address on which the HTTP server accepting incoming
+	// connections listens, e.g., ':8080'. If not set, no server is started
+	// and the transport, which is a http.Handler, must be served by the
+	// application, e.g., on an existing HTTP server.
+	Address string
+
+	// Path is the path on which incoming connections are accepted when the
+	// transport runs its own HTTP server, '/' by default
+	Path string
+
+	// Accept specifies whether the transport accepts incoming connections
+	Accept bool
+
+	// DoNotBlockOnAccept specifies if the accept call should be performed
+	// in a separate routine or not, i.e., to avoid the caller to block. If
+	// 'Accept' is not set to true, this will be ignored
+	DoNotBlockOnAccept bool
+
+	// MaxRetry is the maximum of retries when trying to connect
+	MaxRetry int
+
+	// MTU is the requested MTU size
+	MTU int64
+
+	// EagerThreshold is the size, in bytes, above which data messages are
+	// sent using the rendezvous protocol (see TCPTransportCfg)
+	EagerThreshold int64
+
+	// MaxMsgSize is the maximum size of the messages received as fragments
+	// or using the rendezvous protocol (see TCPTransportCfg)
+	MaxMsgSize int64
+
+	// LegacyWireHeader forces the use of the legacy wire header (see TCPTransportCfg)
+	LegacyWireHeader bool
+
+	// Proxy returns the URL of the HTTP proxy to use to reach a given URL,
+	// nil if none. If not set, the proxy is defined by the environment
+	// (HTTP_PROXY, HTTPS_PROXY and NO_PROXY)
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// TLSConfig is the TLS configuration used to connect to 'wss' URLs
+	TLSConfig *tls.Config
+
+	// Header gathers additional headers sent with the opening handshake,
+	// e.g., to authenticate with a load balancer
+	Header http.Header
+
+	// Logger is the logger of the transport, nothing is logged if not set
+	Logger Logger
+}
+
+// WebSocketTransport is the structure representing a given instantiation of a
+// WebSocket transport. Messages are exchanged exactly like with the TCP
+// transport, the frames being carried by binary WebSocket messages, so that
+// peers can communicate through HTTP proxies and load balancers.
+type WebSocketTransport struct {
+	*TCPTransport
+
+	// Cfg is the configuration of the WebSocket transport
+	Cfg *WebSocketTransportCfg
+
+	server   *http.Server
+	listener net.Listener
+
+	// accepting specifies whether an incoming connection is being established
+	accepting bool
+	// accepted receives the outcome of the establishment of incoming connections
+	accepted chan error
+	connLock sync.Mutex
+}
+
+func doWebSocketAccept(serverID string, tpt *WebSocketTransport) error {
+	err := tpt.Accept(serverID)
+	if err != nil {
+		tpt.log.Error("unable to accept incoming connections", ErrorField(err))
+		return err
+	}
+	return nil
+}
+
+// Init creates a new WebSocket transport based on a configuration
+func (cfg *WebSocketTransportCfg) Init() (*WebSocketTransport, error) {
+	if !cfg.Accept && cfg.URL == "" {
+		return nil, fmt.Errorf("undefined URL")
+	}
+
+	var tpt WebSocketTransport
+	tpt.Cfg = cfg
+	tpt.TCPTransport = newTCPTransport(&TCPTransportCfg{
+		Accept:             cfg.Accept,
+		DoNotBlockOnAccept: cfg.DoNotBlockOnAccept,
+		MaxRetry:           cfg.MaxRetry,
+		MTU:                cfg.MTU,
+		EagerThreshold:     cfg.EagerThreshold,
+		MaxMsgSize:         cfg.MaxMsgSize,
+		LegacyWireHeader:   cfg.LegacyWireHeader,
+	})
+	tpt.log = NewComponentLogger(cfg.Logger, "websocket")
+	tpt.accepted = make(chan error, 1)
+
+	if cfg.Accept {
+		if cfg.Address != "" {
+			// The server is started right away so that the handler is
+			// ready even if the accept is not blocking
+			err := tpt.listen()
+			if err != nil {
+				return nil, err
+			}
+		}
+		serverID := util.GenerateID()
+		tpt.log.Info("waiting for connection")
+		if !cfg.DoNotBlockOnAccept {
+			err := tpt.Accept(serverID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to accept incoming connections: %w", err)
+			}
+		} else {
+			go doWebSocketAccept(serverID, &tpt)
+		}
+	}
+
+	return &tpt, nil
+}
+
+// listen starts the HTTP server accepting incoming connections
+func (tpt *WebSocketTransport) listen() error {
+	var err error
+	tpt.listener, err = net.Listen("tcp", tpt.Cfg.Address)
+	if err != nil {
+		return fmt.Errorf("listen failed while accepting new WebSocket connections: %w", err)
+	}
+	path := tpt.Cfg.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, tpt)
+	tpt.server = &http.Server{Handler: mux}
+	go tpt.server.Serve(tpt.listener)
+	tpt.log.Info("listening", Field{Key: "addr", Value: tpt.listener.Addr().String() + path})
+	return nil
+}
+
+// ID returns the identifier of the WebSocket transport type
+func (tpt *WebSocketTransport) ID() string {
+	return WebSocketTransportID
+}
+
+// headerContains checks whether a comma-separated header includes a token
+func headerContains(h http.Header, name string, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ServeHTTP upgrades an incoming HTTP request to a WebSocket and establishes
+// the connection of the transport over it
+func (tpt *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !tpt.Cfg.Accept {
+		http.Error(w, "not accepting connections", http.StatusForbidden)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "invalid WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+
+	// The transport supports a single connection
+	tpt.connLock.Lock()
+	if tpt.accepting || tpt.Conn != nil {
+		tpt.connLock.Unlock()
+		http.Error(w, "already connected", http.StatusServiceUnavailable)
+		return
+	}
+	tpt.accepting = true
+	tpt.connLock.Unlock()
+
+	conn, err := tpt.upgrade(w, r, key)
+	if err == nil {
+		err = tpt.acceptConn(conn)
+		if err != nil {
+			conn.Close()
+		}
+	}
+
+	tpt.connLock.Lock()
+	tpt.accepting = false
+	tpt.connLock.Unlock()
+	if err != nil {
+		tpt.log.Warn("connection rejected", ErrorField(err))
+		return
+	}
+	select {
+	case tpt.accepted <- nil:
+	default:
+	}
+}
+
+// upgrade completes the opening handshake on the server side
+func (tpt *WebSocketTransport) upgrade(w http.ResponseWriter, r *http.Request, key string) (net.Conn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, fmt.Errorf("HTTP server does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to hijack connection: %w", err)
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", webSocketProtocol) {
+		resp += "Sec-WebSocket-Protocol: " + webSocketProtocol + "\r\n"
+	}
+	_, err = brw.WriteString(resp + "\r\n")
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to complete handshake: %w", err)
+	}
+	tpt.log.Info("connection upgraded", PeerField(r.RemoteAddr))
+
+	return newWSConn(conn, brw.Reader, false), nil
+}
+
+// Accept waits for an incoming connection, established by the HTTP server
+// serving the transport
+func (tpt *WebSocketTransport) Accept(epID string) error {
+	return tpt.AcceptContext(context.Background(), epID)
+}
+
+// AcceptContext waits for an incoming connection like Accept until the
+// context is done, in which case the error of the context is returned
+func (tpt *WebSocketTransport) AcceptContext(ctx context.Context, epID string) error {
+	if tpt == nil || tpt.Cfg == nil {
+		return fmt.Errorf("corrupted transport object")
+	}
+
+	if !tpt.Cfg.Accept {
+		return fmt.Errorf("attempting to accept connections on a transport not setup for it")
+	}
+	tpt.Status = tcpTransportStatusAccepting
+	tpt.AddEndpoint(epID)
+
+	if tpt.Cfg.Address != "" && tpt.server == nil {
+		err := tpt.listen()
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case err := <-tpt.accepted:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dialProxy establishes a tunnel to a host through a HTTP proxy
+func dialProxy(ctx context.Context, proxyURL *url.URL, host string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy does not send anything else before the tunnel is used
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused tunnel: %s", proxyURL.Host, resp.Status)
+	}
+	return conn, nil
+}
+
+// dial connects to the remote WebSocket endpoint, possibly through a proxy,
+// and performs the opening handshake until the context is done
+func (tpt *WebSocketTransport) dial(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(tpt.Cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %w", tpt.Cfg.URL, err)
+	}
+	// The request is handled as a regular HTTP request, e.g., to select the proxy
+	reqURL := *u
+	secure := false
+	port := "80"
+	switch u.Scheme {
+	case "ws", "http":
+		reqURL.Scheme = "http"
+	case "wss", "https":
+		reqURL.Scheme = "https"
+		secure = true
+		port = "443"
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme %s", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	key, err := wsNewKey()
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &reqURL,
+		Host:   u.Host,
+		Header: make(http.Header),
+	}
+	for name, values := range tpt.Cfg.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", webSocketProtocol)
+
+	proxy := tpt.Cfg.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	proxyURL, err := proxy(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get proxy: %w", err)
+	}
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = dialProxy(ctx, proxyURL, host)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, netError("dial", host, err)
+	}
+
+	// The deadline covers both the TLS and the opening handshakes, which are
+	// interrupted once the context is done
+	conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	stopWatching := watchConn(ctx, conn)
+	defer stopWatching()
+	if secure {
+		tlsCfg := &tls.Config{}
+		if tpt.Cfg.TLSConfig != nil {
+			tlsCfg = tpt.Cfg.TLSConfig.Clone()
+		}
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsCfg)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	// Only the header of the response is read, the connection being closed
+	// if the handshake fails
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake with %s failed: %s", tpt.Cfg.URL, resp.Status)
+	}
+
+	return newWSConn(conn, reader, true), nil
+}
+
+// Connect connects to the remote WebSocket endpoint, including the endpoint
+// ID of the caller in the connection handshake
+func (tpt *WebSocketTransport) Connect(epID string) (string, error) {
+	return tpt.ConnectEP(epID, "")
+}
+
+// ConnectContext connects like Connect until the context is done, in which
+// case the error of the context is returned
+func (tpt *WebSocketTransport) ConnectContext(ctx context.Context, epID string) (string, error) {
+	return tpt.ConnectEPContext(ctx, epID, "")
+}
+
+// ConnectEP connects a local endpoint to a specific remote endpoint; if the
+// transport is already connected, the new channel is multiplexed over the
+// existing connection
+func (tpt *WebSocketTransport) ConnectEP(epID string, dstID string) (string, error) {
+	return tpt.ConnectEPContext(context.Background(), epID, dstID)
+}
+
+// ConnectEPContext connects a local endpoint to a specific remote endpoint
+// like ConnectEP until the context is done, in which case the error of the
+// context is returned. The context is checked between connection attempts
+// and bounds the connection handshake.
+func (tpt *WebSocketTransport) ConnectEPContext(ctx context.Context, epID string, dstID string) (string, error) {
+	if tpt == nil || tpt.Cfg == nil {
+		return "", fmt.Errorf("corrupted transport object")
+	}
+
+	if tpt.Conn != nil {
+		return tpt.openChannel(ctx, epID, dstID)
+	}
+
+	for retry := 0; ; retry++ {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		conn, err := tpt.dial(ctx)
+		if err == nil {
+			return tpt.connectConn(ctx, conn, epID, dstID)
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if retry >= tpt.TCPTransport.Cfg.MaxRetry {
+			return "", fmt.Errorf("unable to connect to %s: %w", tpt.Cfg.URL, err)
+		}
+		err = waitRetry(ctx, retry)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Close closes the current connection associated to the transport and stops
+// the HTTP server, if any
+func (tpt *WebSocketTransport) Close() error {
+	if tpt.server != nil {
+		tpt.server.Close()
+	}
+	if tpt.Conn == nil {
+		return nil
+	}
+	err := tpt.Conn.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close WebSocket connection: %w", err)
+	}
+
+	return nil
+}
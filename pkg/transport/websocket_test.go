@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// connPair creates both sides of a local TCP connection
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+	c1, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	c2, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %s", err)
+	}
+	return c1, c2
+}
+
+func TestWSConn(t *testing.T) {
+	for _, size := range []int{10, 200, 70000} {
+		c1, c2 := connPair(t)
+		client := newWSConn(c1, bufio.NewReader(c1), true)
+		server := newWSConn(c2, bufio.NewReader(c2), false)
+
+		data := bytes.Repeat([]byte("x"), size)
+		go func() {
+			// A ping is transparently answered by the receiver
+			client.writeFrame(wsOpPing, []byte("ping"))
+			client.Write(data)
+		}()
+		buf := make([]byte, size)
+		_, err := io.ReadFull(server, buf)
+		if err != nil {
+			t.Fatalf("unable to read %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("%d bytes message corrupted", size)
+		}
+
+		// The pong is consumed before the reply
+		go server.Write(data[:size/2])
+		_, err = io.ReadFull(client, buf[:size/2])
+		if err != nil {
+			t.Fatalf("unable to read reply: %s", err)
+		}
+		if !bytes.Equal(buf[:size/2], data[:size/2]) {
+			t.Fatalf("%d bytes reply corrupted", size/2)
+		}
+
+		go server.Close()
+		_, err = client.Read(buf)
+		if err != io.EOF {
+			t.Fatalf("close frame not detected: %v", err)
+		}
+		c1.Close()
+	}
+}
+
+// newTestProxy creates a HTTP proxy only supporting tunnels
+func newTestProxy(t *testing.T) (*httptest.Server, *int32) {
+	var used int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only tunnels are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("unable to hijack connection: %s", err)
+			dst.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		atomic.StoreInt32(&used, 1)
+		go io.Copy(dst, conn)
+		io.Copy(conn, dst)
+	}))
+	return proxy, &used
+}
+
+func doWebSocketServer(t *testing.T, server *WebSocketTransport, done chan bool) {
+	defer close(done)
+
+	rx := <-server.RecvQueue
+	data, err := server.ExtractPayload(rx)
+	if err != nil {
+		t.Errorf("unable to extract payload: %s", err)
+		return
+	}
+	if string(data) != msg1 {
+		t.Errorf("received %s instead of %s", string(data), msg1)
+		return
+	}
+	server.ReturnRX(rx)
+
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Dst:     clientID,
+	}
+	err = server.SendMsg(hdr, []byte(allDoneMsg))
+	if err != nil {
+		t.Errorf("unable to send message: %s", err)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	tests := []struct {
+		name     string
+		secure   bool
+		useProxy bool
+	}{
+		{
+			name: "direct",
+		},
+		{
+			name:     "through proxy",
+			useProxy: true,
+		},
+		{
+			name:   "secure",
+			secure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCfg := WebSocketTransportCfg{
+				Accept:             true,
+				DoNotBlockOnAccept: true,
+			}
+			server, err := serverCfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate WebSocket transport: %s", err)
+			}
+			var ts *httptest.Server
+			if tt.secure {
+				ts = httptest.NewTLSServer(server)
+			} else {
+				ts = httptest.NewServer(server)
+			}
+			defer ts.Close()
+			done := make(chan bool)
+			go doWebSocketServer(t, server, done)
+
+			cfg := WebSocketTransportCfg{
+				URL: "ws" + strings.TrimPrefix(ts.URL, "http") + "/comm",
+				Proxy: func(*http.Request) (*url.URL, error) {
+					return nil, nil
+				},
+			}
+			if tt.secure {
+				cfg.TLSConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+			}
+			var proxyUsed *int32
+			if tt.useProxy {
+				var proxy *httptest.Server
+				proxy, proxyUsed = newTestProxy(t)
+				defer proxy.Close()
+				proxyURL, _ := url.Parse(proxy.URL)
+				cfg.Proxy = http.ProxyURL(proxyURL)
+			}
+			ws, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate WebSocket transport: %s", err)
+			}
+			_, err = ws.Connect(clientID)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+			if proxyUsed != nil && atomic.LoadInt32(proxyUsed) == 0 {
+				t.Fatalf("connection did not go through the proxy")
+			}
+
+			hdr := TCPHeader{
+				MsgType: DATAMSG,
+				Src:     clientID,
+			}
+			err = ws.SendMsg(hdr, []byte(msg1))
+			if err != nil {
+				t.Fatalf("unable to send message: %s", err)
+			}
+			rx := <-ws.RecvQueue
+			data, err := ws.ExtractPayload(rx)
+			if err != nil {
+				t.Fatalf("unable to extract payload: %s", err)
+			}
+			if string(data) != allDoneMsg {
+				t.Fatalf("received %s instead of %s", string(data), allDoneMsg)
+			}
+			ws.ReturnRX(rx)
+
+			<-done
+
+			// The transport only supports a single connection
+			second, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate WebSocket transport: %s", err)
+			}
+			conn, err := second.dial(context.Background())
+			if err == nil {
+				conn.Close()
+				t.Fatalf("a second connection was accepted")
+			}
+		})
+	}
+}
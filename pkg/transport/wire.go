@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Messages are stored in TX/RX buffers using a fixed layout with string
+// message types and endpoint IDs (see payloadOffset), which is also the
+// legacy wire format. When both peers support it, which is negotiated during
+// the CONNREQ/CONNACK handshake, messages are instead sent with a compact
+// binary header:
+//
+//	 0: magic (2 bytes)
+//	 2: version (1 byte)
+//	 3: message type (1 byte)
+//	 4: flags (1 byte), followed by 3 reserved bytes
+//	 8: source endpoint ID (64-bit hash)
+//	16: destination endpoint ID (64-bit hash)
+//	24: sequence number of the frame on the connection
+//	32: payload length (4 bytes)
+//
+// Endpoint IDs are replaced by a hash of the ID; the full IDs are learned from
+// the frames using the legacy format, which is always used for the handshake
+// messages. Receivers detect the format of each frame so old and new peers
+// can interoperate.
+const (
+	legacyWireVersion  = 0
+	compactWireVersion = 1
+	// wireVersion is the most recent version of the wire header supported
+	wireVersion = compactWireVersion
+
+	wireMagic0 = 0xC7
+	wireMagic1 = 0x4D
+
+	wireMagicOffset   = 0
+	wireVersionOffset = 2
+	wireTypeOffset    = 3
+	wireFlagsOffset   = 4
+	wireSrcOffset     = 8
+	wireDstOffset     = 16
+	wireSeqOffset     = 24
+	wireLenOffset     = 32
+	compactHdrLen     = 36
+)
+
+// wireMsgTypes are the numeric identifiers of the message types in compact headers
+var wireMsgTypes = []string{
+	INVALID,
+	DATAMSG,
+	CONNREQ,
+	CONNACK,
+	CONNRED,
+	TERMMSG,
+	FRAGMSG,
+	RTSMSG,
+	CTSMSG,
+	RNDVMSG,
+	TAGMSG,
+}
+
+func wireMsgType(msgType string) (uint8, bool) {
+	for i, t := range wireMsgTypes {
+		if t == msgType {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+// isHandshakeMsg checks whether a message type is used to establish
+// connections, in which case the legacy format is always used
+func isHandshakeMsg(msgType string) bool {
+	return msgType == CONNREQ || msgType == CONNACK || msgType == CONNRED
+}
+
+func idHash(id string) uint64 {
+	if id == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// wireCodec encodes and decodes the headers of the messages sent over a
+// connection based on the negotiated version of the wire header
+type wireCodec struct {
+	// version is the negotiated version of the wire header
+	version uint32
+
+	lock sync.Mutex
+	// ids are the endpoint IDs known by both peers, indexed by their hash
+	ids map[uint64]string
+
+	// sendSeq is the sequence number of the next frame sent, only accessed by the send thread
+	sendSeq uint64
+	// recvSeq is the sequence number of the next frame received, only accessed by the receiver
+	recvSeq uint64
+}
+
+func newWireCodec() *wireCodec {
+	return &wireCodec{
+		ids: make(map[uint64]string),
+	}
+}
+
+func (c *wireCodec) getVersion() uint32 {
+	return atomic.LoadUint32(&c.version)
+}
+
+func (c *wireCodec) setVersion(version uint32) {
+	atomic.StoreUint32(&c.version, version)
+}
+
+// negotiateWireVersion returns the version of the wire header to use based
+// on the version supported by the remote peer
+func negotiateWireVersion(local uint32, remote []byte) uint32 {
+	if len(remote) == 0 {
+		// The peer only supports the legacy format
+		return legacyWireVersion
+	}
+	if uint32(remote[0]) < local {
+		return uint32(remote[0])
+	}
+	return local
+}
+
+// wireVersionPayload returns the payload of the handshake messages advertising
+// a version of the wire header. Nothing is advertised for the legacy format,
+// like peers that do not support the compact header.
+func wireVersionPayload(version uint32) []byte {
+	if version == legacyWireVersion {
+		return nil
+	}
+	return []byte{byte(version)}
+}
+
+// supportedWireVersion returns the most recent version of the wire header the
+// transport is configured to use
+func (tpt *TCPTransport) supportedWireVersion() uint32 {
+	if tpt.Cfg.LegacyWireHeader {
+		return legacyWireVersion
+	}
+	return wireVersion
+}
+
+// setWireVersion sets the version of the wire header based on the version
+// returned by the remote peer in a CONNACK
+func (tpt *TCPTransport) setWireVersion(rx []byte) {
+	payload, err := tpt.ExtractPayload(rx)
+	if err != nil {
+		tpt.log.Error("unable to extract payload from CONNACK", ErrorField(err))
+		return
+	}
+	tpt.wire.setVersion(negotiateWireVersion(tpt.supportedWireVersion(), payload))
+}
+
+func (c *wireCodec) learn(ids ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, id := range ids {
+		if id != "" {
+			c.ids[idHash(id)] = id
+		}
+	}
+}
+
+// knows checks whether an endpoint ID can be replaced by its hash
+func (c *wireCodec) knows(id string) bool {
+	if id == "" {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ids[idHash(id)] == id
+}
+
+func (c *wireCodec) lookup(hash uint64) (string, bool) {
+	if hash == 0 {
+		return "", true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id, ok := c.ids[hash]
+	return id, ok
+}
+
+// writeMsg writes the message stored in a TX buffer as a single frame, using
+// the compact header when possible. Only the used part of the buffer is sent
+// and the header of the TX buffer is not valid anymore once the function returns.
+func (c *wireCodec) writeMsg(w io.Writer, tx []byte, data ...[]byte) error {
+	size, err := msgLen(tx)
+	if err != nil {
+		return err
+	}
+	if size > len(tx) {
+		return fmt.Errorf("message of %d bytes exceeds the TX buffer: %w", size, ErrMessageTooLarge)
+	}
+	msgType := string(tx[msgTypeOffset : msgTypeOffset+msgTypeLen])
+	src := strings.TrimRight(string(tx[srcOffset:srcOffset+srcLen]), "\x00")
+	dst := strings.TrimRight(string(tx[dstOffset:dstOffset+dstLen]), "\x00")
+	seq := c.sendSeq
+	c.sendSeq++
+
+	t, ok := wireMsgType(msgType)
+	if c.getVersion() < compactWireVersion || !ok || isHandshakeMsg(msgType) || !c.knows(src) || !c.knows(dst) {
+		c.learn(src, dst)
+		return writeFrame(w, tx[:size], data...)
+	}
+
+	// The compact header is set right before the payload so the frame is
+	// contiguous in the TX buffer
+	hdr := tx[payloadOffset-compactHdrLen : payloadOffset]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	hdr[wireMagicOffset] = wireMagic0
+	hdr[wireMagicOffset+1] = wireMagic1
+	hdr[wireVersionOffset] = compactWireVersion
+	hdr[wireTypeOffset] = t
+	binary.LittleEndian.PutUint64(hdr[wireSrcOffset:], idHash(src))
+	binary.LittleEndian.PutUint64(hdr[wireDstOffset:], idHash(dst))
+	binary.LittleEndian.PutUint64(hdr[wireSeqOffset:], seq)
+	binary.LittleEndian.PutUint32(hdr[wireLenOffset:], uint32(size-payloadOffset))
+	return writeFrame(w, tx[payloadOffset-compactHdrLen:size], data...)
+}
+
+// readMsg reads the next frame into a RX buffer, which always ends up with the
+// legacy layout, regardless of the format used on the wire. It returns the
+// size of the message in the RX buffer.
+func (c *wireCodec) readMsg(reader *frameReader, rx []byte) (int, error) {
+	n, err := reader.readLen()
+	if err != nil {
+		return 0, err
+	}
+	seq := c.recvSeq
+	c.recvSeq++
+
+	magic, err := reader.peek(1)
+	if err != nil {
+		return 0, fmt.Errorf("truncated frame: %w", err)
+	}
+	if magic[0] != wireMagic0 {
+		if n < payloadOffset || n > len(rx) {
+			return 0, fmt.Errorf("invalid frame length: %d", n)
+		}
+		err = reader.readFull(rx[:n])
+		if err != nil {
+			return 0, err
+		}
+		c.learn(strings.TrimRight(string(rx[srcOffset:srcOffset+srcLen]), "\x00"),
+			strings.TrimRight(string(rx[dstOffset:dstOffset+dstLen]), "\x00"))
+		return n, nil
+	}
+
+	// The frame is read so that the payload directly lands at its place in
+	// the RX buffer, the compact header is then converted
+	size := payloadOffset - compactHdrLen + n
+	if size > len(rx) {
+		return 0, fmt.Errorf("invalid frame length: %d", n)
+	}
+	err = reader.readFull(rx[payloadOffset-compactHdrLen : size])
+	if err != nil {
+		return 0, err
+	}
+	hdr := rx[payloadOffset-compactHdrLen : payloadOffset]
+	if hdr[wireMagicOffset+1] != wireMagic1 || hdr[wireVersionOffset] != compactWireVersion {
+		return 0, fmt.Errorf("unsupported wire header (version %d)", hdr[wireVersionOffset])
+	}
+	if int(binary.LittleEndian.Uint32(hdr[wireLenOffset:])) != n-compactHdrLen {
+		return 0, fmt.Errorf("payload size inconsistent with frame length %d", n)
+	}
+	if binary.LittleEndian.Uint64(hdr[wireSeqOffset:]) != seq {
+		return 0, fmt.Errorf("frame %d received instead of %d", binary.LittleEndian.Uint64(hdr[wireSeqOffset:]), seq)
+	}
+	t := int(hdr[wireTypeOffset])
+	if t >= len(wireMsgTypes) {
+		return 0, fmt.Errorf("unknown message type: %d", t)
+	}
+	src, ok := c.lookup(binary.LittleEndian.Uint64(hdr[wireSrcOffset:]))
+	if !ok {
+		return 0, fmt.Errorf("unknown source endpoint")
+	}
+	dst, ok := c.lookup(binary.LittleEndian.Uint64(hdr[wireDstOffset:]))
+	if !ok {
+		return 0, fmt.Errorf("unknown destination endpoint")
+	}
+
+	for i := 0; i < payloadOffset; i++ {
+		rx[i] = 0
+	}
+	setHeader(rx, TCPHeader{
+		MsgType: wireMsgTypes[t],
+		Src:     src,
+		Dst:     dst,
+	})
+	n = binary.PutUvarint(rx[payloadSizeOffset:payloadOffset], uint64(size-payloadOffset))
+	rx[sizeOfSizeOffset] = uint8(n)
+	return size, nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+const (
+	wirePortLow = 44447
+	serverID    = "I am the server"
+)
+
+func wireMsg(hdr TCPHeader, payload string) []byte {
+	tx := make([]byte, defaultMTU)
+	setHeader(tx, hdr)
+	setPayload(tx, []byte(payload))
+	return tx
+}
+
+func TestWireCodec(t *testing.T) {
+	sender := newWireCodec()
+	sender.setVersion(compactWireVersion)
+	receiver := newWireCodec()
+	receiver.setVersion(compactWireVersion)
+
+	// The handshake always uses the legacy header, which is how the
+	// endpoint IDs are learned by both sides
+	var stream bytes.Buffer
+	connReq := TCPHeader{MsgType: CONNREQ, Src: clientID, Dst: serverID}
+	err := sender.writeMsg(&stream, wireMsg(connReq, ""))
+	if err != nil {
+		t.Fatalf("unable to write CONNREQ: %s", err)
+	}
+	legacyLen := stream.Len()
+	data := TCPHeader{MsgType: DATAMSG, Src: clientID, Dst: serverID}
+	err = sender.writeMsg(&stream, wireMsg(data, msg1))
+	if err != nil {
+		t.Fatalf("unable to write data message: %s", err)
+	}
+	if stream.Len()-legacyLen != frameLenLen+compactHdrLen+len(msg1) {
+		t.Fatalf("data message of %d bytes sent with a legacy header", stream.Len()-legacyLen)
+	}
+	// Endpoints unknown to the remote peer require the legacy header
+	unknown := TCPHeader{MsgType: DATAMSG, Src: "unknown endpoint", Dst: serverID}
+	err = sender.writeMsg(&stream, wireMsg(unknown, msg2))
+	if err != nil {
+		t.Fatalf("unable to write data message: %s", err)
+	}
+
+	tcp := newTCPTransport(&TCPTransportCfg{})
+	reader := newFrameReader(&stream, defaultMTU)
+	expected := []struct {
+		hdr     TCPHeader
+		payload string
+	}{
+		{connReq, ""},
+		{data, msg1},
+		{unknown, msg2},
+	}
+	for i, e := range expected {
+		rx := make([]byte, defaultMTU)
+		_, err := tcp.recvMsg(reader, receiver, rx)
+		if err != nil {
+			t.Fatalf("unable to receive message %d: %s", i, err)
+		}
+		if tcp.GetMsgTypeFromRX(rx) != e.hdr.MsgType {
+			t.Fatalf("message %d: type is %s instead of %s", i, tcp.GetMsgTypeFromRX(rx), e.hdr.MsgType)
+		}
+		if string(tcp.ExtractSrc(rx)) != e.hdr.Src || tcp.ExtractDest(rx) != e.hdr.Dst {
+			t.Fatalf("message %d: invalid source or destination", i)
+		}
+		payload, err := tcp.ExtractPayload(rx)
+		if err != nil {
+			t.Fatalf("unable to extract payload of message %d: %s", i, err)
+		}
+		if string(payload) != e.payload {
+			t.Fatalf("message %d: received %s instead of %s", i, string(payload), e.payload)
+		}
+	}
+}
+
+func doWireServer(t *testing.T, port uint16, expectedVersion uint32, done chan bool) {
+	defer close(done)
+
+	cfg := TCPTransportCfg{
+		Interface: "127.0.0.1",
+		PortLow:   port,
+		PortHigh:  port,
+		Accept:    true,
+	}
+	tcp, err := cfg.Init()
+	if err != nil {
+		t.Errorf("unable to instantiate TCP transport: %s", err)
+		return
+	}
+	defer finiOnceClosed(tcp)
+	if tcp.wire.getVersion() != expectedVersion {
+		t.Errorf("wire header version %d negotiated instead of %d", tcp.wire.getVersion(), expectedVersion)
+		return
+	}
+
+	rx := <-tcp.RecvQueue
+	data, err := tcp.ExtractPayload(rx)
+	if err != nil {
+		t.Errorf("unable to extract payload: %s", err)
+		return
+	}
+	if string(data) != msg1 {
+		t.Errorf("received %s instead of %s", string(data), msg1)
+		return
+	}
+	hdr := TCPHeader{
+		MsgType: DATAMSG,
+		Src:     tcp.ExtractDest(rx),
+		Dst:     string(tcp.ExtractSrc(rx)),
+	}
+	tcp.ReturnRX(rx)
+	err = tcp.SendMsg(hdr, []byte(msg2))
+	if err != nil {
+		t.Errorf("unable to send reply: %s", err)
+	}
+}
+
+func TestWireNegotiation(t *testing.T) {
+	tests := []struct {
+		name            string
+		legacy          bool
+		expectedVersion uint32
+	}{
+		{
+			name:            "compact header",
+			legacy:          false,
+			expectedVersion: compactWireVersion,
+		},
+		{
+			name:            "legacy peer",
+			legacy:          true,
+			expectedVersion: legacyWireVersion,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := uint16(wirePortLow + i)
+			done := make(chan bool)
+			go doWireServer(t, port, tt.expectedVersion, done)
+
+			cfg := TCPTransportCfg{
+				Interface:        "127.0.0.1",
+				PortLow:          port,
+				LegacyWireHeader: tt.legacy,
+			}
+			tcp, err := cfg.Init()
+			if err != nil {
+				t.Fatalf("unable to instantiate TCP transport: %s", err)
+			}
+			defer tcp.Close()
+			_, err = tcp.Connect(clientID)
+			if err != nil {
+				t.Fatalf("connect failed: %s", err)
+			}
+			if tcp.wire.getVersion() != tt.expectedVersion {
+				t.Fatalf("wire header version %d negotiated instead of %d", tcp.wire.getVersion(), tt.expectedVersion)
+			}
+
+			hdr := TCPHeader{
+				MsgType: DATAMSG,
+				Src:     clientID,
+			}
+			err = tcp.SendMsg(hdr, []byte(msg1))
+			if err != nil {
+				t.Fatalf("unable to send message: %s", err)
+			}
+			rx := <-tcp.RecvQueue
+			data, err := tcp.ExtractPayload(rx)
+			if err != nil {
+				t.Fatalf("unable to extract payload: %s", err)
+			}
+			if string(data) != msg2 {
+				t.Fatalf("received %s instead of %s", string(data), msg2)
+			}
+			tcp.ReturnRX(rx)
+
+			// The server is finalized once the connection is closed
+			tcp.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2019 Geoffroy Vallee, All rights reserved
+ * This software is licensed under a 3-clause BSD license. Please consult the
+ * LICENSE.md file distributed with the sources of this project regarding your
+ * rights to use or distribute this software.
+ */
+
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// wsGUID is the GUID used to compute the accept key of the opening
+	// handshake (RFC 6455, section 1.3)
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsFinBit  = 0x80
+	wsMaskBit = 0x80
+
+	// wsMaxControlLen is the maximum size of the payload of a control frame
+	wsMaxControlLen = 125
+)
+
+// wsAcceptKey computes the value of the Sec-WebSocket-Accept header matching
+// the key sent by a client
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsNewKey generates the key sent by a client during the opening handshake
+func wsNewKey() (string, error) {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// wsConn is a connection carrying a byte stream in binary WebSocket messages,
+// once the opening handshake is completed. It makes a WebSocket usable as a
+// net.Conn so that the frames of the TCP transport can be tunneled over it.
+type wsConn struct {
+	net.Conn
+
+	// r is the reader used during the opening handshake, which may already
+	// hold data received after the handshake
+	r *bufio.Reader
+	// client specifies whether the connection is the client side of the
+	// WebSocket, in which case frames are masked
+	client bool
+
+	// remaining is the number of bytes left in the payload of the current frame
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	// wlock serializes writes, including the pongs sent while reading
+	wlock sync.Mutex
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader, client bool) *wsConn {
+	return &wsConn{
+		Conn:   conn,
+		r:      r,
+		client: client,
+	}
+}
+
+// writeFrame writes a single, unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	hdr := make([]byte, 2, 14)
+	hdr[0] = wsFinBit | opcode
+	switch {
+	case len(payload) <= wsMaxControlLen:
+		hdr[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		hdr[1] = 126
+		hdr = hdr[:4]
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+	default:
+		hdr[1] = 127
+		hdr = hdr[:10]
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(payload)))
+	}
+
+	frame := payload
+	if c.client {
+		// Clients must mask all the frames they send
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		hdr[1] |= wsMaskBit
+		hdr = append(hdr, mask[:]...)
+		frame = make([]byte, len(payload))
+		for i := range payload {
+			frame[i] = payload[i] ^ mask[i%4]
+		}
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err := c.Conn.Write(append(hdr, frame...))
+	return err
+}
+
+// readFrameHeader reads the header of the next frame
+func (c *wsConn) readFrameHeader() (byte, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(c.r, hdr[:])
+	if err != nil {
+		return 0, err
+	}
+	opcode := hdr[0] & 0x0F
+	c.masked = hdr[1]&wsMaskBit != 0
+	c.remaining = uint64(hdr[1] &^ wsMaskBit)
+	switch c.remaining {
+	case 126:
+		var size [2]byte
+		_, err = io.ReadFull(c.r, size[:])
+		c.remaining = uint64(binary.BigEndian.Uint16(size[:]))
+	case 127:
+		var size [8]byte
+		_, err = io.ReadFull(c.r, size[:])
+		c.remaining = binary.BigEndian.Uint64(size[:])
+	}
+	if err != nil {
+		return 0, err
+	}
+	if c.masked {
+		_, err = io.ReadFull(c.r, c.mask[:])
+		if err != nil {
+			return 0, err
+		}
+	}
+	c.maskPos = 0
+	return opcode, nil
+}
+
+// readPayload reads data from the payload of the current frame
+func (c *wsConn) readPayload(p []byte) (int, error) {
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// readControl handles a control frame
+func (c *wsConn) readControl(opcode byte) error {
+	if c.remaining > wsMaxControlLen {
+		return fmt.Errorf("invalid WebSocket control frame of %d bytes", c.remaining)
+	}
+	payload := make([]byte, c.remaining)
+	_, err := io.ReadFull(readerFunc(c.readPayload), payload)
+	if err != nil {
+		return err
+	}
+	switch opcode {
+	case wsOpClose:
+		// Echo the close frame, as required to complete the closing handshake
+		c.writeFrame(wsOpClose, payload)
+		return io.EOF
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	}
+	return nil
+}
+
+// Read reads the data of the binary messages received over the WebSocket;
+// control frames are handled transparently
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		opcode, err := c.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsOpContinuation, wsOpBinary, wsOpText:
+			// Messages are only used as a byte stream
+		case wsOpClose, wsOpPing, wsOpPong:
+			err = c.readControl(opcode)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("unknown WebSocket opcode %d", opcode)
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return c.readPayload(p)
+}
+
+// Write sends data as a single binary message
+func (c *wsConn) Write(p []byte) (int, error) {
+	err := c.writeFrame(wsOpBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame, on a best effort basis, and closes the underlying connection
+func (c *wsConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.Conn.Close()
+}
+
+// readerFunc makes a function usable as an io.Reader
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}